@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// Branch es una sucursal/oficina del tenant (configs/{tenant}/branches.json; el formato está
+// en configs/broker/branches.example.json).
+type Branch struct {
+	ID      string  `json:"id"`
+	Name    string  `json:"name"`
+	Address string  `json:"address"`
+	Phone   string  `json:"phone"`
+	Hours   string  `json:"hours"`
+	Lat     float64 `json:"lat"`
+	Lng     float64 `json:"lng"`
+}
+
+// Estructura para mapear el JSON
+type TenantBranchesConfig struct {
+	Branches []Branch `json:"branches"`
+}
+
+func loadBranches(tenant string) ([]Branch, error) {
+	path := filepath.Join(configRoot, tenant, "branches.json")
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("falta %s (formato en branches.example.json)", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("no pude leer %s: %w", path, err)
+	}
+	var cfg TenantBranchesConfig
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return nil, fmt.Errorf("json inválido en %s: %w", path, err)
+	}
+	if len(cfg.Branches) == 0 {
+		return nil, fmt.Errorf("branches.json de %s no tiene sucursales", tenant)
+	}
+	return cfg.Branches, nil
+}
+
+// haversineKm calcula la distancia en km entre dos coordenadas.
+func haversineKm(lat1, lng1, lat2, lng2 float64) float64 {
+	const earthRadiusKm = 6371.0
+	toRad := func(d float64) float64 { return d * math.Pi / 180 }
+
+	dLat := toRad(lat2 - lat1)
+	dLng := toRad(lng2 - lng1)
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(toRad(lat1))*math.Cos(toRad(lat2))*math.Sin(dLng/2)*math.Sin(dLng/2)
+	return earthRadiusKm * 2 * math.Atan2(math.Sqrt(a), math.Sqrt(1-a))
+}
+
+func nearestBranch(branches []Branch, lat, lng float64) (Branch, float64) {
+	var best Branch
+	bestDist := math.MaxFloat64
+	for _, b := range branches {
+		d := haversineKm(lat, lng, b.Lat, b.Lng)
+		if d < bestDist {
+			best, bestDist = b, d
+		}
+	}
+	return best, bestDist
+}
+
+// actionNearestBranch usa la ubicación compartida por el usuario (lat/lng en sesión)
+// y devuelve los datos de la sucursal más cercana.
+func actionNearestBranch(tenant, userID string, sess *UserSession) (map[string]string, error) {
+	lat, errLat := strconv.ParseFloat(sess.Data["lat"], 64)
+	lng, errLng := strconv.ParseFloat(sess.Data["lng"], 64)
+	if errLat != nil || errLng != nil {
+		return nil, fmt.Errorf("el usuario no compartió una ubicación válida")
+	}
+
+	branches, err := loadBranches(tenant)
+	if err != nil {
+		return nil, err
+	}
+
+	b, dist := nearestBranch(branches, lat, lng)
+	log.Printf("📍 Sucursal más cercana para %s: %s (%.1f km)", userID, b.Name, dist)
+
+	return map[string]string{
+		"branch_id":          b.ID,
+		"branch_name":        b.Name,
+		"branch_address":     b.Address,
+		"branch_phone":       b.Phone,
+		"branch_hours":       b.Hours,
+		"branch_distance_km": strconv.FormatFloat(dist, 'f', 1, 64),
+		"branch_maps_url":    fmt.Sprintf("https://www.google.com/maps/search/?api=1&query=%f,%f", b.Lat, b.Lng),
+	}, nil
+}
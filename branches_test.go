@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestHaversineKm(t *testing.T) {
+	tests := []struct {
+		name                   string
+		lat1, lng1, lat2, lng2 float64
+		want                   float64
+	}{
+		{"mismo punto", -34.6037, -58.3816, -34.6037, -58.3816, 0},
+		{"un grado de latitud", 0, 0, 1, 0, 111.19},
+		{"Buenos Aires a Córdoba", -34.6037, -58.3816, -31.4201, -64.1888, 646.3},
+		{"cruza el antimeridiano", 0, 179.5, 0, -179.5, 111.19},
+	}
+	for _, tt := range tests {
+		if got := haversineKm(tt.lat1, tt.lng1, tt.lat2, tt.lng2); math.Abs(got-tt.want) > 1 {
+			t.Errorf("%s: %.2f km, esperaba %.2f", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestNearestBranch(t *testing.T) {
+	branches := []Branch{
+		{ID: "centro", Lat: -34.603722, Lng: -58.381592},
+		{ID: "belgrano", Lat: -34.562260, Lng: -58.456290},
+		{ID: "lomas", Lat: -34.760650, Lng: -58.401510},
+	}
+	tests := []struct {
+		name     string
+		lat, lng float64
+		want     string
+	}{
+		{"Obelisco", -34.6037, -58.3816, "centro"},
+		{"Núñez", -34.5450, -58.4640, "belgrano"},
+		{"Banfield", -34.7440, -58.3970, "lomas"},
+	}
+	for _, tt := range tests {
+		if got, _ := nearestBranch(branches, tt.lat, tt.lng); got.ID != tt.want {
+			t.Errorf("%s: %s, esperaba %s", tt.name, got.ID, tt.want)
+		}
+	}
+}
+
+func TestActionNearestBranchRequiresLocation(t *testing.T) {
+	tests := []map[string]string{
+		nil,
+		{"lat": "-34.6"},
+		{"lat": "abc", "lng": "-58.4"},
+	}
+	for _, data := range tests {
+		if _, err := actionNearestBranch("broker", "5491100000000", &UserSession{Data: data}); err == nil {
+			t.Errorf("data=%v: esperaba error por ubicación inválida", data)
+		}
+	}
+}
+
+func TestBranchesExampleFormat(t *testing.T) {
+	b, err := os.ReadFile(filepath.Join(configRoot, "broker", "branches.example.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cfg TenantBranchesConfig
+	if err := json.Unmarshal(b, &cfg); err != nil || len(cfg.Branches) == 0 {
+		t.Fatalf("branches.example.json: %d sucursales (%v)", len(cfg.Branches), err)
+	}
+	for _, br := range cfg.Branches {
+		if br.ID == "" || br.Name == "" || br.Lat == 0 || br.Lng == 0 {
+			t.Errorf("sucursal incompleta: %+v", br)
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// ---------------------
+// Horario de atención (tenants.json -> business_hours)
+// ---------------------
+
+// BusinessHoursException cambia el horario de una fecha puntual (ej: 24/12 de 09:00 a 13:00),
+// o la cierra (closed).
+type BusinessHoursException struct {
+	Date   string `json:"date"` // YYYY-MM-DD
+	Closed bool   `json:"closed,omitempty"`
+	Start  string `json:"start,omitempty"`
+	End    string `json:"end,omitempty"`
+}
+
+// Cuántos días hacia adelante se busca la próxima apertura.
+const nextOpenSearchDays = 60
+
+var weekdaysES = [...]string{"domingo", "lunes", "martes", "miércoles", "jueves", "viernes", "sábado"}
+
+// parseHHMM devuelve el horario "HH:MM" del día (24:00 = medianoche siguiente).
+func parseHHMM(day time.Time, hhmm string) time.Time {
+	var h, m int
+	fmt.Sscanf(hhmm, "%d:%d", &h, &m)
+	return time.Date(day.Year(), day.Month(), day.Day(), h, m, 0, 0, day.Location())
+}
+
+// window devuelve el horario de atención del día (en la zona de day). open=false si ese día no se atiende.
+func (bh *BusinessHours) window(day time.Time) (start, end time.Time, open bool) {
+	date := day.Format("2006-01-02")
+
+	for _, ex := range bh.Exceptions {
+		if ex.Date == date {
+			if ex.Closed {
+				return time.Time{}, time.Time{}, false
+			}
+			return parseHHMM(day, ex.Start), parseHHMM(day, ex.End), true
+		}
+	}
+	for _, h := range bh.Holidays {
+		if h == date {
+			return time.Time{}, time.Time{}, false
+		}
+	}
+
+	workDays := bh.WorkDays
+	if len(workDays) == 0 {
+		workDays = []int{1, 2, 3, 4, 5}
+	}
+	for _, d := range workDays {
+		if time.Weekday(d) == day.Weekday() {
+			return parseHHMM(day, bh.Start), parseHHMM(day, bh.End), true
+		}
+	}
+	return time.Time{}, time.Time{}, false
+}
+
+// IsOpen indica si now cae dentro del horario de atención.
+func (bh *BusinessHours) IsOpen(now time.Time) bool {
+	start, end, open := bh.window(now)
+	return open && !now.Before(start) && now.Before(end)
+}
+
+// NextOpen devuelve el próximo momento de atención (now si está abierto). ok=false si no hay
+// apertura en los próximos nextOpenSearchDays días.
+func (bh *BusinessHours) NextOpen(now time.Time) (time.Time, bool) {
+	for i := 0; i <= nextOpenSearchDays; i++ {
+		day := now.AddDate(0, 0, i)
+		start, end, open := bh.window(day)
+		if !open || !now.Before(end) {
+			continue
+		}
+		if now.After(start) {
+			return now, true
+		}
+		return start, true
+	}
+	return time.Time{}, false
+}
+
+// formatNextOpen lo dice como lo leería el usuario: "hoy a las 15:00", "mañana a las 09:00",
+// "el lunes a las 09:00" o "el 02/01 a las 09:00".
+func formatNextOpen(t, now time.Time) string {
+	at := "a las " + t.Format("15:04")
+	y1, m1, d1 := now.Date()
+	days := int(time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location()).
+		Sub(time.Date(y1, m1, d1, 0, 0, 0, 0, now.Location())).Hours() / 24)
+	switch {
+	case days == 0:
+		return "hoy " + at
+	case days == 1:
+		return "mañana " + at
+	case days < 7:
+		return "el " + weekdaysES[t.Weekday()] + " " + at
+	default:
+		return "el " + t.Format("02/01") + " " + at
+	}
+}
+
+// businessHoursVars expone el horario del tenant al flow: is_open ("true"/"false") y next_open.
+// Un tenant sin business_hours se considera siempre abierto.
+func businessHoursVars(tenant string, now time.Time) map[string]string {
+	vars := map[string]string{"is_open": "true", "next_open": ""}
+	if tenantRegistry == nil {
+		return vars
+	}
+	t, ok := tenantRegistry.Config(tenant)
+	if !ok || t.BusinessHours == nil {
+		return vars
+	}
+
+	now = now.In(tenantLocation(tenant))
+	if t.BusinessHours.IsOpen(now) {
+		return vars
+	}
+	vars["is_open"] = "false"
+	if next, ok := t.BusinessHours.NextOpen(now); ok {
+		vars["next_open"] = formatNextOpen(next, now)
+	}
+	return vars
+}
+
+// validateBusinessHours devuelve los errores de configuración del horario del tenant.
+func validateBusinessHours(tenant string, bh *BusinessHours) []string {
+	var errs []string
+	validRange := func(what, start, end string) {
+		if !hhmmRe.MatchString(start) || !hhmmRe.MatchString(end) {
+			errs = append(errs, fmt.Sprintf("tenant=%s %s start/end deben ser HH:MM (%q-%q)", tenant, what, start, end))
+		} else if start >= end {
+			errs = append(errs, fmt.Sprintf("tenant=%s %s start >= end (%s-%s)", tenant, what, start, end))
+		}
+	}
+	validDate := func(what, date string) bool {
+		if _, err := time.Parse("2006-01-02", date); err != nil {
+			errs = append(errs, fmt.Sprintf("tenant=%s %s fecha inválida %q (YYYY-MM-DD)", tenant, what, date))
+			return false
+		}
+		return true
+	}
+
+	validRange("business_hours", bh.Start, bh.End)
+	for _, d := range bh.WorkDays {
+		if d < 0 || d > 6 {
+			errs = append(errs, fmt.Sprintf("tenant=%s business_hours work_days fuera de rango: %d", tenant, d))
+		}
+	}
+	for _, h := range bh.Holidays {
+		validDate("business_hours.holidays", h)
+	}
+	for _, ex := range bh.Exceptions {
+		if validDate("business_hours.exceptions", ex.Date) && !ex.Closed {
+			validRange("business_hours.exceptions "+ex.Date, ex.Start, ex.End)
+		}
+	}
+	return errs
+}
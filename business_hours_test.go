@@ -0,0 +1,73 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBusinessHoursNextOpen(t *testing.T) {
+	loc, err := time.LoadLocation("America/Argentina/Buenos_Aires")
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := func(s string) time.Time {
+		tm, err := time.ParseInLocation("2006-01-02 15:04", s, loc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tm
+	}
+	bh := &BusinessHours{
+		WorkDays:   []int{1, 2, 3, 4, 5},
+		Start:      "09:00",
+		End:        "18:00",
+		Holidays:   []string{"2026-12-25", "2027-01-01"},
+		Exceptions: []BusinessHoursException{{Date: "2026-12-24", Start: "09:00", End: "13:00"}},
+	}
+	night := &BusinessHours{WorkDays: []int{5, 6}, Start: "20:00", End: "24:00"}
+
+	tests := []struct {
+		name string
+		bh   *BusinessHours
+		now  string
+		want string
+		text string
+	}{
+		{"abierto", bh, "2026-10-16 10:30", "2026-10-16 10:30", "hoy a las 10:30"},
+		{"antes de abrir", bh, "2026-10-20 07:15", "2026-10-20 09:00", "hoy a las 09:00"},
+		{"a la hora de cierre", bh, "2026-10-20 18:00", "2026-10-21 09:00", "mañana a las 09:00"},
+		{"viernes a la noche", bh, "2026-10-16 23:30", "2026-10-19 09:00", "el lunes a las 09:00"},
+		{"sábado", bh, "2026-10-17 12:00", "2026-10-19 09:00", "el lunes a las 09:00"},
+		{"domingo a medianoche", bh, "2026-10-18 00:00", "2026-10-19 09:00", "mañana a las 09:00"},
+		{"pasada la medianoche de un día hábil", bh, "2026-10-20 00:05", "2026-10-20 09:00", "hoy a las 09:00"},
+		{"horario reducido del 24/12", bh, "2026-12-24 14:00", "2026-12-28 09:00", "el lunes a las 09:00"},
+		{"feriado en viernes", bh, "2026-12-31 19:00", "2027-01-04 09:00", "el lunes a las 09:00"},
+		{"cierra a las 24:00", night, "2026-10-16 23:59", "2026-10-16 23:59", "hoy a las 23:59"},
+		{"recién cerrado a medianoche", night, "2026-10-18 00:00", "2026-10-23 20:00", "el viernes a las 20:00"},
+	}
+	for _, tt := range tests {
+		now := at(tt.now)
+		got, ok := tt.bh.NextOpen(now)
+		if !ok || !got.Equal(at(tt.want)) {
+			t.Errorf("%s: NextOpen(%s) = %v, %v; esperaba %s", tt.name, tt.now, got, ok, tt.want)
+			continue
+		}
+		if text := formatNextOpen(got, now); text != tt.text {
+			t.Errorf("%s: formatNextOpen = %q, esperaba %q", tt.name, text, tt.text)
+		}
+		if open := tt.bh.IsOpen(now); open != (tt.now == tt.want) {
+			t.Errorf("%s: IsOpen = %v", tt.name, open)
+		}
+	}
+}
+
+func TestBusinessHoursNextOpenNeverOpens(t *testing.T) {
+	bh := &BusinessHours{WorkDays: []int{1}, Start: "09:00", End: "18:00"}
+	now := time.Date(2026, 10, 20, 12, 0, 0, 0, time.UTC)
+	for d := 0; d <= nextOpenSearchDays; d++ {
+		bh.Exceptions = append(bh.Exceptions, BusinessHoursException{Date: now.AddDate(0, 0, d).Format("2006-01-02"), Closed: true})
+	}
+	if next, ok := bh.NextOpen(now); ok {
+		t.Errorf("todo cerrado: NextOpen = %v", next)
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"sync"
 	"time"
 
 	"google.golang.org/api/calendar/v3"
@@ -18,6 +19,7 @@ type CalendarService struct {
 	StartHour int
 	EndHour   int
 	WorkDays  []int // 0=Domingo, 1=Lunes...
+	loc       *time.Location
 }
 
 // Estructura para mapear el JSON
@@ -28,14 +30,36 @@ type TenantCalendarConfig struct {
 	WorkDays   []int  `json:"work_days"`
 }
 
-func NewCalendarService(tenant string) (*CalendarService, error) {
-	ctx := context.Background()
-	credsFile := os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
-	if credsFile == "" {
-		return nil, fmt.Errorf("GOOGLE_APPLICATION_CREDENTIALS no está en .env")
+// Cache de calendar.json por tenant. El watcher de configs (config_watcher.go) la
+// reemplaza solo si el archivo nuevo es válido.
+var calendarConfigs = struct {
+	sync.RWMutex
+	m map[string]TenantCalendarConfig
+}{m: make(map[string]TenantCalendarConfig)}
+
+func getCalendarConfig(tenant string) (TenantCalendarConfig, error) {
+	calendarConfigs.RLock()
+	cfg, ok := calendarConfigs.m[tenant]
+	calendarConfigs.RUnlock()
+	if ok {
+		return cfg, nil
 	}
 
-	configRoot := "configs"
+	cfg, err := loadCalendarConfig(tenant)
+	if err != nil {
+		return cfg, err
+	}
+	setCalendarConfig(tenant, cfg)
+	return cfg, nil
+}
+
+func setCalendarConfig(tenant string, cfg TenantCalendarConfig) {
+	calendarConfigs.Lock()
+	defer calendarConfigs.Unlock()
+	calendarConfigs.m[tenant] = cfg
+}
+
+func loadCalendarConfig(tenant string) (TenantCalendarConfig, error) {
 	configPath := filepath.Join(configRoot, tenant, "calendar.json")
 
 	// Valores por defecto (si faltan en el JSON)
@@ -49,10 +73,10 @@ func NewCalendarService(tenant string) (*CalendarService, error) {
 	if _, err := os.Stat(configPath); err == nil {
 		b, err := os.ReadFile(configPath)
 		if err != nil {
-			return nil, fmt.Errorf("error leyendo config calendario: %w", err)
+			return cfg, fmt.Errorf("error leyendo config calendario: %w", err)
 		}
 		if err := json.Unmarshal(b, &cfg); err != nil {
-			return nil, fmt.Errorf("json calendario inválido: %w", err)
+			return cfg, fmt.Errorf("json calendario inválido: %w", err)
 		}
 	} else {
 		// Fallback por env vars si no hay JSON (retrocompatibilidad)
@@ -60,7 +84,7 @@ func NewCalendarService(tenant string) (*CalendarService, error) {
 	}
 
 	if cfg.CalendarID == "" {
-		return nil, fmt.Errorf("no se encontró calendar_id para el tenant %s", tenant)
+		return cfg, fmt.Errorf("no se encontró calendar_id para el tenant %s", tenant)
 	}
 
 	// Validaciones básicas para que no explote el loop
@@ -74,6 +98,21 @@ func NewCalendarService(tenant string) (*CalendarService, error) {
 		cfg.WorkDays = []int{1, 2, 3, 4, 5}
 	}
 
+	return cfg, nil
+}
+
+func NewCalendarService(tenant string) (*CalendarService, error) {
+	ctx := context.Background()
+	credsFile := os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
+	if credsFile == "" {
+		return nil, fmt.Errorf("GOOGLE_APPLICATION_CREDENTIALS no está en .env")
+	}
+
+	cfg, err := getCalendarConfig(tenant)
+	if err != nil {
+		return nil, err
+	}
+
 	srv, err := calendar.NewService(ctx, option.WithCredentialsFile(credsFile))
 	if err != nil {
 		return nil, fmt.Errorf("error creando cliente calendar: %v", err)
@@ -85,6 +124,7 @@ func NewCalendarService(tenant string) (*CalendarService, error) {
 		StartHour: cfg.StartHour,
 		EndHour:   cfg.EndHour,
 		WorkDays:  cfg.WorkDays,
+		loc:       tenantLocation(tenant),
 	}, nil
 }
 
@@ -95,12 +135,8 @@ type Slot struct {
 }
 
 func (c *CalendarService) GetNextAvailableSlots() ([]Slot, error) {
-	// 1. Cargamos la zona horaria
-	loc, err := time.LoadLocation("America/Argentina/Buenos_Aires")
-	if err != nil {
-		fmt.Printf("⚠️ No se pudo cargar zona horaria, usando Local: %v\n", err)
-		loc = time.Local
-	}
+	// 1. Zona horaria del tenant (tenants.json)
+	loc := c.loc
 
 	now := time.Now().In(loc)
 
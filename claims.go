@@ -0,0 +1,587 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ---------------------
+// Siniestros (claims)
+// ---------------------
+
+// Estados de un siniestro. El staff los cambia por /api/claims/{número}/status.
+const (
+	ClaimReceived    = "recibido"
+	ClaimInProgress  = "en_gestion"
+	ClaimWaitingDocs = "esperando_documentacion"
+	ClaimWithInsurer = "en_compania"
+	ClaimClosed      = "cerrado"
+	ClaimRejected    = "rechazado"
+)
+
+const (
+	claimNumberPrefix = "SIN"
+	// Un create_claim dentro de esta ventana completa el siniestro recién abierto en vez de crear otro.
+	claimMergeWindow  = 30 * time.Minute
+	maxClaimsInLookup = 3
+
+	claimLookupNoMatch = "No encontré siniestros con esos datos 🤔\nSi lo denunciaste desde otro número, mandame el Nº de siniestro (ej: SIN-2026-00042) junto con el DNI del titular, o pedí hablar con un asesor."
+)
+
+var claimStatusLabels = map[string]string{
+	ClaimReceived:    "Recibido",
+	ClaimInProgress:  "En gestión",
+	ClaimWaitingDocs: "Esperando documentación",
+	ClaimWithInsurer: "En la compañía",
+	ClaimClosed:      "Cerrado",
+	ClaimRejected:    "Rechazado",
+}
+
+var (
+	claimNumberRe = regexp.MustCompile(`(?i)\b` + claimNumberPrefix + `-\d{4}-\d+\b`)
+	dniRe         = regexp.MustCompile(`\b\d{1,2}\.?\d{3}\.?\d{3}\b`)
+)
+
+type ClaimEvent struct {
+	Status string    `json:"status"`
+	Note   string    `json:"note,omitempty"`
+	By     string    `json:"by"`
+	At     time.Time `json:"at"`
+}
+
+type Claim struct {
+	Number      string       `json:"number"`
+	Tenant      string       `json:"tenant"`
+	WaID        string       `json:"wa_id"`
+	PhoneID     string       `json:"phone_number_id"`
+	Name        string       `json:"name"`
+	DNI         string       `json:"dni,omitempty"`
+	Type        string       `json:"type"`
+	Urgent      bool         `json:"urgent"`
+	Description string       `json:"description"`
+	Media       []MediaRef   `json:"media"`
+	Status      string       `json:"status"`
+	History     []ClaimEvent `json:"history"`
+	CreatedAt   time.Time    `json:"created_at"`
+	UpdatedAt   time.Time    `json:"updated_at"`
+}
+
+// ClaimStore guarda los siniestros de cada tenant en {dataDir}/{tenant}/claims.json
+// (se reescribe entero en cada cambio; se carga la primera vez que se usa el tenant).
+type ClaimStore struct {
+	mu     sync.Mutex
+	dir    string
+	claims map[string]map[string]*Claim // tenant -> número -> claim
+}
+
+func NewClaimStore(dir string) *ClaimStore {
+	return &ClaimStore{dir: dir, claims: make(map[string]map[string]*Claim)}
+}
+
+// claimStore lo arma NewApp, después de cargar el .env (DATA_DIR): lo usan las actions de siniestros.
+var claimStore *ClaimStore
+
+func (s *ClaimStore) path(tenant string) string {
+	return filepath.Join(s.dir, tenant, "claims.json")
+}
+
+// tenantClaims devuelve los siniestros del tenant (cargándolos de disco). Requiere s.mu.
+func (s *ClaimStore) tenantClaims(tenant string) (map[string]*Claim, error) {
+	if m, ok := s.claims[tenant]; ok {
+		return m, nil
+	}
+	if tenant == "" || strings.ContainsAny(tenant, `/\.`) {
+		return nil, fmt.Errorf("tenant inválido: %q", tenant)
+	}
+	m := make(map[string]*Claim)
+	b, err := os.ReadFile(s.path(tenant))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		var list []*Claim
+		if err := json.Unmarshal(b, &list); err != nil {
+			return nil, fmt.Errorf("json inválido en %s: %w", s.path(tenant), err)
+		}
+		for _, c := range list {
+			m[c.Number] = c
+		}
+	}
+	s.claims[tenant] = m
+	return m, nil
+}
+
+// persist reescribe el archivo del tenant (tmp + rename). Requiere s.mu.
+func (s *ClaimStore) persist(tenant string) error {
+	list := make([]*Claim, 0, len(s.claims[tenant]))
+	for _, c := range s.claims[tenant] {
+		list = append(list, c)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.Before(list[j].CreatedAt) })
+	b, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	p := s.path(tenant)
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		return err
+	}
+	tmp := p + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, p)
+}
+
+// nextClaimNumber arma el próximo número del año: SIN-2026-00042.
+func nextClaimNumber(m map[string]*Claim, now time.Time) string {
+	prefix := fmt.Sprintf("%s-%d-", claimNumberPrefix, now.Year())
+	max := 0
+	for n := range m {
+		if seq, ok := strings.CutPrefix(n, prefix); ok {
+			if v, err := strconv.Atoi(seq); err == nil && v > max {
+				max = v
+			}
+		}
+	}
+	return fmt.Sprintf("%s%05d", prefix, max+1)
+}
+
+// Create da de alta el siniestro con número nuevo y estado "recibido".
+func (s *ClaimStore) Create(c Claim) (Claim, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m, err := s.tenantClaims(c.Tenant)
+	if err != nil {
+		return Claim{}, err
+	}
+
+	now := time.Now()
+	c.Number = nextClaimNumber(m, now.In(tenantLocation(c.Tenant)))
+	c.Status = ClaimReceived
+	c.History = []ClaimEvent{{Status: ClaimReceived, By: "bot", At: now}}
+	c.CreatedAt, c.UpdatedAt = now, now
+	m[c.Number] = &c
+	if err := s.persist(c.Tenant); err != nil {
+		delete(m, c.Number)
+		return Claim{}, fmt.Errorf("no se pudo guardar el siniestro: %w", err)
+	}
+	return c, nil
+}
+
+// Update aplica fn al siniestro y lo persiste.
+func (s *ClaimStore) Update(tenant, number string, fn func(*Claim) error) (Claim, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m, err := s.tenantClaims(tenant)
+	if err != nil {
+		return Claim{}, err
+	}
+	c, ok := m[strings.ToUpper(number)]
+	if !ok {
+		return Claim{}, fmt.Errorf("siniestro %s no encontrado", number)
+	}
+	updated := *c
+	updated.Media = append([]MediaRef(nil), c.Media...)
+	updated.History = append([]ClaimEvent(nil), c.History...)
+	if err := fn(&updated); err != nil {
+		return Claim{}, err
+	}
+	updated.UpdatedAt = time.Now()
+	m[updated.Number] = &updated
+	if err := s.persist(tenant); err != nil {
+		m[c.Number] = c
+		return Claim{}, fmt.Errorf("no se pudo guardar el siniestro: %w", err)
+	}
+	return updated, nil
+}
+
+func (s *ClaimStore) Get(tenant, number string) (Claim, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m, err := s.tenantClaims(tenant)
+	if err != nil {
+		log.Printf("⚠️ claims %s: %v", tenant, err)
+		return Claim{}, false
+	}
+	c, ok := m[strings.ToUpper(number)]
+	if !ok {
+		return Claim{}, false
+	}
+	return *c, true
+}
+
+// ClaimFilter: campos vacíos no filtran.
+type ClaimFilter struct {
+	Status string
+	DNI    string
+	WaID   string
+}
+
+// List devuelve los siniestros del tenant que cumplen el filtro, más nuevos primero.
+func (s *ClaimStore) List(tenant string, f ClaimFilter) ([]Claim, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m, err := s.tenantClaims(tenant)
+	if err != nil {
+		return nil, err
+	}
+	out := []Claim{}
+	for _, c := range m {
+		if (f.Status != "" && c.Status != f.Status) || (f.DNI != "" && c.DNI != f.DNI) || (f.WaID != "" && c.WaID != f.WaID) {
+			continue
+		}
+		out = append(out, *c)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].CreatedAt.After(out[j].CreatedAt) })
+	return out, nil
+}
+
+// findDNI extrae el primer DNI (7-8 dígitos, con o sin puntos) del texto.
+func findDNI(text string) string {
+	return strings.ReplaceAll(dniRe.FindString(text), ".", "")
+}
+
+// actionCreateClaim registra el siniestro con lo capturado (save_as: claim_type, claim_details,
+// claim_urgent_details) y los adjuntos pendientes. Si el usuario ya abrió uno hace poco
+// (ej: primero lo marcó urgente y después cargó el detalle) se completa ese mismo.
+// Vars: claim_number, claim_status, claim_new ("false" si completó uno existente)
+func actionCreateClaim(tenant, userID string, session *UserSession) (map[string]string, error) {
+	claimType := session.Inputs["claim_type"]
+	urgentDetails := session.Inputs["claim_urgent_details"]
+	details := session.Inputs["claim_details"]
+	description := strings.TrimSpace(strings.Join([]string{urgentDetails, details}, "\n\n"))
+	media := session.PendingMedia
+
+	var claim Claim
+	var err error
+	merged := false
+	if prev, ok := claimStore.Get(tenant, session.Data["claim_number"]); ok && prev.WaID == userID &&
+		prev.Status == ClaimReceived && time.Since(prev.CreatedAt) < claimMergeWindow {
+		merged = true
+		claim, err = claimStore.Update(tenant, prev.Number, func(c *Claim) error {
+			if claimType != "" {
+				c.Type = claimType
+			}
+			if description != "" {
+				c.Description = strings.TrimSpace(c.Description + "\n\n" + description)
+			}
+			if c.DNI == "" {
+				c.DNI = findDNI(description)
+			}
+			c.Urgent = c.Urgent || urgentDetails != ""
+			c.Media = append(c.Media, media...)
+			return nil
+		})
+	} else {
+		claim, err = claimStore.Create(Claim{
+			Tenant:      tenant,
+			WaID:        userID,
+			PhoneID:     session.PhoneID,
+			Name:        session.Data["name"],
+			DNI:         findDNI(description),
+			Type:        claimType,
+			Urgent:      urgentDetails != "",
+			Description: description,
+			Media:       append([]MediaRef{}, media...),
+		})
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Lo ya registrado no se vuelve a usar en el próximo siniestro
+	for _, k := range []string{"claim_type", "claim_details", "claim_urgent_details"} {
+		delete(session.Inputs, k)
+	}
+	session.PendingMedia = nil
+	session.Data["claim_number"] = claim.Number
+
+	log.Printf("🚨 Siniestro %s (tenant=%s tipo=%q urgente=%v adjuntos=%d)", claim.Number, tenant, claim.Type, claim.Urgent, len(claim.Media))
+	if claim.Urgent {
+		alertOperator(tenant, fmt.Sprintf("🚨 Siniestro URGENTE %s de %s (%s)", claim.Number, claim.Name, userID))
+	}
+	return map[string]string{
+		"claim_number": claim.Number,
+		"claim_status": claimStatusLabels[claim.Status],
+		"claim_new":    strconv.FormatBool(!merged),
+	}, nil
+}
+
+// actionAttachClaimMedia suma los adjuntos pendientes al último siniestro del usuario.
+// Vars: claim_media_count
+func actionAttachClaimMedia(tenant, userID string, session *UserSession) (map[string]string, error) {
+	number := session.Data["claim_number"]
+	if number == "" {
+		return nil, fmt.Errorf("no hay siniestro en sesión para asociar adjuntos")
+	}
+	media := session.PendingMedia
+	claim, err := claimStore.Update(tenant, number, func(c *Claim) error {
+		if c.WaID != userID {
+			return fmt.Errorf("el siniestro %s no es de %s", number, userID)
+		}
+		c.Media = append(c.Media, media...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	session.PendingMedia = nil
+	log.Printf("📎 %d adjunto(s) sumados al siniestro %s", len(media), number)
+	return map[string]string{
+		"claim_number":      claim.Number,
+		"claim_media_count": strconv.Itoa(len(claim.Media)),
+	}, nil
+}
+
+// actionClaimStatusLookup busca los siniestros del usuario (texto capturado con save_as: claim_query).
+// Los números son correlativos y un DNI lo puede saber cualquiera: sólo se muestran los siniestros
+// abiertos desde este WhatsApp o, si lo hizo desde otro número, el que coincida en número y DNI.
+// Vars: claim_found ("true"/"false"), claim_status_text
+func actionClaimStatusLookup(tenant, userID string, session *UserSession) (map[string]string, error) {
+	query := session.Inputs["claim_query"]
+
+	var claims []Claim
+	if number := claimNumberRe.FindString(query); number != "" {
+		dni := findDNI(strings.Replace(query, number, "", 1))
+		if c, ok := claimStore.Get(tenant, number); ok && (c.WaID == userID || (dni != "" && c.DNI == dni)) {
+			claims = []Claim{c}
+		}
+	} else {
+		var err error
+		if claims, err = claimStore.List(tenant, ClaimFilter{WaID: userID}); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(claims) == 0 {
+		return map[string]string{"claim_found": "false", "claim_status_text": claimLookupNoMatch}, nil
+	}
+	if len(claims) > maxClaimsInLookup {
+		claims = claims[:maxClaimsInLookup]
+	}
+	loc := tenantLocation(tenant)
+	var parts []string
+	for _, c := range claims {
+		part := fmt.Sprintf("🧾 *%s*", c.Number)
+		if c.Type != "" {
+			part += " (" + c.Type + ")"
+		}
+		part += fmt.Sprintf("\nEstado: *%s*\nÚltima actualización: %s", claimStatusLabels[c.Status], c.UpdatedAt.In(loc).Format("02/01 15:04"))
+		parts = append(parts, part)
+	}
+	return map[string]string{"claim_found": "true", "claim_status_text": strings.Join(parts, "\n\n")}, nil
+}
+
+// notifyClaimStatus avisa al usuario el cambio de estado con el template configurado
+// en el flow (claim_status_template). Parámetros del body: nombre, número, estado, nota.
+func (a *App) notifyClaimStatus(c Claim, note string) error {
+	cfg, err := a.currentFlow(c.Tenant)
+	if err != nil {
+		return err
+	}
+	tpl := cfg.ClaimStatusTemplate
+	if tpl == nil {
+		return fmt.Errorf("el flow de %s no define claim_status_template", c.Tenant)
+	}
+	waClient, err := a.clients.Get(c.PhoneID)
+	if err != nil {
+		return err
+	}
+
+	lang := tpl.Language
+	if lang == "" {
+		lang = "es_AR"
+		if t, ok := a.resolver.Config(c.Tenant); ok && t.Locale != "" {
+			lang = t.Locale
+		}
+	}
+	if note == "" {
+		note = "-"
+	}
+	name := c.Name
+	if name == "" {
+		name = "👋"
+	}
+	msgID, err := waClient.sendTemplate(c.WaID, tpl.Name, lang, []string{name, c.Number, claimStatusLabels[c.Status], note})
+	if err != nil {
+		return err
+	}
+	a.messages.RecordOutbound(c.Tenant, c.WaID, "CLAIM_STATUS", msgID)
+	a.transcripts.Append(c.Tenant, c.WaID, TranscriptEntry{
+		Direction: "out",
+		State:     "CLAIM_STATUS",
+		Type:      "template",
+		Text:      fmt.Sprintf("[%s] %s: %s (%s)", tpl.Name, c.Number, claimStatusLabels[c.Status], note),
+		MessageID: msgID,
+	})
+	return nil
+}
+
+// API de siniestros para el staff (mismos tokens que el inbox, ver inbox.go):
+//
+//	GET  /api/claims?tenant=broker[&status=…][&dni=…][&wa_id=…] -> listado
+//	GET  /api/claims/{número}?tenant=broker                     -> detalle
+//	POST /api/claims/{número}/status {tenant, status, note, notify} -> cambia el estado (y avisa por template)
+//	GET  /api/claims/{número}/media/{media_id}?tenant=broker    -> descarga un adjunto
+func (a *App) handleClaimsAPI(w http.ResponseWriter, r *http.Request) {
+	agent, ok := a.authenticateAgent(w, r)
+	if !ok {
+		return
+	}
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/claims"), "/"), "/")
+
+	if r.Method == http.MethodPost && len(parts) == 2 && parts[1] == "status" {
+		a.handleClaimStatusUpdate(w, r, agent, parts[0])
+		return
+	}
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	q := r.URL.Query()
+	tenant := q.Get("tenant")
+	if tenant == "" {
+		tenant = agent.Tenant
+	}
+	if tenant == "" || !agent.canAccess(tenant) {
+		http.Error(w, "tenant inválido", http.StatusForbidden)
+		return
+	}
+
+	switch {
+	case parts[0] == "":
+		claims, err := a.claims.List(tenant, ClaimFilter{Status: q.Get("status"), DNI: q.Get("dni"), WaID: q.Get("wa_id")})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, claims)
+	case len(parts) == 1:
+		c, found := a.claims.Get(tenant, parts[0])
+		if !found {
+			http.Error(w, "siniestro no encontrado", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, c)
+	case len(parts) == 3 && parts[1] == "media":
+		a.serveClaimMedia(w, tenant, parts[0], parts[2])
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (a *App) handleClaimStatusUpdate(w http.ResponseWriter, r *http.Request, agent inboxAgent, number string) {
+	var req struct {
+		Tenant string `json:"tenant"`
+		Status string `json:"status"`
+		Note   string `json:"note"`
+		Notify bool   `json:"notify"`
+	}
+	// Con Basic auth el navegador manda las credenciales solo: un form de otro sitio (text/plain)
+	// podría cambiar el estado y mandarle el template al cliente. application/json exige preflight.
+	if !strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		http.Error(w, "se espera application/json", http.StatusUnsupportedMediaType)
+		return
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "json inválido", http.StatusBadRequest)
+		return
+	}
+	if req.Tenant == "" {
+		req.Tenant = agent.Tenant
+	}
+	if req.Tenant == "" || !agent.canAccess(req.Tenant) {
+		http.Error(w, "tenant inválido", http.StatusForbidden)
+		return
+	}
+	if _, ok := claimStatusLabels[req.Status]; !ok {
+		http.Error(w, fmt.Sprintf("status inválido: %q", req.Status), http.StatusBadRequest)
+		return
+	}
+
+	claim, err := a.claims.Update(req.Tenant, number, func(c *Claim) error {
+		c.Status = req.Status
+		c.History = append(c.History, ClaimEvent{Status: req.Status, Note: strings.TrimSpace(req.Note), By: agent.Name, At: time.Now()})
+		return nil
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	log.Printf("🧾 Siniestro %s -> %s (por %s)", claim.Number, claim.Status, agent.Name)
+	emitEvent(TenantEvent{
+		Event:  EventClaimUpdated,
+		Tenant: claim.Tenant,
+		WaID:   claim.WaID,
+		Name:   claim.Name,
+		State:  "CLAIM_STATUS",
+		Data: map[string]string{
+			"claim_number":     claim.Number,
+			"claim_status":     claim.Status,
+			"claim_note":       strings.TrimSpace(req.Note),
+			"claim_updated_by": agent.Name,
+		},
+	}, claim.PhoneID)
+
+	resp := map[string]any{"claim": claim, "notified": false}
+	if req.Notify {
+		if err := a.notifyClaimStatus(claim, strings.TrimSpace(req.Note)); err != nil {
+			log.Printf("⚠️ No se pudo notificar el siniestro %s: %v", claim.Number, err)
+			resp["notify_error"] = err.Error()
+		} else {
+			resp["notified"] = true
+		}
+	}
+	writeJSON(w, resp)
+}
+
+// serveClaimMedia baja el adjunto de Meta con el token del número por el que llegó.
+func (a *App) serveClaimMedia(w http.ResponseWriter, tenant, number, mediaID string) {
+	c, found := a.claims.Get(tenant, number)
+	if !found {
+		http.Error(w, "siniestro no encontrado", http.StatusNotFound)
+		return
+	}
+	var media *MediaRef
+	for i := range c.Media {
+		if c.Media[i].ID == mediaID {
+			media = &c.Media[i]
+		}
+	}
+	if media == nil {
+		http.Error(w, "adjunto no encontrado", http.StatusNotFound)
+		return
+	}
+	waClient, err := a.clients.Get(c.PhoneID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	data, mimeType, err := waClient.downloadMedia(mediaID)
+	if err != nil {
+		log.Printf("⚠️ No se pudo bajar el adjunto %s del siniestro %s: %v", mediaID, number, err)
+		http.Error(w, "no se pudo descargar el adjunto (¿vencido en Meta?)", http.StatusBadGateway)
+		return
+	}
+	if mimeType == "" {
+		mimeType = media.MimeType
+	}
+	w.Header().Set("Content-Type", mimeType)
+	if media.Filename != "" {
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", media.Filename))
+	}
+	_, _ = w.Write(data)
+}
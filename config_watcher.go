@@ -0,0 +1,160 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ---------------------
+// Hot reload (polling por mtime + hash de configs/{tenant})
+// ---------------------
+
+const defaultConfigReloadInterval = 10 * time.Second
+
+type fileFingerprint struct {
+	modTime time.Time
+	size    int64
+	hash    string
+}
+
+// ConfigWatcher revisa periódicamente flow.json (y sus includes) y calendar.json de cada tenant.
+// Si un archivo cambió, lo vuelve a validar y lo reemplaza en la cache solo si es válido;
+// si no, se sigue sirviendo la última versión buena.
+type ConfigWatcher struct {
+	cache        *ConfigCache
+	interval     time.Duration
+	fingerprints map[string]fileFingerprint // owner|path -> último estado visto
+}
+
+func NewConfigWatcher(cache *ConfigCache, interval time.Duration) *ConfigWatcher {
+	return &ConfigWatcher{
+		cache:        cache,
+		interval:     interval,
+		fingerprints: make(map[string]fileFingerprint),
+	}
+}
+
+// configReloadInterval lee CONFIG_RELOAD_INTERVAL (ej: "10s"); "0" deshabilita el hot reload.
+func configReloadInterval() time.Duration {
+	raw := strings.TrimSpace(os.Getenv("CONFIG_RELOAD_INTERVAL"))
+	if raw == "" {
+		return defaultConfigReloadInterval
+	}
+	if raw == "0" {
+		return 0
+	}
+	d, err := time.ParseDuration(raw)
+	if err != nil || d < time.Second {
+		log.Printf("⚠️ CONFIG_RELOAD_INTERVAL inválido (%q), usando %s", raw, defaultConfigReloadInterval)
+		return defaultConfigReloadInterval
+	}
+	return d
+}
+
+func (w *ConfigWatcher) Start() {
+	if w.interval <= 0 {
+		log.Printf("🔄 Hot reload de configs deshabilitado")
+		return
+	}
+	// Primera pasada: solo tomamos la foto inicial (los flows se cargan on-demand).
+	w.scan(false)
+	log.Printf("🔄 Hot reload de configs cada %s", w.interval)
+
+	go func() {
+		ticker := time.NewTicker(w.interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			w.scan(true)
+		}
+	}()
+}
+
+func (w *ConfigWatcher) scan(reload bool) {
+	entries, err := os.ReadDir(configRoot)
+	if err != nil {
+		log.Printf("ERROR leyendo %s: %v", configRoot, err)
+		return
+	}
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		tenant := e.Name()
+
+		// flow.json + los archivos que incluye (ej: configs/_shared/*.json)
+		flowChanged := w.changed(filepath.Join(configRoot, tenant, "flow.json"))
+		if cfg, ok := w.cache.Get(tenant); ok {
+			for _, src := range cfg.sources {
+				// Un include compartido lo vigila cada tenant por separado
+				if w.changedFor(tenant, src) {
+					flowChanged = true
+				}
+			}
+		}
+		if flowChanged && reload {
+			w.reloadFlow(tenant)
+		}
+		if w.changed(filepath.Join(configRoot, tenant, "calendar.json")) && reload {
+			w.reloadCalendar(tenant)
+		}
+	}
+}
+
+func (w *ConfigWatcher) changed(path string) bool {
+	return w.changedFor("", path)
+}
+
+// changedFor compara mtime/tamaño y, si difieren, confirma con el hash del contenido
+// (un "touch" o un deploy que reescribe el mismo archivo no dispara recarga).
+func (w *ConfigWatcher) changedFor(owner, path string) bool {
+	key := owner + "|" + path
+	prev, seen := w.fingerprints[key]
+
+	info, err := os.Stat(path)
+	if err != nil {
+		if seen {
+			delete(w.fingerprints, key)
+			log.Printf("⚠️ %s fue eliminado: se mantiene la última versión cargada", path)
+		}
+		return false
+	}
+	if seen && info.ModTime().Equal(prev.modTime) && info.Size() == prev.size {
+		return false
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		log.Printf("ERROR leyendo %s: %v", path, err)
+		return false
+	}
+	sum := sha256.Sum256(b)
+	fp := fileFingerprint{modTime: info.ModTime(), size: info.Size(), hash: hex.EncodeToString(sum[:])}
+	w.fingerprints[key] = fp
+
+	return seen && fp.hash != prev.hash
+}
+
+func (w *ConfigWatcher) reloadFlow(tenant string) {
+	cfg, err := loadFlowConfig(tenant)
+	if err != nil {
+		log.Printf("❌ flow.json de %s cambió pero es inválido, se mantiene la versión anterior: %v", tenant, err)
+		return
+	}
+	w.cache.Set(tenant, cfg)
+	log.Printf("🔄 flow.json recargado: tenant=%s version=%s states=%d", tenant, cfg.Version, len(cfg.States))
+}
+
+func (w *ConfigWatcher) reloadCalendar(tenant string) {
+	cfg, err := loadCalendarConfig(tenant)
+	if err != nil {
+		log.Printf("❌ calendar.json de %s cambió pero es inválido, se mantiene la versión anterior: %v", tenant, err)
+		return
+	}
+	setCalendarConfig(tenant, cfg)
+	log.Printf("🔄 calendar.json recargado: tenant=%s calendar_id=%s", tenant, cfg.CalendarID)
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const (
+	flowV1 = `{"version": "1", "states": {
+		"MENU": {"type": "text", "body": "Hola", "on_text_next": "ASK"},
+		"ASK": {"type": "text", "body": "Pregunta v1", "on_text_next": "MENU"}
+	}}`
+	flowV2 = `{"version": "2", "states": {
+		"MENU": {"type": "text", "body": "Hola", "on_text_next": "ASK"},
+		"ASK": {"type": "text", "body": "Pregunta v2", "on_text_next": "DONE"},
+		"DONE": {"type": "text", "body": "Listo", "on_text_next": "MENU"}
+	}}`
+)
+
+// writeFlow reescribe el flow.json del tenant con un mtime nuevo (el watcher compara mtime + hash).
+func writeFlow(t *testing.T, tenant, content string, mtime time.Time) {
+	t.Helper()
+	path := filepath.Join(configRoot, tenant, "flow.json")
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFlowVersionPinnedAcrossHotReload(t *testing.T) {
+	tenant := includeTenant(t, map[string]string{"flow.json": flowV1})
+	a := &App{cache: NewConfigCache()}
+	w := NewConfigWatcher(a.cache, time.Hour)
+	w.scan(false)
+
+	v1, err := a.currentFlow(tenant)
+	if err != nil {
+		t.Fatal(err)
+	}
+	midFlow := &UserSession{State: "ASK"}
+	if cfg, _ := a.flowForSession(tenant, midFlow); cfg.VersionKey() != v1.VersionKey() {
+		t.Fatalf("sesión nueva = %s", cfg.VersionKey())
+	}
+
+	writeFlow(t, tenant, flowV2, time.Now().Add(time.Minute))
+	w.scan(true)
+	v2, _ := a.currentFlow(tenant)
+	if v2.Version != "2" {
+		t.Fatalf("el hot reload no tomó la v2: %s", v2.VersionKey())
+	}
+
+	tests := []struct {
+		name string
+		sess *UserSession
+		want string
+	}{
+		{"en curso sigue en su versión", &UserSession{State: "ASK", FlowVersion: v1.VersionKey()}, v1.VersionKey()},
+		{"en el estado de entrada pasa a la vigente", &UserSession{State: "MENU", FlowVersion: v1.VersionKey()}, v2.VersionKey()},
+		{"nueva arranca en la vigente", &UserSession{}, v2.VersionKey()},
+	}
+	for _, tt := range tests {
+		cfg, err := a.flowForSession(tenant, tt.sess)
+		if err != nil || cfg.VersionKey() != tt.want || tt.sess.FlowVersion != tt.want {
+			t.Errorf("%s: flow %s (sesión %s), esperaba %s (%v)", tt.name, cfg.VersionKey(), tt.sess.FlowVersion, tt.want, err)
+		}
+	}
+	if cfg, _ := a.flowForSession(tenant, &UserSession{State: "ASK", FlowVersion: v1.VersionKey()}); cfg.States["ASK"].Body != "Pregunta v1" {
+		t.Errorf("la sesión pineada ve el estado de la v2: %q", cfg.States["ASK"].Body)
+	}
+
+	// Un flow inválido no reemplaza al vigente
+	writeFlow(t, tenant, `{"version": "3", "states": {}}`, time.Now().Add(2*time.Minute))
+	w.scan(true)
+	if cur, _ := a.currentFlow(tenant); cur.VersionKey() != v2.VersionKey() {
+		t.Errorf("un flow inválido reemplazó al vigente: %s", cur.VersionKey())
+	}
+
+	// Si la versión pineada sale de memoria, la sesión pasa a la vigente
+	for i := 0; i < maxFlowVersions; i++ {
+		cfg := v2
+		cfg.Version = "relleno-" + string(rune('a'+i))
+		a.cache.Set(tenant, cfg)
+	}
+	a.cache.Set(tenant, v2)
+	pinned := &UserSession{State: "ASK", FlowVersion: v1.VersionKey()}
+	if cfg, _ := a.flowForSession(tenant, pinned); cfg.VersionKey() != v2.VersionKey() {
+		t.Errorf("versión descartada: flow %s, esperaba %s", cfg.VersionKey(), v2.VersionKey())
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/joho/godotenv"
+)
+
+// Las configs versionadas tienen que arrancar con el .env.dev del repo, sin más secretos.
+func TestShippedConfigsLoad(t *testing.T) {
+	env, err := godotenv.Read(".env.dev")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range env {
+		t.Setenv(k, v)
+	}
+	f, err := loadTenantsFile(filepath.Join(configRoot, tenantsFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &TenantResolver{byPhoneNumberID: map[string]string{}, tenants: map[string]*TenantConfig{}, alertedUnknown: map[string]bool{}}
+	r.register(f.Tenants)
+	prev := tenantRegistry
+	tenantRegistry = r
+	t.Cleanup(func() { tenantRegistry = prev })
+
+	for _, tc := range f.Tenants {
+		if _, err := loadFlowConfig(tc.ID); err != nil {
+			t.Errorf("tenant=%s: %v", tc.ID, err)
+		}
+	}
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// ---------------------
+// CRM: contactos del tenant (tenants.json -> crm)
+// ---------------------
+
+// CRMContact es un contacto del CRM. Fields lleva los datos propios de cada CRM
+// (ej: "last_visit", "plan"); el flow los ve como {{crm_<campo>}}.
+type CRMContact struct {
+	ID     string            `json:"id"`
+	Name   string            `json:"name"`
+	Phone  string            `json:"phone"`
+	DNI    string            `json:"dni,omitempty"`
+	Email  string            `json:"email,omitempty"`
+	Fields map[string]string `json:"fields,omitempty"`
+}
+
+// CRMInteraction es algo que pasó en la conversación (lead, turno, siniestro, derivación...).
+type CRMInteraction struct {
+	Channel string            `json:"channel"`
+	WaID    string            `json:"wa_id"`
+	Event   string            `json:"event"`
+	Summary string            `json:"summary"`
+	Data    map[string]string `json:"data,omitempty"`
+	At      time.Time         `json:"at"`
+}
+
+// CRMProvider es la integración con el CRM del tenant. Los Lookup devuelven found=false
+// (sin error) si el contacto no existe; error queda para fallas del CRM.
+type CRMProvider interface {
+	LookupByPhone(phone string) (c CRMContact, found bool, err error)
+	LookupByDNI(dni string) (c CRMContact, found bool, err error)
+	// UpsertContact crea el contacto (ID vacío) o lo actualiza; devuelve cómo quedó.
+	UpsertContact(c CRMContact) (CRMContact, error)
+	LogInteraction(contactID string, i CRMInteraction) error
+}
+
+// CRMConfig elige el provider del tenant:
+//
+//	{"provider": "csv"}                                                  -> agenda local {DATA_DIR}/{tenant}/contacts.csv
+//	{"provider": "rest", "base_url": "https://crm…/api", "token": "env:CRM_TOKEN_BROKER"}
+//	{"provider": "fake", "contacts": [{"id": "1", "name": "Carlos", "dni": "1234"}]}
+type CRMConfig struct {
+	Provider string       `json:"provider"`
+	Path     string       `json:"path,omitempty"`     // csv (default {DATA_DIR}/{tenant}/contacts.csv)
+	BaseURL  string       `json:"base_url,omitempty"` // rest
+	Token    string       `json:"token,omitempty"`    // rest: secret ref
+	Timeout  string       `json:"timeout,omitempty"`  // rest (default 10s)
+	Contacts []CRMContact `json:"contacts,omitempty"` // fake
+}
+
+// newCRMProvider arma el provider configurado (validando la config).
+func newCRMProvider(tenant string, cfg CRMConfig) (CRMProvider, error) {
+	switch cfg.Provider {
+	case "csv":
+		return newCSVCRM(tenant, cfg.Path)
+	case "rest":
+		return newRESTCRM(cfg)
+	case "fake":
+		return NewFakeCRM(cfg.Contacts...), nil
+	default:
+		return nil, fmt.Errorf("crm.provider desconocido %q (csv|rest|fake)", cfg.Provider)
+	}
+}
+
+// crmProvider devuelve el CRM del tenant.
+func crmProvider(tenant string) (CRMProvider, error) {
+	t, ok := tenantConfig(tenant)
+	if !ok || t.crm == nil {
+		return nil, fmt.Errorf("tenant %s sin crm configurado", tenant)
+	}
+	return t.crm, nil
+}
+
+// samePhone compara teléfonos por los últimos 8 dígitos: el wa_id viene con código de país
+// ("5491155550101") y los CRM suelen guardar el número local ("11 5555-0101").
+func samePhone(a, b string) bool {
+	a, b = digitsOnly(a), digitsOnly(b)
+	if len(a) < 8 || len(b) < 8 {
+		return a != "" && a == b
+	}
+	return a[len(a)-8:] == b[len(b)-8:]
+}
+
+func digitsOnly(s string) string {
+	var sb strings.Builder
+	for _, r := range s {
+		if r >= '0' && r <= '9' {
+			sb.WriteRune(r)
+		}
+	}
+	return sb.String()
+}
+
+// crmVars expone el contacto al flow.
+func crmVars(c CRMContact) map[string]string {
+	vars := map[string]string{
+		"is_client":      "true",
+		"client_name":    c.Name,
+		"crm_contact_id": c.ID,
+		"client_dni":     c.DNI,
+		"client_email":   c.Email,
+	}
+	for k, v := range c.Fields {
+		vars["crm_"+k] = v
+	}
+	return vars
+}
+
+// actionCRMLookup busca al usuario en el CRM del tenant: por el DNI que escribió
+// (save_as: dni) o, si no lo pidió el flow, por su número de WhatsApp.
+// Vars: is_client, client_name, crm_contact_id, client_dni, client_email, crm_<campo>
+func actionCRMLookup(tenant, userID string, session *UserSession) (map[string]string, error) {
+	crm, err := crmProvider(tenant)
+	if err != nil {
+		return nil, err
+	}
+
+	var contact CRMContact
+	var found bool
+	if dni := digitsOnly(session.Inputs["dni"]); dni != "" {
+		contact, found, err = crm.LookupByDNI(dni)
+	} else {
+		contact, found, err = crm.LookupByPhone(userID)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("crm: %w", err)
+	}
+
+	log.Printf("🔍 CRM tenant=%s wa_id=%s: encontrado=%v", tenant, userID, found)
+	if !found {
+		return map[string]string{"is_client": "false", "client_name": "Visitante", "crm_contact_id": ""}, nil
+	}
+	return crmVars(contact), nil
+}
+
+// actionCRMUpsert da de alta o actualiza al usuario en el CRM con lo capturado en la
+// conversación (save_as: full_name, dni, email).
+// Vars: crm_contact_id
+func actionCRMUpsert(tenant, userID string, session *UserSession) (map[string]string, error) {
+	crm, err := crmProvider(tenant)
+	if err != nil {
+		return nil, err
+	}
+	contact, found, err := crm.LookupByPhone(userID)
+	if err != nil {
+		return nil, fmt.Errorf("crm: %w", err)
+	}
+	if !found {
+		contact = CRMContact{Phone: userID, Name: session.Data["name"]}
+	}
+	if v := strings.TrimSpace(session.Inputs["full_name"]); v != "" {
+		contact.Name = v
+	}
+	if v := digitsOnly(session.Inputs["dni"]); v != "" {
+		contact.DNI = v
+	}
+	if v := strings.TrimSpace(session.Inputs["email"]); v != "" {
+		contact.Email = v
+	}
+
+	contact, err = crm.UpsertContact(contact)
+	if err != nil {
+		return nil, fmt.Errorf("crm: %w", err)
+	}
+	log.Printf("👤 CRM tenant=%s contacto %s actualizado", tenant, contact.ID)
+	return map[string]string{"crm_contact_id": contact.ID}, nil
+}
+
+// logCRMEvent registra el evento como interacción del contacto (lo crea si no existe).
+// Corre en background: el CRM no demora la respuesta al usuario.
+func logCRMEvent(ev TenantEvent) {
+	crm, err := crmProvider(ev.Tenant)
+	if err != nil {
+		return
+	}
+	go func() {
+		contact, found, err := crm.LookupByPhone(ev.WaID)
+		if err == nil && !found {
+			contact, err = crm.UpsertContact(CRMContact{Phone: ev.WaID, Name: ev.Name, Email: ev.Inputs["email"]})
+		}
+		if err != nil {
+			log.Printf("⚠️ CRM tenant=%s evento %s: %v", ev.Tenant, ev.Event, err)
+			return
+		}
+
+		data := map[string]string{}
+		for k, v := range ev.Inputs {
+			data[k] = v
+		}
+		for k, v := range ev.Data {
+			data[k] = v
+		}
+		err = crm.LogInteraction(contact.ID, CRMInteraction{
+			Channel: "whatsapp",
+			WaID:    ev.WaID,
+			Event:   ev.Event,
+			Summary: fmt.Sprintf("%s desde el estado %s", ev.Event, ev.State),
+			Data:    data,
+			At:      time.Now(),
+		})
+		if err != nil {
+			log.Printf("⚠️ CRM tenant=%s evento %s: %v", ev.Tenant, ev.Event, err)
+		}
+	}()
+}
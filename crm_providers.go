@@ -0,0 +1,434 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ---------------------
+// CRM "csv": agenda local de contactos
+// ---------------------
+
+// Columnas fijas del CSV; las demás columnas son Fields del contacto.
+var csvCRMColumns = []string{"id", "name", "phone", "dni", "email"}
+
+// csvCRM guarda los contactos en un CSV (se puede editar o reemplazar desde afuera: se relee
+// si cambia) y las interacciones en crm_interactions.jsonl al lado.
+type csvCRM struct {
+	mu           sync.Mutex
+	path         string
+	interactions string
+	modTime      time.Time
+	contacts     []CRMContact
+}
+
+func newCSVCRM(tenant, path string) (*csvCRM, error) {
+	if strings.ContainsAny(tenant, `/\.`) {
+		return nil, fmt.Errorf("tenant inválido %q", tenant)
+	}
+	if path == "" {
+		path = filepath.Join(dataDir(), tenant, "contacts.csv")
+	}
+	return &csvCRM{path: path, interactions: filepath.Join(filepath.Dir(path), "crm_interactions.jsonl")}, nil
+}
+
+// load relee el CSV si cambió desde la última lectura (o escritura). Llamar con mu tomado.
+func (c *csvCRM) load() error {
+	info, err := os.Stat(c.path)
+	if os.IsNotExist(err) {
+		c.contacts, c.modTime = nil, time.Time{}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.ModTime().Equal(c.modTime) {
+		return nil
+	}
+
+	f, err := os.Open(c.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r := csv.NewReader(f)
+	r.FieldsPerRecord = -1
+	header, err := r.Read()
+	if err == io.EOF {
+		c.contacts, c.modTime = nil, info.ModTime()
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("csv de contactos %s: %w", c.path, err)
+	}
+	for i := range header {
+		header[i] = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(header[i], "\ufeff")))
+	}
+
+	var contacts []CRMContact
+	for {
+		rec, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("csv de contactos %s: %w", c.path, err)
+		}
+		ct := CRMContact{Fields: map[string]string{}}
+		for i, col := range header {
+			if i >= len(rec) {
+				break
+			}
+			v := strings.TrimSpace(rec[i])
+			switch col {
+			case "id":
+				ct.ID = v
+			case "name":
+				ct.Name = v
+			case "phone":
+				ct.Phone = v
+			case "dni":
+				ct.DNI = digitsOnly(v)
+			case "email":
+				ct.Email = v
+			default:
+				if v != "" {
+					ct.Fields[col] = v
+				}
+			}
+		}
+		if ct.ID != "" {
+			contacts = append(contacts, ct)
+		}
+	}
+	c.contacts, c.modTime = contacts, info.ModTime()
+	return nil
+}
+
+// save reescribe el CSV con contacts (tmp + rename). Llamar con mu tomado.
+func (c *csvCRM) save(contacts []CRMContact) error {
+	extra := map[string]bool{}
+	for _, ct := range contacts {
+		for k := range ct.Fields {
+			extra[k] = true
+		}
+	}
+	header := append(append([]string{}, csvCRMColumns...), sortedKeys(extra)...)
+
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	_ = w.Write(header)
+	for _, ct := range contacts {
+		rec := []string{ct.ID, ct.Name, ct.Phone, ct.DNI, ct.Email}
+		for _, k := range header[len(csvCRMColumns):] {
+			rec = append(rec, ct.Fields[k])
+		}
+		_ = w.Write(rec)
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(c.path), 0o755); err != nil {
+		return err
+	}
+	tmp := c.path + ".tmp"
+	if err := os.WriteFile(tmp, buf.Bytes(), 0o644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, c.path); err != nil {
+		return err
+	}
+	if info, err := os.Stat(c.path); err == nil {
+		c.modTime = info.ModTime()
+	}
+	return nil
+}
+
+func (c *csvCRM) find(match func(CRMContact) bool) (CRMContact, bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.load(); err != nil {
+		return CRMContact{}, false, err
+	}
+	for _, ct := range c.contacts {
+		if match(ct) {
+			return ct, true, nil
+		}
+	}
+	return CRMContact{}, false, nil
+}
+
+func (c *csvCRM) LookupByPhone(phone string) (CRMContact, bool, error) {
+	return c.find(func(ct CRMContact) bool { return samePhone(ct.Phone, phone) })
+}
+
+func (c *csvCRM) LookupByDNI(dni string) (CRMContact, bool, error) {
+	dni = digitsOnly(dni)
+	return c.find(func(ct CRMContact) bool { return dni != "" && ct.DNI == dni })
+}
+
+func (c *csvCRM) UpsertContact(ct CRMContact) (CRMContact, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.load(); err != nil {
+		return CRMContact{}, err
+	}
+	// Se trabaja sobre una copia: si no se puede escribir el CSV, memoria y disco siguen iguales
+	contacts := append([]CRMContact(nil), c.contacts...)
+	if ct.ID == "" {
+		ct.ID = "C-" + randomToken()[:10]
+		contacts = append(contacts, ct)
+	} else {
+		updated := false
+		for i := range contacts {
+			if contacts[i].ID == ct.ID {
+				contacts[i] = ct
+				updated = true
+			}
+		}
+		if !updated {
+			contacts = append(contacts, ct)
+		}
+	}
+	if err := c.save(contacts); err != nil {
+		return CRMContact{}, err
+	}
+	c.contacts = contacts
+	return ct, nil
+}
+
+func (c *csvCRM) LogInteraction(contactID string, i CRMInteraction) error {
+	b, err := json.Marshal(struct {
+		ContactID string `json:"contact_id"`
+		CRMInteraction
+	}{contactID, i})
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := os.MkdirAll(filepath.Dir(c.interactions), 0o755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(c.interactions, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(append(b, '\n'))
+	return err
+}
+
+// ---------------------
+// CRM "rest": adaptador genérico
+// ---------------------
+
+// restCRM habla con un servicio que expone (JSON con los campos de CRMContact):
+//
+//	GET  {base_url}/contacts?phone=…  |  ?dni=…    -> 200 contacto, 404 si no existe
+//	POST {base_url}/contacts                      -> alta (devuelve el contacto con id)
+//	PUT  {base_url}/contacts/{id}                 -> actualización
+//	POST {base_url}/contacts/{id}/interactions    -> CRMInteraction
+//
+// Autenticación: "Authorization: Bearer {token}". Para APIs que no siguen este formato
+// está la action "http" (http_action.go).
+type restCRM struct {
+	baseURL string
+	token   string
+	client  *http.Client
+}
+
+func newRESTCRM(cfg CRMConfig) (*restCRM, error) {
+	base := strings.TrimRight(strings.TrimSpace(cfg.BaseURL), "/")
+	if !strings.HasPrefix(base, "https://") && !strings.HasPrefix(base, "http://") {
+		return nil, fmt.Errorf("crm.base_url debe ser http(s): %q", cfg.BaseURL)
+	}
+	timeout := defaultHTTPActionTimeout
+	if cfg.Timeout != "" {
+		d, err := time.ParseDuration(cfg.Timeout)
+		if err != nil || d <= 0 || d > maxHTTPActionTimeout {
+			return nil, fmt.Errorf("crm.timeout inválido %q (máx %s)", cfg.Timeout, maxHTTPActionTimeout)
+		}
+		timeout = d
+	}
+	// Sin token configurado van sin autenticación (el CRM puede no pedirlo); uno configurado
+	// que no se resuelve es un error, no una consulta sin auth.
+	token, err := resolveSecret(cfg.Token)
+	if cfg.Token != "" && (err != nil || token == "") {
+		return nil, fmt.Errorf("crm.token no resuelto: %v", secretErr(err))
+	}
+	return &restCRM{baseURL: base, token: token, client: &http.Client{Timeout: timeout}}, nil
+}
+
+// do hace el request; out == nil descarta la respuesta. Devuelve el status HTTP.
+func (c *restCRM) do(method, path string, in, out any) (int, error) {
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return 0, err
+		}
+		body = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, c.baseURL+path, body)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	raw, err := io.ReadAll(io.LimitReader(resp.Body, maxHTTPActionResponse))
+	if err != nil {
+		return resp.StatusCode, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return resp.StatusCode, nil
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("%s %s: status %d", method, path, resp.StatusCode)
+	}
+	if out != nil {
+		if err := json.Unmarshal(raw, out); err != nil {
+			return resp.StatusCode, fmt.Errorf("%s %s: respuesta inválida: %w", method, path, err)
+		}
+	}
+	return resp.StatusCode, nil
+}
+
+func (c *restCRM) lookup(param, value string) (CRMContact, bool, error) {
+	var ct CRMContact
+	status, err := c.do(http.MethodGet, "/contacts?"+url.Values{param: {value}}.Encode(), nil, &ct)
+	if err != nil || status == http.StatusNotFound {
+		return CRMContact{}, false, err
+	}
+	return ct, ct.ID != "", nil
+}
+
+func (c *restCRM) LookupByPhone(phone string) (CRMContact, bool, error) {
+	return c.lookup("phone", phone)
+}
+
+func (c *restCRM) LookupByDNI(dni string) (CRMContact, bool, error) {
+	return c.lookup("dni", dni)
+}
+
+func (c *restCRM) UpsertContact(ct CRMContact) (CRMContact, error) {
+	method, path := http.MethodPost, "/contacts"
+	if ct.ID != "" {
+		method, path = http.MethodPut, "/contacts/"+url.PathEscape(ct.ID)
+	}
+	var out CRMContact
+	status, err := c.do(method, path, ct, &out)
+	if err != nil {
+		return CRMContact{}, err
+	}
+	if status == http.StatusNotFound {
+		return CRMContact{}, fmt.Errorf("contacto %s no existe en el CRM", ct.ID)
+	}
+	if out.ID == "" {
+		return CRMContact{}, fmt.Errorf("%s %s: el CRM no devolvió el id del contacto", method, path)
+	}
+	return out, nil
+}
+
+func (c *restCRM) LogInteraction(contactID string, i CRMInteraction) error {
+	path := "/contacts/" + url.PathEscape(contactID) + "/interactions"
+	status, err := c.do(http.MethodPost, path, i, nil)
+	if err == nil && status == http.StatusNotFound {
+		err = fmt.Errorf("contacto %s no existe en el CRM", contactID)
+	}
+	return err
+}
+
+// ---------------------
+// CRM "fake": determinístico, en memoria (demos y pruebas)
+// ---------------------
+
+// FakeCRM arranca con los contactos que se le pasan; las altas reciben ids "fake-N".
+type FakeCRM struct {
+	mu           sync.Mutex
+	contacts     []CRMContact
+	interactions map[string][]CRMInteraction
+	nextID       int
+}
+
+func NewFakeCRM(contacts ...CRMContact) *FakeCRM {
+	return &FakeCRM{contacts: append([]CRMContact(nil), contacts...), interactions: map[string][]CRMInteraction{}}
+}
+
+func (f *FakeCRM) find(match func(CRMContact) bool) (CRMContact, bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, ct := range f.contacts {
+		if match(ct) {
+			return ct, true, nil
+		}
+	}
+	return CRMContact{}, false, nil
+}
+
+func (f *FakeCRM) LookupByPhone(phone string) (CRMContact, bool, error) {
+	return f.find(func(ct CRMContact) bool { return samePhone(ct.Phone, phone) })
+}
+
+func (f *FakeCRM) LookupByDNI(dni string) (CRMContact, bool, error) {
+	dni = digitsOnly(dni)
+	return f.find(func(ct CRMContact) bool { return dni != "" && digitsOnly(ct.DNI) == dni })
+}
+
+func (f *FakeCRM) UpsertContact(ct CRMContact) (CRMContact, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i := range f.contacts {
+		if ct.ID != "" && f.contacts[i].ID == ct.ID {
+			f.contacts[i] = ct
+			return ct, nil
+		}
+	}
+	if ct.ID == "" {
+		f.nextID++
+		ct.ID = fmt.Sprintf("fake-%d", f.nextID)
+	}
+	f.contacts = append(f.contacts, ct)
+	return ct, nil
+}
+
+func (f *FakeCRM) LogInteraction(contactID string, i CRMInteraction) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.interactions[contactID] = append(f.interactions[contactID], i)
+	return nil
+}
+
+// Interactions devuelve lo registrado para el contacto (más viejo primero).
+func (f *FakeCRM) Interactions(contactID string) []CRMInteraction {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	out := append([]CRMInteraction(nil), f.interactions[contactID]...)
+	sort.SliceStable(out, func(i, j int) bool { return out[i].At.Before(out[j].At) })
+	return out
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// actionMockCRMLookup es el CRM simulado de los primeros flows (cliente = teléfono terminado en
+// par). Queda como fixture para probar flows sin CRM: se registra solo en los tests.
+func actionMockCRMLookup(tenant, userID string, sess *UserSession) (map[string]string, error) {
+	if len(userID) > 0 && int(userID[len(userID)-1])%2 == 0 {
+		return map[string]string{"is_client": "true", "client_name": "Carlos (Cliente VIP)", "last_visit": "15 de Febrero"}, nil
+	}
+	return map[string]string{"is_client": "false", "client_name": "Visitante"}, nil
+}
+
+func init() {
+	actionRegistry["mock_crm_lookup"] = actionMockCRMLookup
+}
+
+// withTenants reemplaza tenantRegistry por uno con estos tenants mientras dura el test.
+func withTenants(t *testing.T, tenants ...*TenantConfig) {
+	t.Helper()
+	prev := tenantRegistry
+	r := &TenantResolver{byPhoneNumberID: map[string]string{}, tenants: map[string]*TenantConfig{}, alertedUnknown: map[string]bool{}}
+	for _, tc := range tenants {
+		r.tenants[tc.ID] = tc
+	}
+	tenantRegistry = r
+	t.Cleanup(func() { tenantRegistry = prev })
+}
+
+func TestMockCRMLookupFixture(t *testing.T) {
+	action, ok := actionRegistry["mock_crm_lookup"]
+	if !ok {
+		t.Fatal("mock_crm_lookup no está registrado en los tests")
+	}
+	vars, _ := action("demo", "5491100000002", &UserSession{})
+	if vars["is_client"] != "true" {
+		t.Errorf("teléfono par: is_client = %q", vars["is_client"])
+	}
+	vars, _ = action("demo", "5491100000001", &UserSession{})
+	if vars["is_client"] != "false" || vars["client_name"] != "Visitante" {
+		t.Errorf("teléfono impar: %v", vars)
+	}
+}
+
+func TestFakeCRM(t *testing.T) {
+	crm := NewFakeCRM(CRMContact{ID: "1", Name: "Ana", Phone: "11 5555-0101", DNI: "12.345.678"})
+
+	if c, found, err := crm.LookupByPhone("5491155550101"); err != nil || !found || c.ID != "1" {
+		t.Fatalf("LookupByPhone = %+v, %v, %v", c, found, err)
+	}
+	if c, found, _ := crm.LookupByDNI("12345678"); !found || c.Name != "Ana" {
+		t.Fatalf("LookupByDNI = %+v, %v", c, found)
+	}
+	if _, found, _ := crm.LookupByDNI("99999999"); found {
+		t.Fatal("LookupByDNI encontró un DNI inexistente")
+	}
+
+	created, err := crm.UpsertContact(CRMContact{Name: "Leo", Phone: "5491177776666"})
+	if err != nil || created.ID != "fake-1" {
+		t.Fatalf("UpsertContact (alta) = %+v, %v", created, err)
+	}
+	created.Email = "leo@example.com"
+	if _, err := crm.UpsertContact(created); err != nil {
+		t.Fatal(err)
+	}
+	if c, _, _ := crm.LookupByPhone("1177776666"); c.Email != "leo@example.com" {
+		t.Errorf("UpsertContact no actualizó el contacto: %+v", c)
+	}
+
+	later := time.Now()
+	_ = crm.LogInteraction("fake-1", CRMInteraction{Event: EventClaimCreated, At: later})
+	_ = crm.LogInteraction("fake-1", CRMInteraction{Event: EventLeadCreated, At: later.Add(-time.Minute)})
+	got := crm.Interactions("fake-1")
+	if len(got) != 2 || got[0].Event != EventLeadCreated {
+		t.Errorf("Interactions = %+v", got)
+	}
+}
+
+func writeContactsCSV(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "contacts.csv")
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestCSVCRMLookupAndUpsert(t *testing.T) {
+	path := writeContactsCSV(t, "\ufeffid,name,phone,dni,email,plan\n1,Ana,11 5555-0101,12.345.678,ana@example.com,Oro\n")
+	crm, err := newCSVCRM("broker", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, found, err := crm.LookupByPhone("5491155550101")
+	if err != nil || !found || c.ID != "1" || c.Fields["plan"] != "Oro" {
+		t.Fatalf("LookupByPhone = %+v, %v, %v", c, found, err)
+	}
+	if c, found, _ := crm.LookupByDNI("12.345.678"); !found || c.DNI != "12345678" {
+		t.Fatalf("LookupByDNI = %+v, %v", c, found)
+	}
+	if _, found, _ := crm.LookupByPhone("5491100000000"); found {
+		t.Fatal("LookupByPhone encontró un teléfono inexistente")
+	}
+
+	created, err := crm.UpsertContact(CRMContact{Name: "Leo", Phone: "5491177776666", Fields: map[string]string{"origen": "whatsapp"}})
+	if err != nil || !strings.HasPrefix(created.ID, "C-") {
+		t.Fatalf("UpsertContact (alta) = %+v, %v", created, err)
+	}
+	c.Email = "ana@nuevo.com"
+	if _, err := crm.UpsertContact(c); err != nil {
+		t.Fatal(err)
+	}
+
+	// Otra instancia lee lo que quedó en disco
+	reread, _ := newCSVCRM("broker", path)
+	if got, found, _ := reread.LookupByPhone("1177776666"); !found || got.ID != created.ID || got.Fields["origen"] != "whatsapp" {
+		t.Errorf("alta no persistida: %+v, %v", got, found)
+	}
+	if got, _, _ := reread.LookupByDNI("12345678"); got.Email != "ana@nuevo.com" || got.Fields["plan"] != "Oro" {
+		t.Errorf("actualización no persistida: %+v", got)
+	}
+}
+
+func TestCSVCRMReloadsExternalChanges(t *testing.T) {
+	path := writeContactsCSV(t, "id,name,phone\n1,Ana,1155550101\n")
+	crm, _ := newCSVCRM("broker", path)
+	if _, found, _ := crm.LookupByPhone("1155550101"); !found {
+		t.Fatal("contacto inicial no encontrado")
+	}
+
+	if err := os.WriteFile(path, []byte("id,name,phone\n9,Externo,1199998888\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	future := time.Now().Add(time.Minute)
+	_ = os.Chtimes(path, future, future)
+	if c, found, _ := crm.LookupByPhone("1199998888"); !found || c.Name != "Externo" {
+		t.Errorf("no releyó el CSV editado: %+v, %v", c, found)
+	}
+}
+
+func TestCSVCRMUpsertKeepsStateWhenSaveFails(t *testing.T) {
+	path := writeContactsCSV(t, "id,name,phone\n1,Ana,1155550101\n")
+	crm, _ := newCSVCRM("broker", path)
+	// El tmp del rename es un directorio: la escritura falla
+	if err := os.Mkdir(path+".tmp", 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := crm.UpsertContact(CRMContact{Name: "Leo", Phone: "1177776666"}); err == nil {
+		t.Fatal("UpsertContact no devolvió el error de escritura")
+	}
+	if _, found, _ := crm.LookupByPhone("1177776666"); found {
+		t.Error("el contacto quedó en memoria aunque no se guardó")
+	}
+	if _, err := crm.UpsertContact(CRMContact{ID: "1", Name: "Ana María", Phone: "1155550101"}); err == nil {
+		t.Fatal("UpsertContact no devolvió el error de escritura")
+	}
+	if c, _, _ := crm.LookupByPhone("1155550101"); c.Name != "Ana" {
+		t.Errorf("la actualización quedó en memoria aunque no se guardó: %+v", c)
+	}
+}
+
+func TestCSVCRMLogInteraction(t *testing.T) {
+	path := writeContactsCSV(t, "id,name,phone\n1,Ana,1155550101\n")
+	crm, _ := newCSVCRM("broker", path)
+	if err := crm.LogInteraction("1", CRMInteraction{Channel: "whatsapp", Event: EventLeadCreated, At: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := os.ReadFile(filepath.Join(filepath.Dir(path), "crm_interactions.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var line struct {
+		ContactID string `json:"contact_id"`
+		Event     string `json:"event"`
+	}
+	if err := json.Unmarshal(b, &line); err != nil || line.ContactID != "1" || line.Event != EventLeadCreated {
+		t.Errorf("interacción registrada = %s (%v)", b, err)
+	}
+}
+
+func TestRESTCRM(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer tok" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch {
+		case r.Method == http.MethodGet && r.URL.Query().Get("dni") == "12345678":
+			_ = json.NewEncoder(w).Encode(CRMContact{ID: "r1", Name: "Ana", Fields: map[string]string{"plan": "Oro"}})
+		case r.Method == http.MethodGet:
+			w.WriteHeader(http.StatusNotFound)
+		case r.Method == http.MethodPost && r.URL.Path == "/contacts":
+			_ = json.NewEncoder(w).Encode(CRMContact{ID: "r2", Name: "Leo"})
+		case r.Method == http.MethodPost && r.URL.Path == "/contacts/r2/interactions":
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+	t.Setenv("CRM_TEST_TOKEN", "tok")
+
+	crm, err := newRESTCRM(CRMConfig{BaseURL: srv.URL + "/", Token: "env:CRM_TEST_TOKEN"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c, found, err := crm.LookupByDNI("12345678"); err != nil || !found || c.Fields["plan"] != "Oro" {
+		t.Errorf("LookupByDNI = %+v, %v, %v", c, found, err)
+	}
+	if _, found, err := crm.LookupByPhone("5491100000000"); err != nil || found {
+		t.Errorf("404 debería ser no encontrado sin error: %v, %v", found, err)
+	}
+	if c, err := crm.UpsertContact(CRMContact{Name: "Leo"}); err != nil || c.ID != "r2" {
+		t.Errorf("UpsertContact = %+v, %v", c, err)
+	}
+	if err := crm.LogInteraction("r2", CRMInteraction{Event: EventLeadCreated}); err != nil {
+		t.Error(err)
+	}
+	if err := crm.LogInteraction("nadie", CRMInteraction{Event: EventLeadCreated}); err == nil {
+		t.Error("LogInteraction de un contacto inexistente no falló")
+	}
+
+	if _, err := newRESTCRM(CRMConfig{BaseURL: srv.URL, Token: "env:CRM_TEST_TOKEN_INEXISTENTE"}); err == nil {
+		t.Error("newRESTCRM aceptó un token que no se resuelve")
+	}
+}
+
+func TestActionCRMLookup(t *testing.T) {
+	withTenants(t, &TenantConfig{ID: "demo", crm: NewFakeCRM(
+		CRMContact{ID: "1", Name: "Carlos", Phone: "1155550101", DNI: "1234", Fields: map[string]string{"last_visit": "15 de Febrero"}},
+	)})
+
+	sess := &UserSession{Inputs: map[string]string{"dni": "1.234"}}
+	vars, err := actionCRMLookup("demo", "5491100000000", sess)
+	if err != nil || vars["is_client"] != "true" || vars["client_name"] != "Carlos" || vars["crm_last_visit"] != "15 de Febrero" {
+		t.Errorf("por DNI = %v, %v", vars, err)
+	}
+
+	vars, _ = actionCRMLookup("demo", "5491155550101", &UserSession{Inputs: map[string]string{}})
+	if vars["crm_contact_id"] != "1" {
+		t.Errorf("por teléfono = %v", vars)
+	}
+
+	vars, _ = actionCRMLookup("demo", "5491100000000", &UserSession{Inputs: map[string]string{}})
+	if vars["is_client"] != "false" || vars["client_name"] != "Visitante" {
+		t.Errorf("sin match = %v", vars)
+	}
+
+	if _, err := actionCRMLookup("otro", "5491100000000", &UserSession{}); err == nil {
+		t.Error("tenant sin crm no devolvió error")
+	}
+}
+
+func TestLogCRMEventCreatesContactAndInteraction(t *testing.T) {
+	crm := NewFakeCRM()
+	withTenants(t, &TenantConfig{ID: "broker", crm: crm})
+
+	logCRMEvent(TenantEvent{
+		Tenant: "broker",
+		WaID:   "5491177776666",
+		Name:   "Leo",
+		Event:  EventLeadCreated,
+		State:  "LEAD_DONE",
+		Inputs: map[string]string{"email": "leo@example.com"},
+		Data:   map[string]string{"lead_id": "L-1"},
+	})
+
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if c, found, _ := crm.LookupByPhone("5491177776666"); found {
+			if got := crm.Interactions(c.ID); len(got) == 1 {
+				if c.Email != "leo@example.com" || got[0].Data["lead_id"] != "L-1" {
+					t.Errorf("contacto %+v, interacción %+v", c, got[0])
+				}
+				return
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("logCRMEvent no registró la interacción")
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"time"
+)
+
+// ---------------------
+// Entry routing (por dónde arranca una conversación)
+// ---------------------
+
+// FlowEntryRoute manda una conversación a un estado distinto del de entrada según su contexto.
+// Ref: token "ref=cyber" / "ref:cyber" en el texto (links wa.me con mensaje precargado).
+// Keyword: el primer mensaje contiene esa palabra.
+// AdID / SourceType / SourceURLContains / HeadlineContains: referral de un anuncio click-to-WhatsApp.
+// Las rutas por ref o referral valen también con la conversación en curso.
+type FlowEntryRoute struct {
+	Ref               string `json:"ref,omitempty"`
+	Keyword           string `json:"keyword,omitempty"`
+	AdID              string `json:"ad_id,omitempty"`
+	SourceType        string `json:"source_type,omitempty"`
+	SourceURLContains string `json:"source_url_contains,omitempty"`
+	HeadlineContains  string `json:"headline_contains,omitempty"`
+	State             string `json:"state"`
+}
+
+var refTokenRe = regexp.MustCompile(`(?i)\bref\s*[=:]\s*([\p{L}\d_-]+)`)
+
+// extractRef devuelve el valor de "ref=..." en el texto, si lo hay.
+func extractRef(text string) string {
+	m := refTokenRe.FindStringSubmatch(text)
+	if len(m) < 2 {
+		return ""
+	}
+	return m[1]
+}
+
+func (r FlowEntryRoute) hasMatcher() bool {
+	return r.Ref != "" || r.Keyword != "" || r.hasReferralMatcher()
+}
+
+func (r FlowEntryRoute) hasReferralMatcher() bool {
+	return r.AdID != "" || r.SourceType != "" || r.SourceURLContains != "" || r.HeadlineContains != ""
+}
+
+func containsFold(s, sub string) bool {
+	return strings.Contains(strings.ToLower(s), strings.ToLower(sub))
+}
+
+// matches: todos los criterios definidos en la ruta tienen que cumplirse.
+func (r FlowEntryRoute) matches(ctx entryContext) bool {
+	if !r.hasMatcher() {
+		return false
+	}
+	if r.Ref != "" && !strings.EqualFold(r.Ref, ctx.ref) {
+		return false
+	}
+	if r.Keyword != "" && (!ctx.firstMessage || !containsFold(ctx.text, r.Keyword)) {
+		return false
+	}
+	if r.hasReferralMatcher() {
+		ref := ctx.referral
+		if ref == nil {
+			return false
+		}
+		if r.AdID != "" && r.AdID != ref.SourceID {
+			return false
+		}
+		if r.SourceType != "" && !strings.EqualFold(r.SourceType, ref.SourceType) {
+			return false
+		}
+		if r.SourceURLContains != "" && !containsFold(ref.SourceURL, r.SourceURLContains) {
+			return false
+		}
+		if r.HeadlineContains != "" && !containsFold(ref.Headline, r.HeadlineContains) {
+			return false
+		}
+	}
+	return true
+}
+
+type entryContext struct {
+	firstMessage bool
+	text         string
+	ref          string
+	referral     *MessageReferral
+}
+
+func newEntryContext(msg IncomingMessage, firstMessage bool) entryContext {
+	ctx := entryContext{firstMessage: firstMessage, referral: msg.Referral}
+	if msg.Type == "text" && msg.Text != nil {
+		ctx.text = strings.TrimSpace(msg.Text.Body)
+		ctx.ref = extractRef(ctx.text)
+	}
+	return ctx
+}
+
+// attributionVars arma las vars ref_* de atribución (anuncio y/o ref del link).
+// Se guardan en sesión (último contacto) y viajan con el lead.
+func attributionVars(msg IncomingMessage, ctx entryContext) map[string]string {
+	vars := map[string]string{}
+	if ref := msg.Referral; ref != nil {
+		vars["ref_source_type"] = ref.SourceType
+		vars["ref_source_id"] = ref.SourceID
+		vars["ref_source_url"] = ref.SourceURL
+		vars["ref_headline"] = ref.Headline
+		vars["ref_body"] = ref.Body
+		vars["ref_media_type"] = ref.MediaType
+		vars["ref_ctwa_clid"] = ref.CtwaClid
+	}
+	if ctx.ref != "" {
+		vars["ref_code"] = ctx.ref
+	}
+	if len(vars) > 0 {
+		vars["ref_captured_at"] = time.Now().Format(time.RFC3339)
+	}
+	return vars
+}
+
+// matchEntryRoute devuelve el estado de la primera ruta que aplica.
+// Con la conversación en curso solo se consideran rutas por ref explícito o por anuncio.
+func matchEntryRoute(cfg FlowConfig, ctx entryContext) (FlowEntryRoute, bool) {
+	if !ctx.firstMessage && ctx.ref == "" && ctx.referral == nil {
+		return FlowEntryRoute{}, false
+	}
+	for _, r := range cfg.EntryRoutes {
+		if r.matches(ctx) {
+			return r, true
+		}
+	}
+	return FlowEntryRoute{}, false
+}
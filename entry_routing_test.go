@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+// incoming arma el mensaje como llega en el webhook.
+func incoming(t *testing.T, raw string) IncomingMessage {
+	t.Helper()
+	var msg IncomingMessage
+	if err := json.Unmarshal([]byte(raw), &msg); err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+func TestExtractRef(t *testing.T) {
+	tests := map[string]string{
+		"Hola! ref=cyber":          "cyber",
+		"hola REF: Auto_2026":      "Auto_2026",
+		"ref = hogar-promo quiero": "hogar-promo",
+		"referencia del siniestro": "",
+		"hola":                     "",
+	}
+	for text, want := range tests {
+		if got := extractRef(text); got != want {
+			t.Errorf("extractRef(%q) = %q, esperaba %q", text, got, want)
+		}
+	}
+}
+
+func TestMatchEntryRouteRefAndKeyword(t *testing.T) {
+	cfg := FlowConfig{EntryRoutes: []FlowEntryRoute{
+		{Ref: "cyber", State: "CYBER"},
+		{Keyword: "siniestro", State: "CLAIM_URGENT_CHECK"},
+		{Ref: "auto", Keyword: "cotizar", State: "QUOTE_AUTO"},
+		{State: "SIN_CRITERIOS"},
+	}}
+	tests := []struct {
+		name  string
+		text  string
+		first bool
+		want  string
+	}{
+		{"ref en el primer mensaje", "Hola ref=CYBER", true, "CYBER"},
+		{"ref con la conversación en curso", "ref=cyber", false, "CYBER"},
+		{"keyword en el primer mensaje", "Tuve un SINIESTRO", true, "CLAIM_URGENT_CHECK"},
+		{"keyword en curso no redirige", "tuve un siniestro", false, ""},
+		{"ref y keyword juntos", "ref=auto quiero cotizar", true, "QUOTE_AUTO"},
+		{"ref sin la keyword de la ruta", "ref=auto hola", true, ""},
+		{"nada coincide", "hola", true, ""},
+	}
+	for _, tt := range tests {
+		msg := incoming(t, `{"type":"text","text":{"body":`+jsonString(tt.text)+`}}`)
+		r, _ := matchEntryRoute(cfg, newEntryContext(msg, tt.first))
+		if r.State != tt.want {
+			t.Errorf("%s: ruta = %q, esperaba %q", tt.name, r.State, tt.want)
+		}
+	}
+}
+
+func jsonString(s string) string {
+	b, _ := json.Marshal(s)
+	return string(b)
+}
+
+func TestMatchEntryRouteReferral(t *testing.T) {
+	cfg := FlowConfig{EntryRoutes: []FlowEntryRoute{
+		{AdID: "120210001", State: "AD_AUTO"},
+		{SourceType: "ad", HeadlineContains: "hogar", State: "AD_HOGAR"},
+		{SourceURLContains: "instagram.com", State: "AD_INSTAGRAM"},
+		{Keyword: "seguro", State: "KEYWORD"},
+		{Ref: "cyber", State: "CYBER"},
+	}}
+	ad := func(id, headline, url string) string {
+		return `,"referral":{"source_type":"ad","source_id":"` + id + `","headline":"` + headline + `","source_url":"` + url + `"}`
+	}
+	tests := []struct {
+		name  string
+		raw   string
+		first bool
+		want  string
+	}{
+		{"por ad_id", `{"type":"text","text":{"body":"hola"}` + ad("120210001", "Seguro de auto", "") + `}`, true, "AD_AUTO"},
+		{"el anuncio gana a la keyword", `{"type":"text","text":{"body":"quiero un seguro"}` + ad("999", "Seguro de HOGAR", "") + `}`, true, "AD_HOGAR"},
+		{"por url del anuncio", `{"type":"text","text":{"body":"hola"}` + ad("999", "Otro", "https://www.instagram.com/p/x") + `}`, true, "AD_INSTAGRAM"},
+		{"anuncio sin ruta cae a la keyword", `{"type":"text","text":{"body":"quiero un seguro"}` + ad("999", "Otro", "https://fb.com") + `}`, true, "KEYWORD"},
+		{"anuncio con la conversación en curso", `{"type":"text","text":{"body":"hola"}` + ad("120210001", "", "") + `}`, false, "AD_AUTO"},
+		{"la ruta de anuncio pide referral", `{"type":"text","text":{"body":"hola hogar instagram.com"}}`, true, ""},
+		{"la ruta por ref sigue después del anuncio", `{"type":"text","text":{"body":"ref=cyber"}` + ad("999", "Otro", "") + `}`, true, "CYBER"},
+	}
+	for _, tt := range tests {
+		r, _ := matchEntryRoute(cfg, newEntryContext(incoming(t, tt.raw), tt.first))
+		if r.State != tt.want {
+			t.Errorf("%s: ruta = %q, esperaba %q", tt.name, r.State, tt.want)
+		}
+	}
+}
+
+func TestAttributionVars(t *testing.T) {
+	msg := incoming(t, `{"type":"text","text":{"body":"ref=cyber hola"},"referral":{"source_type":"ad","source_id":"120210001","headline":"Cyber","ctwa_clid":"ARAx"}}`)
+	vars := attributionVars(msg, newEntryContext(msg, true))
+	if vars["ref_source_id"] != "120210001" || vars["ref_ctwa_clid"] != "ARAx" || vars["ref_code"] != "cyber" || vars["ref_captured_at"] == "" {
+		t.Errorf("vars = %v", vars)
+	}
+
+	plain := incoming(t, `{"type":"text","text":{"body":"hola"}}`)
+	if vars := attributionVars(plain, newEntryContext(plain, true)); len(vars) != 0 {
+		t.Errorf("sin atribución no hay vars: %v", vars)
+	}
+}
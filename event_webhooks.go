@@ -0,0 +1,408 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ---------------------
+// Webhooks salientes: avisan a los sistemas del tenant lo que pasa en las conversaciones
+// ---------------------
+
+// Eventos que se pueden suscribir (tenants.json -> webhooks[].events; vacío = todos).
+const (
+	EventLeadCreated       = "lead.created"
+	EventAppointmentBooked = "appointment.booked"
+	EventHandoffRequested  = "handoff.requested"
+	EventClaimCreated      = "claim.created"
+	EventClaimUpdated      = "claim.updated"
+)
+
+var knownEvents = map[string]bool{
+	EventLeadCreated:       true,
+	EventAppointmentBooked: true,
+	EventHandoffRequested:  true,
+	EventClaimCreated:      true,
+	EventClaimUpdated:      true,
+}
+
+// actionEvents: qué evento dispara cada action cuando termina bien.
+var actionEvents = map[string]string{
+	"save_lead":            EventLeadCreated,
+	"schedule_appointment": EventAppointmentBooked,
+	"handoff":              EventHandoffRequested,
+	"create_claim":         EventClaimCreated,
+}
+
+// WebhookConfig es una suscripción del tenant. Cada intento va firmado con HMAC-SHA256 del secret
+// en X-Flowly-Signature-256 ("sha256=<hex>") sobre "{X-Flowly-Timestamp}.{body}" (unix, segundos).
+// Para verificar, el receptor recalcula la firma con el timestamp del header, compara en tiempo
+// constante y descarta los que tengan más de 5 minutos de diferencia con su reloj: así un request
+// capturado no se puede reenviar más tarde. X-Flowly-Delivery sirve para ignorar duplicados.
+type WebhookConfig struct {
+	URL    string   `json:"url"`
+	Secret string   `json:"secret"` // secret ref: "env:VAR" / "file:/path"
+	Events []string `json:"events,omitempty"`
+
+	secret string
+}
+
+func (c WebhookConfig) wants(event string) bool {
+	if len(c.Events) == 0 {
+		return true
+	}
+	for _, e := range c.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// TenantEvent es el JSON que recibe el sistema del tenant.
+type TenantEvent struct {
+	ID          string            `json:"id"`
+	Event       string            `json:"event"`
+	Tenant      string            `json:"tenant"`
+	WaID        string            `json:"wa_id"`
+	Name        string            `json:"name,omitempty"`
+	State       string            `json:"state"`
+	OccurredAt  time.Time         `json:"occurred_at"`
+	Data        map[string]string `json:"data"`                  // vars que devolvió la action
+	Inputs      map[string]string `json:"inputs,omitempty"`      // lo capturado con save_as
+	Attribution map[string]string `json:"attribution,omitempty"` // ref_* (anuncio / link)
+}
+
+// pendingDelivery es una entrega en curso. Se escribe en {dataDir}/{tenant}/webhooks_pending/
+// antes del primer intento y se borra al entregarse o al pasar al dead-letter: si el proceso se
+// reinicia en el medio (deploy), Resume la retoma desde el intento en que iba.
+type pendingDelivery struct {
+	ID        string          `json:"id"`
+	Tenant    string          `json:"tenant"`
+	URL       string          `json:"url"`
+	EventID   string          `json:"event_id"`
+	Event     string          `json:"event"`
+	Attempts  int             `json:"attempts"`
+	LastError string          `json:"last_error,omitempty"`
+	Payload   json.RawMessage `json:"payload"`
+}
+
+// deadLetter es una entrega que agotó los reintentos ({dataDir}/{tenant}/webhooks_dead.jsonl).
+type deadLetter struct {
+	At        time.Time       `json:"at"`
+	URL       string          `json:"url"`
+	EventID   string          `json:"event_id"`
+	Event     string          `json:"event"`
+	Attempts  int             `json:"attempts"`
+	LastError string          `json:"last_error"`
+	Payload   json.RawMessage `json:"payload"`
+}
+
+// Espera antes de cada reintento (5 intentos en ~13 minutos).
+var webhookRetryDelays = []time.Duration{5 * time.Second, 30 * time.Second, 2 * time.Minute, 10 * time.Minute}
+
+type EventDispatcher struct {
+	client *http.Client
+	delays []time.Duration
+	dir    string
+	mu     sync.Mutex // dead-letter log
+}
+
+func NewEventDispatcher(dir string) *EventDispatcher {
+	return &EventDispatcher{client: &http.Client{Timeout: 10 * time.Second}, delays: webhookRetryDelays, dir: dir}
+}
+
+// eventDispatcher lo arma NewApp, después de cargar el .env (DATA_DIR): lo usa emitEvent.
+var eventDispatcher *EventDispatcher
+
+// Emit entrega el evento (en background) a las suscripciones del tenant que lo quieren.
+func (d *EventDispatcher) Emit(ev TenantEvent) {
+	if tenantRegistry == nil {
+		return
+	}
+	t, ok := tenantRegistry.Config(ev.Tenant)
+	if !ok || len(t.Webhooks) == 0 {
+		return
+	}
+	if ev.ID == "" {
+		ev.ID = newEventID()
+	}
+	if ev.OccurredAt.IsZero() {
+		ev.OccurredAt = time.Now()
+	}
+	body, err := json.Marshal(ev)
+	if err != nil {
+		log.Printf("❌ webhook %s: %v", ev.Event, err)
+		return
+	}
+	for _, sub := range t.Webhooks {
+		if !sub.wants(ev.Event) {
+			continue
+		}
+		p := &pendingDelivery{
+			ID:      "dlv_" + randomToken(),
+			Tenant:  ev.Tenant,
+			URL:     sub.URL,
+			EventID: ev.ID,
+			Event:   ev.Event,
+			Payload: body,
+		}
+		if err := d.savePending(p); err != nil {
+			log.Printf("⚠️ webhook %s %s -> %s: no se pudo persistir la entrega: %v", ev.Event, ev.ID, sub.URL, err)
+		}
+		go d.deliver(p, sub.secret)
+	}
+}
+
+// Resume retoma las entregas que quedaron pendientes de una corrida anterior. Va al arrancar,
+// con tenantRegistry ya cargado (el secret sale de la suscripción actual, no del disco).
+func (d *EventDispatcher) Resume() {
+	files, _ := filepath.Glob(filepath.Join(d.dir, "*", "webhooks_pending", "*.json"))
+	for _, f := range files {
+		b, err := os.ReadFile(f)
+		if err != nil {
+			log.Printf("❌ webhook pendiente %s: %v", f, err)
+			continue
+		}
+		var p pendingDelivery
+		if err := json.Unmarshal(b, &p); err != nil || p.ID == "" {
+			log.Printf("❌ webhook pendiente %s inválido: %v", f, err)
+			continue
+		}
+		secret, ok := d.subscriptionSecret(p.Tenant, p.URL)
+		if !ok {
+			p.LastError = "la suscripción ya no está en " + tenantsFile
+			d.fail(&p)
+			continue
+		}
+		log.Printf("🔁 webhook %s %s -> %s: retomando (intento %d)", p.Event, p.EventID, p.URL, p.Attempts+1)
+		go d.deliver(&p, secret)
+	}
+}
+
+func (d *EventDispatcher) subscriptionSecret(tenant, url string) (string, bool) {
+	if tenantRegistry == nil {
+		return "", false
+	}
+	t, ok := tenantRegistry.Config(tenant)
+	if !ok {
+		return "", false
+	}
+	for _, sub := range t.Webhooks {
+		if sub.URL == url && sub.secret != "" {
+			return sub.secret, true
+		}
+	}
+	return "", false
+}
+
+// deliver reintenta ante errores de red, 408, 429 y 5xx; cualquier otro 4xx es definitivo.
+// Si no se pudo entregar queda en el dead-letter log del tenant.
+func (d *EventDispatcher) deliver(p *pendingDelivery, secret string) {
+	for p.Attempts < len(d.delays)+1 {
+		if p.Attempts > 0 {
+			time.Sleep(d.delays[p.Attempts-1])
+		}
+		p.Attempts++
+
+		retry, err := d.post(p, secret)
+		if err == nil {
+			log.Printf("📤 webhook %s %s -> %s (intento %d)", p.Event, p.EventID, p.URL, p.Attempts)
+			d.removePending(p)
+			return
+		}
+		p.LastError = err.Error()
+		log.Printf("⚠️ webhook %s %s -> %s intento %d: %v", p.Event, p.EventID, p.URL, p.Attempts, err)
+		if !retry {
+			break
+		}
+		if err := d.savePending(p); err != nil {
+			log.Printf("⚠️ webhook %s %s: no se pudo persistir la entrega: %v", p.Event, p.EventID, err)
+		}
+	}
+	d.fail(p)
+}
+
+// fail pasa la entrega al dead-letter log y avisa al operador.
+func (d *EventDispatcher) fail(p *pendingDelivery) {
+	d.deadLetter(p.Tenant, deadLetter{
+		At:        time.Now(),
+		URL:       p.URL,
+		EventID:   p.EventID,
+		Event:     p.Event,
+		Attempts:  p.Attempts,
+		LastError: p.LastError,
+		Payload:   p.Payload,
+	})
+	d.removePending(p)
+	alertOperator(p.Tenant, fmt.Sprintf("webhook %s (%s) a %s descartado tras %d intentos: %s", p.Event, p.EventID, p.URL, p.Attempts, p.LastError))
+}
+
+// signWebhook firma "{timestamp}.{body}"; el timestamp va firmado para que no se pueda reutilizar la firma.
+func signWebhook(secret, timestamp string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func (d *EventDispatcher) post(p *pendingDelivery, secret string) (retry bool, err error) {
+	req, err := http.NewRequest(http.MethodPost, p.URL, bytes.NewReader(p.Payload))
+	if err != nil {
+		return false, err
+	}
+	// Timestamp por intento: un reintento horas después no cae fuera de la ventana del receptor
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "flowly-webhooks")
+	req.Header.Set("X-Flowly-Event", p.Event)
+	req.Header.Set("X-Flowly-Delivery", p.EventID)
+	req.Header.Set("X-Flowly-Timestamp", timestamp)
+	req.Header.Set("X-Flowly-Signature-256", signWebhook(secret, timestamp, p.Payload))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode <= 299:
+		return false, nil
+	case resp.StatusCode == http.StatusRequestTimeout, resp.StatusCode == http.StatusTooManyRequests, resp.StatusCode >= 500:
+		return true, fmt.Errorf("status %d", resp.StatusCode)
+	default:
+		return false, fmt.Errorf("status %d", resp.StatusCode)
+	}
+}
+
+func (d *EventDispatcher) pendingPath(p *pendingDelivery) string {
+	return filepath.Join(d.dir, p.Tenant, "webhooks_pending", p.ID+".json")
+}
+
+// savePending (re)escribe la entrega pendiente (tmp + rename, nunca queda a medias).
+func (d *EventDispatcher) savePending(p *pendingDelivery) error {
+	b, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	path := d.pendingPath(p)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func (d *EventDispatcher) removePending(p *pendingDelivery) {
+	if err := os.Remove(d.pendingPath(p)); err != nil && !os.IsNotExist(err) {
+		log.Printf("⚠️ webhook %s: %v", p.ID, err)
+	}
+}
+
+func (d *EventDispatcher) deadLetter(tenant string, dl deadLetter) {
+	b, err := json.Marshal(dl)
+	if err != nil {
+		return
+	}
+	p := filepath.Join(d.dir, tenant, "webhooks_dead.jsonl")
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		log.Printf("❌ dead-letter: %v", err)
+		return
+	}
+	f, err := os.OpenFile(p, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		log.Printf("❌ dead-letter: %v", err)
+		return
+	}
+	defer f.Close()
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		log.Printf("❌ dead-letter: %v", err)
+	}
+}
+
+func newEventID() string {
+	return "evt_" + randomToken()
+}
+
+// emitActionEvent dispara el evento de la action (si tiene uno) con lo que devolvió y lo que
+// había capturado la conversación antes de correrla (las actions pueden limpiar los inputs).
+func emitActionEvent(tenant, waID, state, action string, sess *UserSession, inputs, vars map[string]string) {
+	event, ok := actionEvents[action]
+	if !ok {
+		return
+	}
+	if event == EventClaimCreated && vars["claim_new"] == "false" {
+		event = EventClaimUpdated
+	}
+
+	attribution := map[string]string{}
+	for k, v := range sess.Data {
+		if strings.HasPrefix(k, "ref_") {
+			attribution[k] = v
+		}
+	}
+	ev := TenantEvent{
+		Event:       event,
+		Tenant:      tenant,
+		WaID:        waID,
+		Name:        sess.Data["name"],
+		State:       state,
+		Data:        vars,
+		Inputs:      inputs,
+		Attribution: attribution,
+	}
+	emitEvent(ev, sess.PhoneID)
+}
+
+// emitEvent manda el evento a los webhooks del tenant, el email que tenga configurado y lo
+// registra en su CRM. phoneID es el número por el que se bajan los adjuntos del email.
+func emitEvent(ev TenantEvent, phoneID string) {
+	if eventDispatcher != nil {
+		eventDispatcher.Emit(ev)
+	}
+	notifyEventEmail(ev, phoneID)
+	logCRMEvent(ev)
+}
+
+// validateWebhooks valida las suscripciones del tenant y resuelve sus secrets.
+func validateWebhooks(t *TenantConfig) []string {
+	var errs []string
+	for i := range t.Webhooks {
+		wh := &t.Webhooks[i]
+		wh.URL = strings.TrimSpace(wh.URL)
+		if !strings.HasPrefix(wh.URL, "https://") && !strings.HasPrefix(wh.URL, "http://") {
+			errs = append(errs, fmt.Sprintf("tenant=%s webhooks[%d] url debe ser http(s): %q", t.ID, i, wh.URL))
+		}
+		for _, e := range wh.Events {
+			if !knownEvents[e] {
+				errs = append(errs, fmt.Sprintf("tenant=%s webhooks[%d] evento desconocido %q", t.ID, i, e))
+			}
+		}
+		var err error
+		if wh.secret, err = resolveSecret(wh.Secret); err != nil || wh.secret == "" {
+			errs = append(errs, fmt.Sprintf("tenant=%s webhooks[%d] secret no resuelto: %v", t.ID, i, secretErr(err)))
+		}
+	}
+	return errs
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// webhookReceiver es el sistema del tenant: responde con statuses (el último se repite) y
+// guarda lo que recibe.
+type webhookReceiver struct {
+	mu       sync.Mutex
+	statuses []int
+	requests []receivedWebhook
+}
+
+type receivedWebhook struct {
+	Header http.Header
+	Body   []byte
+}
+
+func (rv *webhookReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	rv.mu.Lock()
+	defer rv.mu.Unlock()
+	rv.requests = append(rv.requests, receivedWebhook{Header: r.Header.Clone(), Body: body})
+	status := rv.statuses[min(len(rv.requests), len(rv.statuses))-1]
+	w.WriteHeader(status)
+}
+
+func (rv *webhookReceiver) received() []receivedWebhook {
+	rv.mu.Lock()
+	defer rv.mu.Unlock()
+	return append([]receivedWebhook(nil), rv.requests...)
+}
+
+// newTestDispatcher arma un dispatcher con reintentos inmediatos y un tenant suscripto al receptor.
+func newTestDispatcher(t *testing.T, statuses ...int) (*EventDispatcher, *webhookReceiver) {
+	t.Helper()
+	rv := &webhookReceiver{statuses: statuses}
+	srv := httptest.NewServer(rv)
+	t.Cleanup(srv.Close)
+	withTenants(t, &TenantConfig{ID: "broker", Webhooks: []WebhookConfig{{URL: srv.URL, secret: "s3cr3t"}}})
+
+	d := NewEventDispatcher(t.TempDir())
+	d.delays = []time.Duration{time.Millisecond, time.Millisecond}
+	return d, rv
+}
+
+// waitFor espera (hasta 2s) que se cumpla cond.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout esperando %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func pendingFiles(d *EventDispatcher) []string {
+	files, _ := filepath.Glob(filepath.Join(d.dir, "*", "webhooks_pending", "*.json"))
+	return files
+}
+
+func readDeadLetters(t *testing.T, d *EventDispatcher, tenant string) []deadLetter {
+	t.Helper()
+	b, err := os.ReadFile(filepath.Join(d.dir, tenant, "webhooks_dead.jsonl"))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out []deadLetter
+	for _, line := range strings.Split(strings.TrimSpace(string(b)), "\n") {
+		var dl deadLetter
+		if err := json.Unmarshal([]byte(line), &dl); err != nil {
+			t.Fatalf("dead-letter inválido %q: %v", line, err)
+		}
+		out = append(out, dl)
+	}
+	return out
+}
+
+func TestEventWebhookSignature(t *testing.T) {
+	d, rv := newTestDispatcher(t, http.StatusOK)
+	d.Emit(TenantEvent{Event: EventLeadCreated, Tenant: "broker", WaID: "5491100000000", Data: map[string]string{"lead_id": "L-1"}})
+	waitFor(t, "la entrega", func() bool { return len(rv.received()) == 1 && len(pendingFiles(d)) == 0 })
+
+	got := rv.received()[0]
+	ts := got.Header.Get("X-Flowly-Timestamp")
+	if sec, err := strconv.ParseInt(ts, 10, 64); err != nil || time.Since(time.Unix(sec, 0)).Abs() > time.Minute {
+		t.Fatalf("X-Flowly-Timestamp = %q", ts)
+	}
+	// Verificación del lado del receptor: HMAC de "{timestamp}.{body}"
+	mac := hmac.New(sha256.New, []byte("s3cr3t"))
+	mac.Write([]byte(ts + "." + string(got.Body)))
+	if want := "sha256=" + hex.EncodeToString(mac.Sum(nil)); got.Header.Get("X-Flowly-Signature-256") != want {
+		t.Errorf("firma = %q, esperaba %q", got.Header.Get("X-Flowly-Signature-256"), want)
+	}
+	// Con otro timestamp la misma firma no sirve
+	if signWebhook("s3cr3t", "1", got.Body) == got.Header.Get("X-Flowly-Signature-256") {
+		t.Error("la firma no depende del timestamp")
+	}
+	if got.Header.Get("X-Flowly-Event") != EventLeadCreated {
+		t.Errorf("X-Flowly-Event = %q", got.Header.Get("X-Flowly-Event"))
+	}
+
+	var ev TenantEvent
+	if err := json.Unmarshal(got.Body, &ev); err != nil {
+		t.Fatal(err)
+	}
+	if ev.ID == "" || ev.ID != got.Header.Get("X-Flowly-Delivery") || ev.Data["lead_id"] != "L-1" {
+		t.Errorf("evento = %+v (delivery %q)", ev, got.Header.Get("X-Flowly-Delivery"))
+	}
+}
+
+func TestEventWebhookRetriesOn5xx(t *testing.T) {
+	d, rv := newTestDispatcher(t, http.StatusServiceUnavailable, http.StatusOK)
+	d.Emit(TenantEvent{Event: EventClaimCreated, Tenant: "broker", WaID: "5491100000000"})
+	waitFor(t, "el reintento", func() bool { return len(rv.received()) == 2 && len(pendingFiles(d)) == 0 })
+
+	if dl := readDeadLetters(t, d, "broker"); len(dl) != 0 {
+		t.Errorf("entrega reintentada con éxito quedó en el dead-letter: %+v", dl)
+	}
+}
+
+func TestEventWebhookDeadLetter(t *testing.T) {
+	d, rv := newTestDispatcher(t, http.StatusInternalServerError)
+	d.Emit(TenantEvent{Event: EventHandoffRequested, Tenant: "broker", WaID: "5491100000000"})
+	waitFor(t, "el dead-letter", func() bool { return len(readDeadLetters(t, d, "broker")) == 1 })
+
+	dl := readDeadLetters(t, d, "broker")[0]
+	if dl.Attempts != 3 || len(rv.received()) != 3 || dl.Event != EventHandoffRequested || dl.LastError != "status 500" {
+		t.Errorf("dead-letter = %+v (%d requests)", dl, len(rv.received()))
+	}
+	if files := pendingFiles(d); len(files) != 0 {
+		t.Errorf("quedaron entregas pendientes: %v", files)
+	}
+}
+
+func TestEventWebhookNoRetryOn4xx(t *testing.T) {
+	d, rv := newTestDispatcher(t, http.StatusBadRequest)
+	d.Emit(TenantEvent{Event: EventLeadCreated, Tenant: "broker", WaID: "5491100000000"})
+	waitFor(t, "el dead-letter", func() bool { return len(readDeadLetters(t, d, "broker")) == 1 })
+
+	if n := len(rv.received()); n != 1 {
+		t.Errorf("un 400 no se reintenta: %d requests", n)
+	}
+}
+
+func TestEventWebhookResumesPendingDeliveries(t *testing.T) {
+	d, rv := newTestDispatcher(t, http.StatusOK)
+	url := tenantRegistry.tenants["broker"].Webhooks[0].URL
+	for _, p := range []*pendingDelivery{
+		{ID: "dlv_1", Tenant: "broker", URL: url, EventID: "evt_1", Event: EventLeadCreated, Attempts: 1, Payload: json.RawMessage(`{"id":"evt_1"}`)},
+		{ID: "dlv_2", Tenant: "broker", URL: "https://ya-no-existe.example.com", EventID: "evt_2", Event: EventLeadCreated, Payload: json.RawMessage(`{"id":"evt_2"}`)},
+	} {
+		if err := d.savePending(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	d.Resume()
+	waitFor(t, "las entregas retomadas", func() bool { return len(pendingFiles(d)) == 0 && len(rv.received()) == 1 })
+
+	if got := rv.received()[0]; got.Header.Get("X-Flowly-Delivery") != "evt_1" {
+		t.Errorf("entrega retomada = %s", got.Body)
+	}
+	if dl := readDeadLetters(t, d, "broker"); len(dl) != 1 || dl[0].EventID != "evt_2" {
+		t.Errorf("la suscripción borrada debería ir al dead-letter: %+v", dl)
+	}
+}
+
+func TestValidateWebhooksRequiresSecret(t *testing.T) {
+	tc := &TenantConfig{ID: "broker", Webhooks: []WebhookConfig{{URL: "https://example.com/hook", Secret: "env:WEBHOOK_SECRET_INEXISTENTE"}}}
+	if errs := validateWebhooks(tc); len(errs) != 1 || !strings.Contains(errs[0], "secret") {
+		t.Errorf("errores = %v", errs)
+	}
+
+	t.Setenv("WEBHOOK_SECRET_TEST", "s3cr3t")
+	tc.Webhooks[0].Secret = "env:WEBHOOK_SECRET_TEST"
+	if errs := validateWebhooks(tc); len(errs) != 0 {
+		t.Errorf("errores = %v", errs)
+	}
+}
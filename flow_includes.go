@@ -0,0 +1,213 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ---------------------
+// Flow composition: includes + sub-flows
+// ---------------------
+
+// ReturnTarget es el destino especial que vuelve al estado que llamó al sub-flow.
+const ReturnTarget = "$return"
+
+// Límite de saltos encadenados (redirects/call/$return) al resolver una transición, para cortar loops.
+const maxTransitionHops = 10
+
+// FlowInclude suma los states de otro archivo al flow del tenant.
+// Path es relativo a configs/{tenant}/ (ej: "../_shared/contact_pref.json").
+// Con Namespace, los states quedan como "NAMESPACE.STATE".
+type FlowInclude struct {
+	Path      string `json:"path"`
+	Namespace string `json:"namespace"`
+}
+
+// FlowFragment es el formato de un archivo incluido: solo states.
+type FlowFragment struct {
+	States map[string]FlowState `json:"states"`
+}
+
+// FlowCall define un estado de tipo "call": entra a un sub-flow y, cuando el sub-flow
+// transiciona a "$return", sigue en ReturnTo. Params se renderizan y quedan como vars de sesión.
+type FlowCall struct {
+	State    string            `json:"state"`
+	ReturnTo string            `json:"return_to"`
+	Params   map[string]string `json:"params,omitempty"`
+}
+
+// mapTargets aplica fn a todos los destinos de transición del estado.
+// Cualquier campo nuevo que apunte a otro estado tiene que sumarse acá.
+func mapTargets(st FlowState, fn func(string) string) FlowState {
+	if st.OnTextNext != "" {
+		st.OnTextNext = fn(st.OnTextNext)
+	}
+	if st.OnLocationNext != "" {
+		st.OnLocationNext = fn(st.OnLocationNext)
+	}
+	if st.OnMediaNext != "" {
+		st.OnMediaNext = fn(st.OnMediaNext)
+	}
+	if st.OnErrorNext != "" {
+		st.OnErrorNext = fn(st.OnErrorNext)
+	}
+	if len(st.OnSelectNext) > 0 {
+		m := make(map[string]string, len(st.OnSelectNext))
+		for k, v := range st.OnSelectNext {
+			m[k] = fn(v)
+		}
+		st.OnSelectNext = m
+	}
+	if len(st.Redirects) > 0 {
+		rs := make([]FlowRedirect, len(st.Redirects))
+		for i, r := range st.Redirects {
+			r.Next = fn(r.Next)
+			rs[i] = r
+		}
+		st.Redirects = rs
+	}
+	if st.Call != nil {
+		c := *st.Call
+		c.State = fn(c.State)
+		if c.ReturnTo != "" {
+			c.ReturnTo = fn(c.ReturnTo)
+		}
+		st.Call = &c
+	}
+	return st
+}
+
+// transitionTargets lista los destinos de transición del estado (para validar).
+func transitionTargets(st FlowState) []string {
+	var out []string
+	mapTargets(st, func(t string) string {
+		out = append(out, t)
+		return t
+	})
+	return out
+}
+
+// expandIncludes carga los archivos incluidos y suma sus states al flow.
+// Devuelve los paths leídos (para el hot reload) y su contenido (para el hash de versión).
+func expandIncludes(tenant string, cfg *FlowConfig) ([]string, []byte, error) {
+	var sources []string
+	var content []byte
+
+	baseDir := filepath.Join(configRoot, tenant)
+	absRoot, err := filepath.Abs(configRoot)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, inc := range cfg.Includes {
+		path := filepath.Join(baseDir, filepath.FromSlash(inc.Path))
+		absPath, err := filepath.Abs(path)
+		if err != nil || !strings.HasPrefix(absPath, absRoot+string(filepath.Separator)) {
+			return nil, nil, fmt.Errorf("include fuera de %s: %q", configRoot, inc.Path)
+		}
+
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return nil, nil, fmt.Errorf("no pude leer include %s: %w", path, err)
+		}
+		var frag FlowFragment
+		if err := json.Unmarshal(b, &frag); err != nil {
+			return nil, nil, fmt.Errorf("json inválido en include %s: %w", path, err)
+		}
+		if len(frag.States) == 0 {
+			return nil, nil, fmt.Errorf("include %s no tiene states", path)
+		}
+
+		ns := strings.TrimSpace(inc.Namespace)
+		qualify := func(name string) string {
+			if ns == "" {
+				return name
+			}
+			return ns + "." + name
+		}
+		// Los destinos que son states del mismo archivo se califican; el resto
+		// (states del flow principal o de otros includes, y "$return") queda igual.
+		local := func(target string) string {
+			if _, ok := frag.States[target]; ok {
+				return qualify(target)
+			}
+			return target
+		}
+
+		for name, st := range frag.States {
+			full := qualify(name)
+			if _, dup := cfg.States[full]; dup {
+				return nil, nil, fmt.Errorf("include %s: el estado %s ya existe", path, full)
+			}
+			cfg.States[full] = mapTargets(st, local)
+		}
+
+		sources = append(sources, path)
+		content = append(content, b...)
+	}
+	return sources, content, nil
+}
+
+// FlowRedirect desvía la entrada a un estado según una var (ej: is_open == "false" -> fuera de horario).
+// Se evalúa al transicionar al estado, antes de su action y render.
+type FlowRedirect struct {
+	Var    string `json:"var"`
+	Equals string `json:"equals"`
+	Next   string `json:"next"`
+}
+
+// matchRedirect devuelve el primer redirect del estado que aplica con las vars actuales.
+func matchRedirect(st FlowState, vars map[string]string) (FlowRedirect, bool) {
+	for _, r := range st.Redirects {
+		if vars[r.Var] == r.Equals {
+			return r, true
+		}
+	}
+	return FlowRedirect{}, false
+}
+
+// resolveTransition resuelve los redirects, los estados "call" y los "$return" hasta llegar a un estado
+// que se renderiza. Actualiza el call stack y las vars (params del sub-flow) de la sesión.
+func resolveTransition(cfg FlowConfig, sess *UserSession, vars map[string]string, next string) string {
+	for hop := 0; hop < maxTransitionHops; hop++ {
+		if next == ReturnTarget {
+			if len(sess.CallStack) == 0 {
+				return cfg.Entry()
+			}
+			next = sess.CallStack[len(sess.CallStack)-1]
+			sess.CallStack = sess.CallStack[:len(sess.CallStack)-1]
+			continue
+		}
+
+		st, ok := cfg.States[next]
+		if !ok {
+			return next
+		}
+		if r, matched := matchRedirect(st, vars); matched {
+			next = r.Next
+			continue
+		}
+		if st.Type != "call" || st.Call == nil {
+			return next
+		}
+
+		returnTo := st.Call.ReturnTo
+		if returnTo == "" {
+			returnTo = cfg.Entry()
+		}
+		sess.CallStack = append(append([]string(nil), sess.CallStack...), returnTo)
+		if sess.Data == nil {
+			sess.Data = make(map[string]string)
+		}
+		for k, v := range st.Call.Params {
+			v = renderVars(v, vars)
+			sess.Data[k] = v
+			vars[k] = v
+		}
+		next = st.Call.State
+	}
+	return cfg.Entry()
+}
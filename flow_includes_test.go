@@ -0,0 +1,136 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// includeTenant arma un tenant temporal dentro de configs/ (los includes no pueden salir de ahí)
+// con los archivos dados. Devuelve el id del tenant.
+func includeTenant(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir, err := os.MkdirTemp(configRoot, "test_includes_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return filepath.Base(dir)
+}
+
+const contactPrefFragment = `{"states": {
+	"ASK": {"type": "text", "body": "¿Cómo te contactamos?", "on_text_next": "DONE", "on_error_next": "MENU"},
+	"DONE": {"type": "text", "body": "Gracias", "on_text_next": "$return"}
+}}`
+
+func TestExpandIncludesNamespaces(t *testing.T) {
+	tenant := includeTenant(t, map[string]string{"contact.json": contactPrefFragment})
+	cfg := FlowConfig{
+		States:   map[string]FlowState{"MENU": {Type: "text", Body: "Hola"}},
+		Includes: []FlowInclude{{Path: "contact.json", Namespace: "LEAD"}, {Path: "contact.json", Namespace: "CLAIM"}},
+	}
+	sources, content, err := expandIncludes(tenant, &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sources) != 2 || len(content) != 2*len(contactPrefFragment) {
+		t.Errorf("sources = %v (%d bytes)", sources, len(content))
+	}
+
+	tests := []struct {
+		state, next, onError string
+	}{
+		{"LEAD.ASK", "LEAD.DONE", "MENU"},   // destino local: se califica; el del flow principal no
+		{"CLAIM.ASK", "CLAIM.DONE", "MENU"}, // el mismo archivo con otro namespace no pisa al primero
+		{"LEAD.DONE", ReturnTarget, ""},     // $return queda igual
+		{"CLAIM.DONE", ReturnTarget, ""},
+	}
+	for _, tt := range tests {
+		st, ok := cfg.States[tt.state]
+		if !ok || st.OnTextNext != tt.next || st.OnErrorNext != tt.onError {
+			t.Errorf("%s = %+v (existe %v)", tt.state, st, ok)
+		}
+	}
+}
+
+func TestExpandIncludesRejects(t *testing.T) {
+	tenant := includeTenant(t, map[string]string{"contact.json": contactPrefFragment, "empty.json": `{"states": {}}`})
+	tests := []struct {
+		name     string
+		includes []FlowInclude
+		want     string
+	}{
+		{"choca con el flow principal", []FlowInclude{{Path: "contact.json"}}, "el estado ASK ya existe"},
+		{"mismo namespace dos veces", []FlowInclude{{Path: "contact.json", Namespace: "X"}, {Path: "contact.json", Namespace: "X"}}, "ya existe"},
+		{"fuera de configs", []FlowInclude{{Path: "../../go.mod"}}, "include fuera de"},
+		{"sin states", []FlowInclude{{Path: "empty.json"}}, "no tiene states"},
+		{"inexistente", []FlowInclude{{Path: "nope.json"}}, "no pude leer"},
+	}
+	for _, tt := range tests {
+		cfg := FlowConfig{States: map[string]FlowState{"ASK": {Type: "text"}}, Includes: tt.includes}
+		if _, _, err := expandIncludes(tenant, &cfg); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: err = %v, esperaba %q", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestResolveTransitionCallAndReturn(t *testing.T) {
+	cfg := FlowConfig{States: map[string]FlowState{
+		"MENU":      {Type: "text"},
+		"QUOTE":     {Type: "call", Call: &FlowCall{State: "LEAD.ASK", ReturnTo: "THANKS", Params: map[string]string{"product": "{{line}}"}}},
+		"NESTED":    {Type: "call", Call: &FlowCall{State: "QUOTE", ReturnTo: "MENU"}},
+		"LEAD.ASK":  {Type: "text"},
+		"THANKS":    {Type: "text"},
+		"CLOSED":    {Type: "text", Redirects: []FlowRedirect{{Var: "is_open", Equals: "false", Next: "THANKS"}}},
+		"LOOP":      {Type: "call", Call: &FlowCall{State: "LOOP"}},
+		"NO_RETURN": {Type: "call", Call: &FlowCall{State: "LEAD.ASK"}},
+	}}
+
+	sess := &UserSession{}
+	vars := map[string]string{"line": "Auto"}
+	if got := resolveTransition(cfg, sess, vars, "QUOTE"); got != "LEAD.ASK" || sess.Data["product"] != "Auto" || vars["product"] != "Auto" {
+		t.Fatalf("call = %s (data %v)", got, sess.Data)
+	}
+	if got := resolveTransition(cfg, sess, vars, ReturnTarget); got != "THANKS" || len(sess.CallStack) != 0 {
+		t.Errorf("$return = %s (stack %v)", got, sess.CallStack)
+	}
+
+	sess = &UserSession{}
+	if got := resolveTransition(cfg, sess, vars, "NESTED"); got != "LEAD.ASK" || len(sess.CallStack) != 2 {
+		t.Fatalf("call anidado = %s (stack %v)", got, sess.CallStack)
+	}
+	if got := resolveTransition(cfg, sess, vars, ReturnTarget); got != "THANKS" {
+		t.Errorf("primer $return = %s", got)
+	}
+	if got := resolveTransition(cfg, sess, vars, ReturnTarget); got != "MENU" {
+		t.Errorf("segundo $return = %s", got)
+	}
+
+	tests := []struct {
+		name, next, want string
+		vars             map[string]string
+	}{
+		{"$return sin stack va a la entrada", ReturnTarget, "MENU", nil},
+		{"redirect", "CLOSED", "THANKS", map[string]string{"is_open": "false"}},
+		{"sin redirect", "CLOSED", "CLOSED", map[string]string{"is_open": "true"}},
+		{"loop de calls se corta", "LOOP", "MENU", nil},
+		{"estado inexistente se devuelve igual", "NOPE", "NOPE", nil},
+	}
+	for _, tt := range tests {
+		if got := resolveTransition(cfg, &UserSession{}, tt.vars, tt.next); got != tt.want {
+			t.Errorf("%s: %s, esperaba %s", tt.name, got, tt.want)
+		}
+	}
+
+	sess = &UserSession{}
+	resolveTransition(cfg, sess, vars, "NO_RETURN")
+	if len(sess.CallStack) != 1 || sess.CallStack[0] != "MENU" {
+		t.Errorf("call sin return_to vuelve a la entrada: stack %v", sess.CallStack)
+	}
+}
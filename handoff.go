@@ -0,0 +1,327 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ---------------------
+// Handoff (derivación a un asesor)
+// ---------------------
+
+// Mientras una sesión está en ModeHandoff el bot no responde: los mensajes entrantes
+// se encolan para el asesor hasta que la conversación se libera o vence el timeout.
+const (
+	ModeBot     = ""
+	ModeHandoff = "handoff"
+
+	defaultHandoffTimeout = 24 * time.Hour
+
+	// handoffSweepInterval: cada cuánto se liberan los handoffs vencidos sin esperar al próximo mensaje.
+	handoffSweepInterval = time.Minute
+)
+
+// HandoffMessage es un mensaje de la conversación durante el handoff:
+// del usuario ("in", encolado para el asesor) o del asesor ("out", ver inbox.go).
+type HandoffMessage struct {
+	ID        string    `json:"id"`
+	Direction string    `json:"direction"`
+	Type      string    `json:"type"`
+	Text      string    `json:"text"`
+	MediaURL  string    `json:"media_url,omitempty"`
+	Agent     string    `json:"agent,omitempty"`
+	At        time.Time `json:"at"`
+}
+
+// Handoff es una conversación derivada: motivo, contexto capturado y transcript desde la derivación.
+type Handoff struct {
+	Tenant     string            `json:"tenant"`
+	WaID       string            `json:"wa_id"`
+	PhoneID    string            `json:"phone_number_id"`
+	Name       string            `json:"name"`
+	Reason     string            `json:"reason"`
+	FromState  string            `json:"from_state"`
+	Context    map[string]string `json:"context"`
+	StartedAt  time.Time         `json:"started_at"`
+	AssignedTo string            `json:"assigned_to,omitempty"`
+	Transcript []HandoffMessage  `json:"transcript"`
+	// Pending: mensajes del usuario posteriores a la última respuesta del asesor
+	Pending int `json:"pending"`
+}
+
+type HandoffStore struct {
+	mu   sync.RWMutex
+	data map[string]*Handoff // tenant:wa_id
+}
+
+func NewHandoffStore() *HandoffStore {
+	return &HandoffStore{data: make(map[string]*Handoff)}
+}
+
+var handoffs = NewHandoffStore()
+
+func (s *HandoffStore) Start(h Handoff) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data[h.Tenant+":"+h.WaID] = &h
+}
+
+// Append suma un mensaje al transcript de la conversación. Devuelve la cantidad pendiente.
+func (s *HandoffStore) Append(tenant, waID string, m HandoffMessage) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := tenant + ":" + waID
+	h, ok := s.data[key]
+	if !ok {
+		// Handoff sin registro (ej: reinicio del proceso con la sesión en handoff)
+		h = &Handoff{Tenant: tenant, WaID: waID, StartedAt: m.At}
+		s.data[key] = h
+	}
+	h.Transcript = append(h.Transcript, m)
+	if m.Direction == "in" {
+		h.Pending++
+	} else {
+		h.Pending = 0
+	}
+	return h.Pending
+}
+
+// Assign asigna la conversación a un asesor.
+func (s *HandoffStore) Assign(tenant, waID, agent string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	h, ok := s.data[tenant+":"+waID]
+	if !ok {
+		return fmt.Errorf("la conversación %s:%s no está en handoff", tenant, waID)
+	}
+	h.AssignedTo = agent
+	return nil
+}
+
+func (s *HandoffStore) Get(tenant, waID string) (Handoff, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	h, ok := s.data[tenant+":"+waID]
+	if !ok {
+		return Handoff{}, false
+	}
+	return copyHandoff(h), true
+}
+
+func (s *HandoffStore) Remove(tenant, waID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.data, tenant+":"+waID)
+}
+
+// List devuelve los handoffs activos (de un tenant, o de todos si tenant == ""), más viejos primero.
+func (s *HandoffStore) List(tenant string) []Handoff {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	out := []Handoff{}
+	for _, h := range s.data {
+		if tenant != "" && h.Tenant != tenant {
+			continue
+		}
+		out = append(out, copyHandoff(h))
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].StartedAt.Before(out[j].StartedAt) })
+	return out
+}
+
+func copyHandoff(h *Handoff) Handoff {
+	c := *h
+	c.Transcript = append([]HandoffMessage(nil), h.Transcript...)
+	return c
+}
+
+// handoffTimeout (sin actividad del asesor) parsea FlowConfig.HandoffTimeout (ej: "2h"); vacío = 24h.
+func handoffTimeout(cfg FlowConfig) time.Duration {
+	if d, err := time.ParseDuration(strings.TrimSpace(cfg.HandoffTimeout)); err == nil && d > 0 {
+		return d
+	}
+	return defaultHandoffTimeout
+}
+
+// inboundHandoffMessage arma lo que ve el asesor de un mensaje entrante.
+func inboundHandoffMessage(msg IncomingMessage) HandoffMessage {
+	text := inputValue(msg)
+	if text == "" && msg.Type == "location" && msg.Location != nil {
+		text = fmt.Sprintf("📍 %f,%f %s", msg.Location.Latitude, msg.Location.Longitude, msg.Location.Address)
+	}
+	if text == "" {
+		text = "[" + msg.Type + "]"
+	}
+	return HandoffMessage{ID: msg.ID, Direction: "in", Type: msg.Type, Text: text, At: time.Now()}
+}
+
+// actionHandoff pasa la sesión a modo handoff: el bot deja de responder hasta que un asesor
+// libere la conversación o venza handoff_timeout. El motivo sale de action_params.handoff_reason.
+// Vars: handoff_reason
+func actionHandoff(tenant, userID string, session *UserSession) (map[string]string, error) {
+	reason := strings.TrimSpace(session.Data["handoff_reason"])
+	if reason == "" {
+		reason = "Derivación a asesor"
+	}
+
+	// Contexto para el asesor: lo capturado con save_as + datos de sesión
+	context := map[string]string{}
+	for k, v := range session.Data {
+		context[k] = v
+	}
+	for k, v := range session.Inputs {
+		context[k] = v
+	}
+
+	now := time.Now()
+	session.Mode = ModeHandoff
+	session.HandoffAt = now
+	handoffs.Start(Handoff{
+		Tenant:     tenant,
+		WaID:       userID,
+		PhoneID:    session.PhoneID,
+		Name:       session.Data["name"],
+		Reason:     reason,
+		FromState:  session.State,
+		Context:    context,
+		StartedAt:  now,
+		Transcript: []HandoffMessage{},
+	})
+
+	log.Printf("👤 Handoff tenant=%s wa_id=%s motivo=%q", tenant, userID, reason)
+	alertOperator(tenant, fmt.Sprintf("👤 Nueva derivación a asesor: %s (%s) — %s", session.Data["name"], userID, reason))
+
+	return map[string]string{"handoff_reason": reason}, nil
+}
+
+// handleHandoffMessage resuelve un mensaje entrante de una sesión en handoff.
+// Devuelve true si el mensaje quedó encolado para el asesor (el bot no responde);
+// false si el handoff venció y la sesión vuelve al bot desde el estado de entrada.
+func (a *App) handleHandoffMessage(tenant string, cfg FlowConfig, sess *UserSession, msg IncomingMessage) bool {
+	if time.Since(sess.HandoffAt) > handoffTimeout(cfg) {
+		log.Printf("⏰ Handoff vencido tenant=%s wa_id=%s, vuelve el bot", tenant, msg.From)
+		handoffs.Remove(tenant, msg.From)
+		releaseSession(cfg, sess)
+		return false
+	}
+
+	n := handoffs.Append(tenant, msg.From, inboundHandoffMessage(msg))
+	log.Printf("📥 Handoff tenant=%s wa_id=%s: mensaje encolado (%d pendientes)", tenant, msg.From, n)
+	return true
+}
+
+// expireHandoffs libera los handoffs vencidos (de un tenant, o de todos si tenant == ""), así no quedan
+// en el inbox conversaciones que el bot ya retomó. Devuelve cuántos liberó.
+func (a *App) expireHandoffs(tenant string, now time.Time) int {
+	expired := 0
+	for _, h := range handoffs.List(tenant) {
+		if a.expireHandoff(h.Tenant, h.WaID, now) {
+			expired++
+		}
+	}
+	return expired
+}
+
+func (a *App) expireHandoff(tenant, waID string, now time.Time) bool {
+	sessKey := tenant + ":" + waID
+	defer a.lockSession(sessKey)()
+
+	sess, ok := a.sessions.Get(sessKey)
+	if !ok || sess.Mode != ModeHandoff {
+		// La sesión ya no está en handoff (vencida o descartada): el registro quedó huérfano
+		handoffs.Remove(tenant, waID)
+		return true
+	}
+	cfg, err := a.flowForSession(tenant, &sess)
+	if err != nil || now.Sub(sess.HandoffAt) <= handoffTimeout(cfg) {
+		return false
+	}
+	log.Printf("⏰ Handoff vencido tenant=%s wa_id=%s, vuelve el bot", tenant, waID)
+	handoffs.Remove(tenant, waID)
+	releaseSession(cfg, &sess)
+	sess.UpdatedAt = now
+	a.sessions.Set(sessKey, sess)
+	return true
+}
+
+// startHandoffSweeper libera periódicamente los handoffs vencidos.
+func (a *App) startHandoffSweeper() {
+	go func() {
+		ticker := time.NewTicker(handoffSweepInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			a.expireHandoffs("", time.Now())
+		}
+	}()
+}
+
+// releaseSession saca la sesión del handoff; la conversación sigue desde el estado de entrada.
+func releaseSession(cfg FlowConfig, sess *UserSession) {
+	sess.Mode = ModeBot
+	sess.HandoffAt = time.Time{}
+	sess.State = cfg.Entry()
+	sess.CallStack = nil
+}
+
+// releaseHandoff libera una conversación: el próximo mensaje lo atiende el bot desde el estado de entrada.
+// Con closeConversation además se descarta la sesión (caso resuelto: la próxima vez arranca de cero).
+func (a *App) releaseHandoff(tenant, waID string, closeConversation bool) error {
+	sessKey := tenant + ":" + waID
+	defer a.lockSession(sessKey)()
+
+	sess, ok := a.sessions.Get(sessKey)
+	if !ok || sess.Mode != ModeHandoff {
+		return fmt.Errorf("la conversación %s no está en handoff", sessKey)
+	}
+	handoffs.Remove(tenant, waID)
+
+	if closeConversation {
+		a.sessions.Delete(sessKey)
+		log.Printf("✅ Handoff cerrado tenant=%s wa_id=%s", tenant, waID)
+		return nil
+	}
+
+	cfg, err := a.flowForSession(tenant, &sess)
+	if err != nil {
+		return err
+	}
+	releaseSession(cfg, &sess)
+	sess.UpdatedAt = time.Now()
+	a.sessions.Set(sessKey, sess)
+	log.Printf("🔓 Handoff liberado tenant=%s wa_id=%s", tenant, waID)
+	return nil
+}
+
+// GET  /admin/handoffs[?tenant=broker]               -> conversaciones derivadas con su transcript
+// POST /admin/handoffs/release?tenant=broker&wa_id=… -> devuelve la conversación al bot
+func (a *App) handleAdminHandoffs(w http.ResponseWriter, r *http.Request) {
+	if !a.requireAdmin(w, r) {
+		return
+	}
+	q := r.URL.Query()
+
+	if strings.HasSuffix(r.URL.Path, "/release") {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if q.Get("tenant") == "" || q.Get("wa_id") == "" {
+			http.Error(w, "faltan tenant y wa_id", http.StatusBadRequest)
+			return
+		}
+		if err := a.releaseHandoff(q.Get("tenant"), q.Get("wa_id"), false); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		writeJSON(w, map[string]string{"status": "released"})
+		return
+	}
+
+	a.expireHandoffs(q.Get("tenant"), time.Now())
+	writeJSON(w, handoffs.List(q.Get("tenant")))
+}
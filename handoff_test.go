@@ -0,0 +1,51 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestExpireHandoffs(t *testing.T) {
+	tenant := includeTenant(t, map[string]string{"flow.json": `{"version": "1", "handoff_timeout": "1h", "states": {
+		"MENU": {"type": "text", "body": "Hola", "on_text_next": "MENU"}
+	}}`})
+	a := &App{sessionLocks: map[string]*sessionLock{}, sessions: NewSessionStore(), cache: NewConfigCache()}
+	t.Cleanup(func() {
+		for _, h := range handoffs.List(tenant) {
+			handoffs.Remove(h.Tenant, h.WaID)
+		}
+	})
+
+	now := time.Now()
+	tests := []struct {
+		waID      string
+		mode      string
+		handoffAt time.Time
+		expired   bool
+	}{
+		{"111", ModeHandoff, now.Add(-2 * time.Hour), true},
+		{"222", ModeHandoff, now.Add(-10 * time.Minute), false},
+		{"333", ModeBot, time.Time{}, true}, // registro huérfano
+	}
+	for _, tt := range tests {
+		a.sessions.Set(tenant+":"+tt.waID, UserSession{State: "HANDOFF", Mode: tt.mode, HandoffAt: tt.handoffAt})
+		handoffs.Start(Handoff{Tenant: tenant, WaID: tt.waID, StartedAt: tt.handoffAt})
+	}
+
+	if n := a.expireHandoffs(tenant, now); n != 2 {
+		t.Errorf("liberados = %d, esperaba 2", n)
+	}
+	for _, tt := range tests {
+		_, listed := handoffs.Get(tenant, tt.waID)
+		sess, _ := a.sessions.Get(tenant + ":" + tt.waID)
+		if listed == tt.expired {
+			t.Errorf("%s: sigue en el inbox = %v", tt.waID, listed)
+		}
+		if tt.mode == ModeHandoff && tt.expired && (sess.Mode != ModeBot || sess.State != "MENU") {
+			t.Errorf("%s: sesión %+v, esperaba volver al bot en MENU", tt.waID, sess)
+		}
+		if !tt.expired && sess.Mode != ModeHandoff {
+			t.Errorf("%s: se liberó antes del timeout", tt.waID)
+		}
+	}
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ---------------------
+// Action "http": llamada a un endpoint externo declarada en flow.json
+// ---------------------
+
+// FlowHTTPRequest configura la action "http" de un estado:
+//
+//	"action": "http",
+//	"http": {
+//	  "method": "POST",
+//	  "url": "https://crm.example.com/api/contacts?phone={{wa_id}}",
+//	  "headers": { "Authorization": "Bearer {{secret:crm_token}}" },
+//	  "body": { "name": "{{name}}", "dni": "{{dni}}" },
+//	  "timeout": "3s",
+//	  "response_map": { "crm_id": "$.data.id", "crm_plan": "$.data.plans[0].name" }
+//	},
+//	"on_error_next": "CRM_ERROR"
+//
+// URL, headers y los strings del body se renderizan con las vars de la sesión; {{secret:nombre}}
+// sale de tenants.json -> secrets (nunca queda en las vars). En la URL las vars se escapan y el host
+// tiene que quedar fijo en el template. Si falla (red, timeout, status no 2xx, respuesta inválida)
+// la conversación sigue por on_error_next.
+//
+// La llamada corre dentro del webhook de Meta con la sesión tomada: de ahí el timeout corto.
+type FlowHTTPRequest struct {
+	Method      string            `json:"method,omitempty"` // default GET (POST si hay body)
+	URL         string            `json:"url"`
+	Headers     map[string]string `json:"headers,omitempty"`
+	Body        json.RawMessage   `json:"body,omitempty"`
+	Timeout     string            `json:"timeout,omitempty"`      // default 5s, máx 10s
+	ResponseMap map[string]string `json:"response_map,omitempty"` // var -> path ($.a.b[0].c)
+}
+
+const (
+	httpActionName = "http"
+
+	defaultHTTPActionTimeout = 5 * time.Second
+	maxHTTPActionTimeout     = 10 * time.Second
+	maxHTTPActionResponse    = 1 << 20
+)
+
+var (
+	httpActionMethods = map[string]bool{"GET": true, "POST": true, "PUT": true, "PATCH": true, "DELETE": true}
+	secretRefRe       = regexp.MustCompile(`\{\{secret:([A-Za-z0-9_.-]+)\}\}`)
+
+	// httpActionClient no sigue redirects a otro host: los headers llevan secrets del tenant.
+	httpActionClient = &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 5 || req.URL.Host != via[0].URL.Host {
+				return fmt.Errorf("redirect a %s no permitido", req.URL.Host)
+			}
+			return nil
+		},
+	}
+)
+
+func (h *FlowHTTPRequest) method() string {
+	if m := strings.ToUpper(strings.TrimSpace(h.Method)); m != "" {
+		return m
+	}
+	if len(h.Body) > 0 {
+		return http.MethodPost
+	}
+	return http.MethodGet
+}
+
+func (h *FlowHTTPRequest) timeout() time.Duration {
+	if d, err := time.ParseDuration(strings.TrimSpace(h.Timeout)); err == nil && d > 0 {
+		return d
+	}
+	return defaultHTTPActionTimeout
+}
+
+// validateHTTPAction devuelve los errores de configuración de la action http del estado.
+func validateHTTPAction(stateName string, st FlowState) []string {
+	if st.Action != httpActionName {
+		if st.HTTP != nil {
+			return []string{fmt.Sprintf("state=%s define http pero su action no es %q", stateName, httpActionName)}
+		}
+		return nil
+	}
+	h := st.HTTP
+	if h == nil || strings.TrimSpace(h.URL) == "" {
+		return []string{fmt.Sprintf("state=%s action http sin http.url", stateName)}
+	}
+
+	var errs []string
+	if !strings.HasPrefix(h.URL, "https://") && !strings.HasPrefix(h.URL, "http://") {
+		errs = append(errs, fmt.Sprintf("state=%s http.url debe ser http(s): %q", stateName, h.URL))
+	}
+	if !httpActionMethods[h.method()] {
+		errs = append(errs, fmt.Sprintf("state=%s http.method no soportado: %q", stateName, h.Method))
+	}
+	if h.Timeout != "" {
+		d, err := time.ParseDuration(h.Timeout)
+		if err != nil || d <= 0 || d > maxHTTPActionTimeout {
+			errs = append(errs, fmt.Sprintf("state=%s http.timeout inválido %q (máx %s)", stateName, h.Timeout, maxHTTPActionTimeout))
+		}
+	}
+	for v, path := range h.ResponseMap {
+		if _, err := parseJSONPath(path); err != nil {
+			errs = append(errs, fmt.Sprintf("state=%s http.response_map.%s: %v", stateName, v, err))
+		}
+	}
+	return errs
+}
+
+// httpAction arma la ActionFunc de un estado con action "http".
+// Vars: http_status + las de response_map
+func httpAction(h *FlowHTTPRequest, vars map[string]string) ActionFunc {
+	return func(tenant, userID string, session *UserSession) (map[string]string, error) {
+		if h == nil {
+			return nil, fmt.Errorf("action http sin configuración")
+		}
+		secrets, err := httpActionSecrets(tenant, h)
+		if err != nil {
+			return nil, err
+		}
+		render := func(s string) string {
+			return renderVars(renderVars(s, secrets), vars)
+		}
+
+		u, err := renderHTTPActionURL(h.URL, secrets, vars)
+		if err != nil {
+			return nil, err
+		}
+
+		var body io.Reader
+		if len(h.Body) > 0 {
+			var tmpl any
+			if err := json.Unmarshal(h.Body, &tmpl); err != nil {
+				return nil, fmt.Errorf("http: body inválido: %w", err)
+			}
+			b, err := json.Marshal(renderJSONTemplate(tmpl, render))
+			if err != nil {
+				return nil, err
+			}
+			body = bytes.NewReader(b)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), h.timeout())
+		defer cancel()
+		req, err := http.NewRequestWithContext(ctx, h.method(), u.String(), body)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Accept", "application/json")
+		if body != nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		for k, v := range h.Headers {
+			req.Header.Set(k, render(v))
+		}
+
+		start := time.Now()
+		resp, err := httpActionClient.Do(req)
+		if err != nil {
+			return nil, fmt.Errorf("http %s %s: %w", req.Method, u.Host, err)
+		}
+		defer resp.Body.Close()
+		raw, err := io.ReadAll(io.LimitReader(resp.Body, maxHTTPActionResponse))
+		if err != nil {
+			return nil, fmt.Errorf("http %s %s: leyendo respuesta: %w", req.Method, u.Host, err)
+		}
+		log.Printf("🌐 http %s %s%s -> %d (%s)", req.Method, u.Host, u.EscapedPath(), resp.StatusCode, time.Since(start).Round(time.Millisecond))
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			return nil, fmt.Errorf("http %s %s: status %d", req.Method, u.Host, resp.StatusCode)
+		}
+
+		out := map[string]string{"http_status": strconv.Itoa(resp.StatusCode)}
+		if len(h.ResponseMap) == 0 {
+			return out, nil
+		}
+		dec := json.NewDecoder(bytes.NewReader(raw))
+		dec.UseNumber()
+		var doc any
+		if err := dec.Decode(&doc); err != nil {
+			return nil, fmt.Errorf("http %s %s: la respuesta no es JSON: %w", req.Method, u.Host, err)
+		}
+		for v, path := range h.ResponseMap {
+			// Un campo ausente queda vacío (no "{{var}}" en el mensaje)
+			out[v] = ""
+			if val, ok := lookupJSONPath(doc, path); ok {
+				out[v] = jsonValueString(val)
+			}
+		}
+		return out, nil
+	}
+}
+
+// renderHTTPActionURL renderiza la URL de la action. Secretos primero (un input del usuario con
+// "{{secret:x}}" queda literal); después las vars, escapadas con PathEscape antes del "?" y
+// QueryEscape en el query string, así lo que escribió el usuario no puede cambiar el path
+// ("../../admin") ni el host al que viajan los headers con secrets.
+func renderHTTPActionURL(tmpl string, secrets, vars map[string]string) (*url.URL, error) {
+	base, query, hasQuery := strings.Cut(renderURLVars(tmpl, secrets), "?")
+	want, err := url.Parse(base)
+	if err != nil || want.Host == "" {
+		return nil, fmt.Errorf("http: url inválida %q (el host no puede salir de una var)", tmpl)
+	}
+
+	pathVars := make(map[string]string, len(vars))
+	queryVars := make(map[string]string, len(vars))
+	for k, v := range vars {
+		p := url.PathEscape(v)
+		if p == "." || p == ".." {
+			p = strings.ReplaceAll(p, ".", "%2E")
+		}
+		pathVars[k] = p
+		queryVars[k] = url.QueryEscape(v)
+	}
+	target := renderVars(base, pathVars)
+	if hasQuery {
+		target += "?" + renderVars(query, queryVars)
+	}
+
+	u, err := url.Parse(target)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host != want.Host {
+		return nil, fmt.Errorf("http: url inválida %q", target)
+	}
+	return u, nil
+}
+
+// httpActionSecrets resuelve los {{secret:nombre}} usados en url/headers/body.
+func httpActionSecrets(tenant string, h *FlowHTTPRequest) (map[string]string, error) {
+	var refs []string
+	for _, s := range append([]string{h.URL, string(h.Body)}, mapValues(h.Headers)...) {
+		for _, m := range secretRefRe.FindAllStringSubmatch(s, -1) {
+			refs = append(refs, m[1])
+		}
+	}
+	secrets := map[string]string{}
+	for _, name := range refs {
+		if tenantRegistry == nil {
+			return nil, fmt.Errorf("http: {{secret:%s}} requiere %s", name, tenantsFile)
+		}
+		v, err := tenantRegistry.Secret(tenant, name)
+		if err != nil {
+			return nil, fmt.Errorf("http: %w", err)
+		}
+		secrets["secret:"+name] = v
+	}
+	return secrets, nil
+}
+
+func mapValues(m map[string]string) []string {
+	out := make([]string, 0, len(m))
+	for _, v := range m {
+		out = append(out, v)
+	}
+	return out
+}
+
+// renderJSONTemplate renderiza los strings (valores, no claves) de un body JSON.
+func renderJSONTemplate(v any, render func(string) string) any {
+	switch t := v.(type) {
+	case string:
+		return render(t)
+	case map[string]any:
+		out := make(map[string]any, len(t))
+		for k, x := range t {
+			out[k] = renderJSONTemplate(x, render)
+		}
+		return out
+	case []any:
+		out := make([]any, len(t))
+		for i, x := range t {
+			out[i] = renderJSONTemplate(x, render)
+		}
+		return out
+	default:
+		return v
+	}
+}
+
+// parseJSONPath convierte "$.data.items[0].name" (o "data.items.0.name") en sus segmentos.
+func parseJSONPath(path string) ([]string, error) {
+	p := strings.TrimSpace(path)
+	p = strings.TrimPrefix(strings.TrimPrefix(p, "$"), ".")
+	p = strings.NewReplacer("[", ".", "]", "").Replace(p)
+	if p == "" {
+		return nil, fmt.Errorf("path vacío")
+	}
+	parts := strings.Split(p, ".")
+	for _, s := range parts {
+		if s == "" {
+			return nil, fmt.Errorf("path inválido %q", path)
+		}
+	}
+	return parts, nil
+}
+
+// lookupJSONPath recorre el documento JSON decodificado siguiendo el path.
+func lookupJSONPath(doc any, path string) (any, bool) {
+	parts, err := parseJSONPath(path)
+	if err != nil {
+		return nil, false
+	}
+	cur := doc
+	for _, p := range parts {
+		switch t := cur.(type) {
+		case map[string]any:
+			v, ok := t[p]
+			if !ok {
+				return nil, false
+			}
+			cur = v
+		case []any:
+			i, err := strconv.Atoi(p)
+			if err != nil || i < 0 || i >= len(t) {
+				return nil, false
+			}
+			cur = t[i]
+		default:
+			return nil, false
+		}
+	}
+	return cur, true
+}
+
+// jsonValueString pasa un valor JSON a var: strings/números/bool tal cual, objetos y listas como JSON.
+func jsonValueString(v any) string {
+	switch t := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return t
+	case json.Number:
+		return t.String()
+	case bool:
+		return strconv.FormatBool(t)
+	default:
+		b, _ := json.Marshal(t)
+		return string(b)
+	}
+}
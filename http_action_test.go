@@ -0,0 +1,39 @@
+package main
+
+import "testing"
+
+func TestRenderHTTPActionURL(t *testing.T) {
+	secrets := map[string]string{"secret:crm_host": "crm.example.com", "secret:api_key": "k&y=1"}
+	tests := []struct {
+		name    string
+		tmpl    string
+		vars    map[string]string
+		want    string
+		wantErr bool
+	}{
+		{"path escapado", "https://api.example.com/clientes/{{dni}}", map[string]string{"dni": "12/34?x"}, "https://api.example.com/clientes/12%2F34%3Fx", false},
+		{"punto no sube de directorio", "https://api.example.com/clientes/{{dni}}/polizas", map[string]string{"dni": ".."}, "https://api.example.com/clientes/%2E%2E/polizas", false},
+		{"punto solo", "https://api.example.com/clientes/{{dni}}", map[string]string{"dni": "."}, "https://api.example.com/clientes/%2E", false},
+		{"query escapado", "https://api.example.com/buscar?q={{q}}&tipo=auto", map[string]string{"q": "a b&tipo=admin"}, "https://api.example.com/buscar?q=a+b%26tipo%3Dadmin&tipo=auto", false},
+		{"secret en el host", "https://{{secret:crm_host}}/v1?key={{secret:api_key}}", nil, "https://crm.example.com/v1?key=k%26y%3D1", false},
+		{"host desde una var", "https://{{host}}/v1", map[string]string{"host": "evil.example.com"}, "", true},
+		{"var que cambia el host", "https://api.example.com{{path}}", map[string]string{"path": "@evil.example.com"}, "", true},
+		{"esquema no http", "ftp://api.example.com/{{x}}", map[string]string{"x": "a"}, "", true},
+	}
+	for _, tt := range tests {
+		u, err := renderHTTPActionURL(tt.tmpl, secrets, tt.vars)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%s: esperaba error, dio %s", tt.name, u)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if got := u.String(); got != tt.want {
+			t.Errorf("%s: %s, esperaba %s", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"crypto/hmac"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// ---------------------
+// Inbox de asesores (conversaciones en handoff)
+// ---------------------
+
+// API (JSON o form; Authorization: Bearer {token} o Basic con el token como password):
+//
+//	GET  /api/inbox[?tenant=broker]                    -> conversaciones derivadas con transcript
+//	GET  /api/inbox/conversation?tenant=broker&wa_id=… -> una conversación
+//	POST /api/inbox/reply   {tenant, wa_id, text} | {tenant, wa_id, media_type, media_url, caption, filename}
+//	POST /api/inbox/assign  {tenant, wa_id[, agent]} (sin agent: se la asigna quien llama; agent debe estar en agents del tenant)
+//	POST /api/inbox/release {tenant, wa_id}          -> vuelve el bot desde el estado de entrada
+//	POST /api/inbox/close   {tenant, wa_id}          -> caso resuelto: se descarta la sesión
+//
+// GET /inbox[?tenant=broker] -> la misma información en HTML (los forms postean a la API).
+//
+// Los asesores (tenants.json -> agents) solo ven su tenant; ADMIN_TOKEN ve todos.
+
+// inboxAgent es quien está usando el inbox. Tenant vacío = admin (todos los tenants).
+type inboxAgent struct {
+	Tenant string
+	Name   string
+}
+
+func (ag inboxAgent) canAccess(tenant string) bool {
+	return ag.Tenant == "" || ag.Tenant == tenant
+}
+
+type inboxRequest struct {
+	Tenant    string `json:"tenant"`
+	WaID      string `json:"wa_id"`
+	Text      string `json:"text"`
+	MediaType string `json:"media_type"`
+	MediaURL  string `json:"media_url"`
+	Caption   string `json:"caption"`
+	Filename  string `json:"filename"`
+	Agent     string `json:"agent"`
+}
+
+// authenticateAgent valida el token (Bearer, o Basic para el navegador) contra los asesores
+// de tenants.json y ADMIN_TOKEN. Si falla responde 401 (con challenge Basic para el HTML).
+func (a *App) authenticateAgent(w http.ResponseWriter, r *http.Request) (inboxAgent, bool) {
+	token, isBearer := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !isBearer {
+		_, token, _ = r.BasicAuth()
+	}
+
+	if token != "" {
+		if tenant, name, ok := a.resolver.AuthenticateAgent(token); ok {
+			return inboxAgent{Tenant: tenant, Name: name}, true
+		}
+		if a.adminToken != "" && hmac.Equal([]byte(token), []byte(a.adminToken)) {
+			return inboxAgent{Name: "admin"}, true
+		}
+	}
+
+	w.Header().Set("WWW-Authenticate", `Basic realm="flowly inbox"`)
+	w.WriteHeader(http.StatusUnauthorized)
+	return inboxAgent{}, false
+}
+
+func parseInboxRequest(r *http.Request) (inboxRequest, error) {
+	var req inboxRequest
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			return req, fmt.Errorf("json inválido: %w", err)
+		}
+	} else {
+		if err := r.ParseForm(); err != nil {
+			return req, err
+		}
+		req = inboxRequest{
+			Tenant:    r.FormValue("tenant"),
+			WaID:      r.FormValue("wa_id"),
+			Text:      r.FormValue("text"),
+			MediaType: r.FormValue("media_type"),
+			MediaURL:  r.FormValue("media_url"),
+			Caption:   r.FormValue("caption"),
+			Filename:  r.FormValue("filename"),
+			Agent:     r.FormValue("agent"),
+		}
+	}
+	req.Tenant = strings.TrimSpace(req.Tenant)
+	req.WaID = strings.TrimSpace(req.WaID)
+	if req.Tenant == "" || req.WaID == "" {
+		return req, fmt.Errorf("faltan tenant y wa_id")
+	}
+	return req, nil
+}
+
+// agentReply envía la respuesta del asesor por el número de la conversación y la suma al transcript.
+// La respuesta cuenta como actividad: reinicia el handoff_timeout.
+func (a *App) agentReply(agent inboxAgent, req inboxRequest) error {
+	sessKey := req.Tenant + ":" + req.WaID
+	defer a.lockSession(sessKey)()
+
+	sess, ok := a.sessions.Get(sessKey)
+	if !ok || sess.Mode != ModeHandoff {
+		return fmt.Errorf("la conversación %s no está en handoff", sessKey)
+	}
+	if sess.PhoneID == "" {
+		return fmt.Errorf("la conversación %s no tiene número asociado", sessKey)
+	}
+	waClient, err := a.clients.Get(sess.PhoneID)
+	if err != nil {
+		return err
+	}
+
+	out := HandoffMessage{Direction: "out", Agent: agent.Name, At: time.Now()}
+	var msgID string
+	switch {
+	case strings.TrimSpace(req.MediaURL) != "":
+		mediaType := req.MediaType
+		if mediaType == "" {
+			mediaType = "image"
+		}
+		switch mediaType {
+		case "image", "document", "video", "audio":
+		default:
+			return fmt.Errorf("media_type inválido: %s (image|document|video|audio)", mediaType)
+		}
+		if u, err := url.Parse(req.MediaURL); err != nil || u.Scheme != "https" {
+			return fmt.Errorf("media_url debe ser una URL https pública")
+		}
+		msgID, err = waClient.sendMedia(req.WaID, mediaType, req.MediaURL, req.Caption, req.Filename)
+		out.Type, out.MediaURL, out.Text = mediaType, req.MediaURL, req.Caption
+	case strings.TrimSpace(req.Text) != "":
+		msgID, err = waClient.sendText(req.WaID, req.Text)
+		out.Type, out.Text = "text", req.Text
+	default:
+		return fmt.Errorf("falta text o media_url")
+	}
+	if err != nil {
+		return fmt.Errorf("no se pudo enviar: %w", err)
+	}
+
+	out.ID = msgID
+	handoffs.Append(req.Tenant, req.WaID, out)
+	a.messages.RecordOutbound(req.Tenant, req.WaID, "HANDOFF", msgID)
+	a.transcripts.Append(req.Tenant, req.WaID, TranscriptEntry{
+		At:        out.At,
+		Direction: "out",
+		State:     sess.State,
+		Type:      out.Type,
+		Text:      strings.TrimSpace(out.Text + " " + out.MediaURL),
+		MessageID: msgID,
+		Agent:     agent.Name,
+	})
+
+	sess.HandoffAt = out.At
+	sess.UpdatedAt = out.At
+	a.sessions.Set(sessKey, sess)
+	log.Printf("💬 Asesor %s respondió a %s (%s)", agent.Name, sessKey, out.Type)
+	return nil
+}
+
+// GET /api/inbox, GET /api/inbox/conversation, POST /api/inbox/{reply,assign,release,close}
+func (a *App) handleInboxAPI(w http.ResponseWriter, r *http.Request) {
+	agent, ok := a.authenticateAgent(w, r)
+	if !ok {
+		return
+	}
+	action := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/inbox"), "/")
+
+	if r.Method == http.MethodGet {
+		q := r.URL.Query()
+		tenant := q.Get("tenant")
+		if tenant == "" {
+			tenant = agent.Tenant
+		}
+		if !agent.canAccess(tenant) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		switch action {
+		case "":
+			a.expireHandoffs(tenant, time.Now())
+			writeJSON(w, handoffs.List(tenant))
+		case "conversation":
+			h, found := handoffs.Get(tenant, q.Get("wa_id"))
+			if !found {
+				http.Error(w, "conversación no encontrada", http.StatusNotFound)
+				return
+			}
+			writeJSON(w, h)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Los forms usan Basic auth (el navegador la reenvía sola): solo aceptamos posts desde el mismo host
+	if !strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") && !sameOrigin(r) {
+		http.Error(w, "origen no permitido", http.StatusForbidden)
+		return
+	}
+
+	req, err := parseInboxRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !agent.canAccess(req.Tenant) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	switch action {
+	case "reply":
+		err = a.agentReply(agent, req)
+	case "assign":
+		assignee := strings.TrimSpace(req.Agent)
+		switch {
+		case assignee == "":
+			assignee = agent.Name
+		case !a.resolver.HasAgent(req.Tenant, assignee):
+			// Un typo dejaría la conversación asignada a alguien que nunca la va a ver
+			http.Error(w, fmt.Sprintf("el asesor %q no está en agents de %s", assignee, req.Tenant), http.StatusBadRequest)
+			return
+		}
+		err = handoffs.Assign(req.Tenant, req.WaID, assignee)
+		if err == nil {
+			log.Printf("🙋 %s:%s asignada a %s (por %s)", req.Tenant, req.WaID, assignee, agent.Name)
+		}
+	case "release":
+		err = a.releaseHandoff(req.Tenant, req.WaID, false)
+	case "close":
+		err = a.releaseHandoff(req.Tenant, req.WaID, true)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("⚠️ inbox %s %s:%s: %v", action, req.Tenant, req.WaID, err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Los forms del inbox HTML vuelven a la página; la API responde JSON
+	if !strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		http.Redirect(w, r, "/inbox?tenant="+url.QueryEscape(req.Tenant), http.StatusSeeOther)
+		return
+	}
+	writeJSON(w, map[string]string{"status": "ok"})
+}
+
+// sameOrigin: el form viene de una página de este mismo host. Sin Origin ni Referer no se puede
+// saber de dónde viene, así que se rechaza (los navegadores mandan al menos uno en los POST).
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		origin = r.Header.Get("Referer")
+	}
+	if origin == "" {
+		return false
+	}
+	u, err := url.Parse(origin)
+	return err == nil && u.Host == r.Host
+}
+
+var inboxTemplate = template.Must(template.New("inbox").Funcs(template.FuncMap{
+	"fmtTime": func(t time.Time) string { return t.Format("02/01 15:04") },
+}).Parse(`<!doctype html>
+<html lang="es">
+<head>
+<meta charset="utf-8">
+<title>Inbox{{if .Tenant}} · {{.Tenant}}{{end}}</title>
+<style>
+body { font-family: system-ui, sans-serif; margin: 2rem; background: #f4f5f7; }
+.conv { background: #fff; border-radius: 8px; padding: 1rem; margin-bottom: 1.5rem; box-shadow: 0 1px 3px #0002; }
+.meta { color: #555; font-size: .9rem; }
+.msg { margin: .3rem 0; padding: .4rem .6rem; border-radius: 6px; max-width: 70%; }
+.in { background: #eef; }
+.out { background: #dfd; margin-left: auto; text-align: right; }
+.actions form { display: inline; }
+textarea { width: 100%; }
+</style>
+</head>
+<body>
+<h1>Conversaciones derivadas{{if .Tenant}} · {{.Tenant}}{{end}}</h1>
+<p class="meta">Asesor: {{.Agent}}</p>
+{{range .Handoffs}}
+<div class="conv">
+  <h3>{{.Name}} · {{.WaID}} {{if .Pending}}<small>({{.Pending}} sin responder)</small>{{end}}</h3>
+  <p class="meta">{{.Tenant}} · {{.Reason}} · desde {{fmtTime .StartedAt}} · {{if .AssignedTo}}asignada a {{.AssignedTo}}{{else}}sin asignar{{end}}</p>
+  <p class="meta"><a href="/api/transcripts?tenant={{.Tenant}}&wa_id={{.WaID}}&format=text">Historial completo</a></p>
+  {{if .Context}}<details><summary>Contexto</summary><ul>{{range $k, $v := .Context}}<li><b>{{$k}}</b>: {{$v}}</li>{{end}}</ul></details>{{end}}
+  {{range .Transcript}}
+  <div class="msg {{.Direction}}">{{if .MediaURL}}<a href="{{.MediaURL}}">[{{.Type}}]</a> {{end}}{{.Text}}<br><small>{{if .Agent}}{{.Agent}} · {{end}}{{fmtTime .At}}</small></div>
+  {{end}}
+  <form method="post" action="/api/inbox/reply">
+    <input type="hidden" name="tenant" value="{{.Tenant}}"><input type="hidden" name="wa_id" value="{{.WaID}}">
+    <textarea name="text" rows="2" placeholder="Respuesta"></textarea>
+    <input name="media_url" placeholder="https://... (imagen/documento, opcional)" size="40">
+    <select name="media_type"><option>image</option><option>document</option></select>
+    <button>Enviar</button>
+  </form>
+  <div class="actions">
+    <form method="post" action="/api/inbox/assign"><input type="hidden" name="tenant" value="{{.Tenant}}"><input type="hidden" name="wa_id" value="{{.WaID}}"><button>Tomar</button></form>
+    <form method="post" action="/api/inbox/release"><input type="hidden" name="tenant" value="{{.Tenant}}"><input type="hidden" name="wa_id" value="{{.WaID}}"><button>Devolver al bot</button></form>
+    <form method="post" action="/api/inbox/close"><input type="hidden" name="tenant" value="{{.Tenant}}"><input type="hidden" name="wa_id" value="{{.WaID}}"><button>Cerrar</button></form>
+  </div>
+</div>
+{{else}}
+<p>No hay conversaciones derivadas 🎉</p>
+{{end}}
+</body>
+</html>`))
+
+// GET /inbox[?tenant=broker] -> inbox HTML de los asesores
+func (a *App) handleInboxPage(w http.ResponseWriter, r *http.Request) {
+	agent, ok := a.authenticateAgent(w, r)
+	if !ok {
+		return
+	}
+	tenant := r.URL.Query().Get("tenant")
+	if tenant == "" {
+		tenant = agent.Tenant
+	}
+	if !agent.canAccess(tenant) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	a.expireHandoffs(tenant, time.Now())
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err := inboxTemplate.Execute(w, map[string]any{
+		"Tenant":   tenant,
+		"Agent":    agent.Name,
+		"Handoffs": handoffs.List(tenant),
+	})
+	if err != nil {
+		log.Printf("ERROR render inbox: %v", err)
+	}
+}
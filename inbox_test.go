@@ -0,0 +1,43 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestInboxAssignRejectsUnknownAgent(t *testing.T) {
+	r := &TenantResolver{byPhoneNumberID: map[string]string{}, tenants: map[string]*TenantConfig{}, alertedUnknown: map[string]bool{}}
+	r.register([]TenantConfig{
+		{ID: "broker", Enabled: true, Agents: []AgentConfig{{Name: "Ana", token: "tok-ana"}, {Name: "Beto", token: "tok-beto"}}},
+		{ID: "demo_medical", Enabled: true, Agents: []AgentConfig{{Name: "Carla", token: "tok-carla"}}},
+	})
+	a := &App{resolver: r}
+	handoffs.Start(Handoff{Tenant: "broker", WaID: "5491155550000"})
+	t.Cleanup(func() { handoffs.Remove("broker", "5491155550000") })
+
+	tests := []struct {
+		agent    string
+		status   int
+		assigned string
+	}{
+		{"", http.StatusOK, "Ana"}, // sin agent: quien llama
+		{"Beto", http.StatusOK, "Beto"},
+		{"Bto", http.StatusBadRequest, "Beto"},
+		{"Carla", http.StatusBadRequest, "Beto"}, // asesora de otro tenant
+	}
+	for _, tt := range tests {
+		body := `{"tenant": "broker", "wa_id": "5491155550000", "agent": "` + tt.agent + `"}`
+		req := httptest.NewRequest(http.MethodPost, "/api/inbox/assign", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer tok-ana")
+		w := httptest.NewRecorder()
+		a.handleInboxAPI(w, req)
+
+		h, _ := handoffs.Get("broker", "5491155550000")
+		if w.Code != tt.status || h.AssignedTo != tt.assigned {
+			t.Errorf("agent %q: status %d asignada a %q, esperaba %d %q", tt.agent, w.Code, h.AssignedTo, tt.status, tt.assigned)
+		}
+	}
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ---------------------
+// Leads (save_lead)
+// ---------------------
+
+// Lead es una consulta comercial registrada al terminar el flow de cotización.
+// Fields son los datos capturados con save_as en los estados del flow; Attribution las vars ref_*.
+type Lead struct {
+	ID          string            `json:"id"`
+	Tenant      string            `json:"tenant"`
+	WaID        string            `json:"wa_id"`
+	Name        string            `json:"name"`
+	ProductLine string            `json:"product_line"`
+	ContactPref string            `json:"contact_pref"`
+	Fields      map[string]string `json:"fields"`
+	Attribution map[string]string `json:"attribution,omitempty"`
+	StartedAt   time.Time         `json:"started_at"`
+	CreatedAt   time.Time         `json:"created_at"`
+}
+
+// LeadStore persiste los leads en {dataDir}/{tenant}/leads.jsonl (append-only, una línea por lead).
+type LeadStore struct {
+	mu  sync.Mutex
+	dir string
+}
+
+func NewLeadStore(dir string) *LeadStore {
+	return &LeadStore{dir: dir}
+}
+
+// dataDir es la carpeta de datos generados por el bot (leads, etc). Default "data".
+func dataDir() string {
+	if d := strings.TrimSpace(os.Getenv("DATA_DIR")); d != "" {
+		return d
+	}
+	return "data"
+}
+
+// leadStore lo arma NewApp, después de cargar el .env (DATA_DIR): lo usa la action save_lead.
+var leadStore *LeadStore
+
+func (s *LeadStore) path(tenant string) string {
+	return filepath.Join(s.dir, tenant, "leads.jsonl")
+}
+
+func (s *LeadStore) Save(lead Lead) error {
+	b, err := json.Marshal(lead)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p := s.path(lead.Tenant)
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		return fmt.Errorf("no se pudo crear %s: %w", filepath.Dir(p), err)
+	}
+	f, err := os.OpenFile(p, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return fmt.Errorf("no se pudo abrir %s: %w", p, err)
+	}
+	defer f.Close()
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		return fmt.Errorf("no se pudo escribir %s: %w", p, err)
+	}
+	return nil
+}
+
+// List devuelve los leads del tenant (más viejos primero), opcionalmente desde una fecha.
+func (s *LeadStore) List(tenant string, since time.Time) ([]Lead, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f, err := os.Open(s.path(tenant))
+	if os.IsNotExist(err) {
+		return []Lead{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	leads := []Lead{}
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for line := 1; sc.Scan(); line++ {
+		if strings.TrimSpace(sc.Text()) == "" {
+			continue
+		}
+		var l Lead
+		if err := json.Unmarshal(sc.Bytes(), &l); err != nil {
+			log.Printf("⚠️ leads %s línea %d inválida: %v", tenant, line, err)
+			continue
+		}
+		if !since.IsZero() && l.CreatedAt.Before(since) {
+			continue
+		}
+		leads = append(leads, l)
+	}
+	return leads, sc.Err()
+}
+
+// writeLeadsCSV exporta los leads con columnas fijas + una columna por cada field/atribución que aparezca.
+func writeLeadsCSV(w io.Writer, leads []Lead) error {
+	fieldSet := map[string]bool{}
+	attrSet := map[string]bool{}
+	for _, l := range leads {
+		for k := range l.Fields {
+			fieldSet[k] = true
+		}
+		for k := range l.Attribution {
+			attrSet[k] = true
+		}
+	}
+	fields := sortedKeys(fieldSet)
+	attrs := sortedKeys(attrSet)
+
+	cw := csv.NewWriter(w)
+	header := []string{"id", "created_at", "started_at", "wa_id", "name", "product_line", "contact_pref"}
+	header = append(header, fields...)
+	header = append(header, attrs...)
+	if err := cw.Write(header); err != nil {
+		return err
+	}
+	for _, l := range leads {
+		row := []string{
+			l.ID,
+			l.CreatedAt.Format(time.RFC3339),
+			l.StartedAt.Format(time.RFC3339),
+			l.WaID,
+			l.Name,
+			l.ProductLine,
+			l.ContactPref,
+		}
+		for _, k := range fields {
+			row = append(row, l.Fields[k])
+		}
+		for _, k := range attrs {
+			row = append(row, l.Attribution[k])
+		}
+		for i := range row {
+			row[i] = csvSafe(row[i])
+		}
+		if err := cw.Write(row); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// csvSafe neutraliza fórmulas: lo que escribe el usuario ("=HYPERLINK(...)") no se ejecuta al abrir el CSV en Excel/Sheets.
+func csvSafe(v string) string {
+	if v != "" && strings.ContainsRune("=+-@\t\r", rune(v[0])) {
+		return "'" + v
+	}
+	return v
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// actionSaveLead registra el lead con lo capturado en la sesión (save_as) y la atribución.
+// Después limpia los inputs para que una segunda consulta ("otro servicio") arranque de cero.
+// Vars: lead_id
+func actionSaveLead(tenant, userID string, session *UserSession) (map[string]string, error) {
+	now := time.Now()
+	lead := Lead{
+		// El sufijo aleatorio evita colisiones entre dos leads del mismo número en el mismo segundo
+		ID:          fmt.Sprintf("L-%s-%s-%s", now.Format("20060102150405"), lastDigits(userID, 4), randomToken()[:6]),
+		Tenant:      tenant,
+		WaID:        userID,
+		Name:        session.Data["name"],
+		ProductLine: session.Inputs["product_line"],
+		ContactPref: session.Inputs["contact_pref"],
+		Fields:      map[string]string{},
+		Attribution: map[string]string{},
+		StartedAt:   session.StartedAt,
+		CreatedAt:   now,
+	}
+	for k, v := range session.Inputs {
+		if k == "product_line" || k == "contact_pref" {
+			continue
+		}
+		lead.Fields[k] = v
+	}
+	for k, v := range session.Data {
+		if strings.HasPrefix(k, "ref_") {
+			lead.Attribution[k] = v
+		}
+	}
+
+	if err := leadStore.Save(lead); err != nil {
+		return nil, err
+	}
+	log.Printf("🧲 Lead %s guardado (tenant=%s producto=%q contacto=%q)", lead.ID, tenant, lead.ProductLine, lead.ContactPref)
+
+	session.Inputs = nil
+	return map[string]string{"lead_id": lead.ID}, nil
+}
+
+func lastDigits(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[len(s)-n:]
+}
+
+// GET /admin/leads?tenant=broker[&format=csv|json][&since=2026-01-02] -> leads registrados del tenant
+func (a *App) handleAdminLeads(w http.ResponseWriter, r *http.Request) {
+	if !a.requireAdmin(w, r) {
+		return
+	}
+	q := r.URL.Query()
+	tenant := q.Get("tenant")
+	if tenant == "" {
+		http.Error(w, "falta tenant", http.StatusBadRequest)
+		return
+	}
+	if strings.ContainsAny(tenant, `/\.`) {
+		http.Error(w, "tenant inválido", http.StatusBadRequest)
+		return
+	}
+	var since time.Time
+	if s := q.Get("since"); s != "" {
+		t, err := time.ParseInLocation("2006-01-02", s, tenantLocation(tenant))
+		if err != nil {
+			http.Error(w, "since inválido (YYYY-MM-DD)", http.StatusBadRequest)
+			return
+		}
+		since = t
+	}
+
+	leads, err := a.leads.List(tenant, since)
+	if err != nil {
+		log.Printf("ERROR leyendo leads %s: %v", tenant, err)
+		http.Error(w, "error leyendo leads", http.StatusInternalServerError)
+		return
+	}
+
+	switch q.Get("format") {
+	case "", "json":
+		writeJSON(w, leads)
+	case "csv":
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", tenant+"-leads.csv"))
+		if err := writeLeadsCSV(w, leads); err != nil {
+			log.Printf("ERROR exportando leads %s: %v", tenant, err)
+		}
+	default:
+		http.Error(w, "format inválido (json|csv)", http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+)
+
+func TestAdminLeadsRejectsTraversal(t *testing.T) {
+	a := &App{adminToken: "admin"}
+	for _, tenant := range []string{"..", "../broker", "broker/x"} {
+		r := httptest.NewRequest(http.MethodGet, "/admin/leads?tenant="+tenant, nil)
+		r.Header.Set("Authorization", "Bearer admin")
+		w := httptest.NewRecorder()
+		a.handleAdminLeads(w, r)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("tenant %q: status %d", tenant, w.Code)
+		}
+	}
+}
+
+func TestWriteLeadsCSVNeutralizesFormulas(t *testing.T) {
+	leads := []Lead{{
+		ID:     "L-1",
+		Name:   "=HYPERLINK(\"http://evil\",\"x\")",
+		Fields: map[string]string{"a": "+54 11 5555", "b": "-1", "c": "@SUM(A1)", "d": "Juan Pérez", "e": ""},
+	}}
+	var buf bytes.Buffer
+	if err := writeLeadsCSV(&buf, leads); err != nil {
+		t.Fatal(err)
+	}
+	rows, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := rows[1]
+	tests := []struct{ col, want string }{
+		{"name", `'=HYPERLINK("http://evil","x")`},
+		{"a", "'+54 11 5555"},
+		{"b", "'-1"},
+		{"c", "'@SUM(A1)"},
+		{"d", "Juan Pérez"},
+		{"e", ""},
+	}
+	for _, tt := range tests {
+		i := slices.Index(rows[0], tt.col)
+		if i < 0 {
+			t.Fatalf("falta la columna %s: %v", tt.col, rows[0])
+		}
+		if got[i] != tt.want {
+			t.Errorf("columna %s = %q, esperaba %q", tt.col, got[i], tt.want)
+		}
+	}
+}
+
+func TestSaveLeadIDsAreUnique(t *testing.T) {
+	old := leadStore
+	leadStore = NewLeadStore(t.TempDir())
+	t.Cleanup(func() { leadStore = old })
+
+	seen := map[string]bool{}
+	for i := 0; i < 20; i++ {
+		vars, err := actionSaveLead("broker", "5491155551234", &UserSession{Data: map[string]string{}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if seen[vars["lead_id"]] {
+			t.Fatalf("lead_id repetido: %s", vars["lead_id"])
+		}
+		seen[vars["lead_id"]] = true
+	}
+}
@@ -2,6 +2,9 @@ package main
 
 import (
 	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -13,6 +16,7 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -31,10 +35,19 @@ ENV:
 
 VERIFY_TOKEN=brokerbot_verify
 WHATSAPP_TOKEN=EAAM...
+# Opcional: token propio por número (System User token de otra WABA)
+WHATSAPP_TOKEN_1041740029016016=EAAM...
 
-# Mapeo tenant (por phone_number_id)
+# Mapeo tenant (por phone_number_id). Preferir configs/tenants.json (números, tokens,
+# app_secret, timezone, horarios); esta variable se usa solo si ese archivo no existe.
 TENANT_BY_PHONE_NUMBER_ID=1041740029016016:broker
+# Opcional: catch-all para phone_number_id desconocidos (sin esto se descartan)
 DEFAULT_TENANT=broker
+# Fuerza el descarte de desconocidos aunque haya catch-all (recomendado en prod)
+TENANT_STRICT=true
+
+# Firma de webhooks (X-Hub-Signature-256) si el tenant no define app_secret
+WHATSAPP_APP_SECRET=...
 
 # SOLO PARA DEV/PRUEBAS: fuerza a quién le respondés
 WHATSAPP_FORCE_TO=+54111558492828
@@ -42,6 +55,24 @@ WHATSAPP_FORCE_TO=+54111558492828
 # Ambiente y puerto
 APP_ENV=dev
 PORT=8080
+
+# Hot reload de configs/{tenant} (flow.json, calendar.json). "0" lo deshabilita.
+CONFIG_RELOAD_INTERVAL=10s
+
+# Endpoints /admin/* (Authorization: Bearer ...). Sin token quedan deshabilitados.
+ADMIN_TOKEN=...
+
+# Tokens de asesores para /inbox y /api/inbox (referenciados en tenants.json -> agents)
+INBOX_TOKEN_BROKER=...
+
+# Contraseña SMTP de las notificaciones por email (tenants.json -> smtp.password)
+SMTP_PASSWORD_BROKER=...
+
+# Carpeta de datos generados (leads.jsonl, claims.json y transcripts/{wa_id}.jsonl por tenant). Default "data".
+DATA_DIR=/data
+
+# Opcional: webhook (Slack/Discord) para alertas a operadores
+OPERATOR_ALERT_URL=https://hooks.slack.com/...
 */
 
 // ---------------------
@@ -78,6 +109,21 @@ func renderVars(s string, vars map[string]string) string {
 	return s
 }
 
+// renderURLVars es renderVars para URLs: lo que está antes del "?" se reemplaza tal cual
+// (permite {{portal_url}} como base), y los valores dentro del query string se escapan.
+func renderURLVars(s string, vars map[string]string) string {
+	base, query, hasQuery := strings.Cut(s, "?")
+	base = renderVars(base, vars)
+	if !hasQuery {
+		return base
+	}
+	escaped := make(map[string]string, len(vars))
+	for k, v := range vars {
+		escaped[k] = url.QueryEscape(v)
+	}
+	return base + "?" + renderVars(query, escaped)
+}
+
 // ---------------------
 // HTTP Public Url
 // ---------------------
@@ -126,6 +172,7 @@ type WebhookPayload struct {
 					WaID string `json:"wa_id"`
 				} `json:"contacts"`
 				Messages []IncomingMessage `json:"messages"`
+				Statuses []MessageStatus   `json:"statuses"`
 			} `json:"value"`
 		} `json:"changes"`
 	} `json:"entry"`
@@ -153,6 +200,65 @@ type IncomingMessage struct {
 			Description string `json:"description"`
 		} `json:"list_reply,omitempty"`
 	} `json:"interactive,omitempty"`
+
+	Location *struct {
+		Latitude  float64 `json:"latitude"`
+		Longitude float64 `json:"longitude"`
+		Name      string  `json:"name"`
+		Address   string  `json:"address"`
+		URL       string  `json:"url"`
+	} `json:"location,omitempty"`
+
+	// Click-to-WhatsApp: viene en el primer mensaje después de tocar un anuncio
+	Referral *MessageReferral `json:"referral,omitempty"`
+
+	// Adjuntos (type image / document / video): Meta manda el media ID, el archivo se baja aparte
+	Image    *MediaRef `json:"image,omitempty"`
+	Document *MediaRef `json:"document,omitempty"`
+	Video    *MediaRef `json:"video,omitempty"`
+}
+
+// MediaRef es un adjunto recibido. Type y ReceivedAt los completamos nosotros.
+type MediaRef struct {
+	ID         string    `json:"id"`
+	MimeType   string    `json:"mime_type"`
+	SHA256     string    `json:"sha256,omitempty"`
+	Caption    string    `json:"caption,omitempty"`
+	Filename   string    `json:"filename,omitempty"`
+	Type       string    `json:"type,omitempty"`
+	ReceivedAt time.Time `json:"received_at,omitempty"`
+}
+
+// media devuelve el adjunto del mensaje, si tiene.
+func (m IncomingMessage) media() (MediaRef, bool) {
+	var ref *MediaRef
+	switch m.Type {
+	case "image":
+		ref = m.Image
+	case "document":
+		ref = m.Document
+	case "video":
+		ref = m.Video
+	}
+	if ref == nil || ref.ID == "" {
+		return MediaRef{}, false
+	}
+	out := *ref
+	out.Type = m.Type
+	return out, true
+}
+
+type MessageReferral struct {
+	SourceURL    string `json:"source_url"`
+	SourceID     string `json:"source_id"`   // ad id / post id
+	SourceType   string `json:"source_type"` // "ad" | "post"
+	Headline     string `json:"headline"`
+	Body         string `json:"body"`
+	MediaType    string `json:"media_type"`
+	ImageURL     string `json:"image_url"`
+	VideoURL     string `json:"video_url"`
+	ThumbnailURL string `json:"thumbnail_url"`
+	CtwaClid     string `json:"ctwa_clid"`
 }
 
 // ---------------------
@@ -162,25 +268,102 @@ type IncomingMessage struct {
 type FlowConfig struct {
 	Version string               `json:"version"`
 	States  map[string]FlowState `json:"states"`
+
+	// Otros archivos cuyos states se suman a este flow (ver flow_includes.go)
+	Includes []FlowInclude `json:"includes,omitempty"`
+
+	// Estado inicial y de "volver al inicio" (por defecto MENU), y rutas de entrada
+	// alternativas según el contexto (ver entry_routing.go).
+	EntryState  string           `json:"entry_state,omitempty"`
+	EntryRoutes []FlowEntryRoute `json:"entry_routes,omitempty"`
+
+	// Qué hacer cuando Meta informa (status webhook) que un mensaje nuestro falló.
+	// OnSendFailed: estado al que se mueve la sesión (se usa en el próximo mensaje del usuario).
+	OnSendFailed       string `json:"on_send_failed,omitempty"`
+	AlertOnSendFailure bool   `json:"alert_on_send_failure,omitempty"`
+
+	// Feedback mientras corre la action de un estado (ej: consulta a Google Calendar).
+	// TypingIndicator implica también marcar como leído.
+	MarkAsRead      bool `json:"mark_as_read,omitempty"`
+	TypingIndicator bool `json:"typing_indicator,omitempty"`
+
+	// Límite de envíos salientes del número del tenant (ver rate_limiter.go).
+	RateLimit *RateLimitConfig `json:"rate_limit,omitempty"`
+
+	// Hot reload: estados renombrados/eliminados -> estado donde continúan las sesiones
+	// que estaban parados ahí. Si un estado desaparece sin migración, la sesión vuelve al de entrada.
+	StateMigrations map[string]string `json:"state_migrations,omitempty"`
+
+	// Handoff: tiempo sin actividad del asesor tras el cual vuelve el bot (default 24h).
+	HandoffTimeout string `json:"handoff_timeout,omitempty"`
+
+	// Template aprobado para avisar cambios de estado de siniestros (ver claims.go).
+	// Body: {{1}} nombre, {{2}} número, {{3}} estado, {{4}} nota.
+	ClaimStatusTemplate *FlowTemplate `json:"claim_status_template,omitempty"`
+
+	// hash del contenido de flow.json + includes, y paths de los includes (se completan al cargar)
+	hash    string
+	sources []string
+}
+
+// Entry devuelve el estado de entrada del flow.
+func (c FlowConfig) Entry() string {
+	if e := strings.TrimSpace(c.EntryState); e != "" {
+		return e
+	}
+	return "MENU"
+}
+
+// VersionKey identifica la versión del flow: "version" del JSON + hash del contenido,
+// así dos ediciones sin bump de version igual se distinguen.
+func (c FlowConfig) VersionKey() string {
+	v := strings.TrimSpace(c.Version)
+	if v == "" {
+		v = "sin-version"
+	}
+	if len(c.hash) >= 8 {
+		return v + "@" + c.hash[:8]
+	}
+	return v
 }
 
 type FlowState struct {
-	Type string `json:"type"` // "text" | "interactive_list" | "interactive_buttons"
+	Type string `json:"type"` // "text" | "interactive_list" | "interactive_buttons" | "interactive_cta_url" | "location_request" | "call"
 	Body string `json:"body"`
 
 	// Action: Nombre de la función a ejecutar en Go antes de renderizar (ej: "fetch_client_data", "check_calendar")
 	Action string `json:"action,omitempty"`
+	// ActionParams: se renderizan con las vars y quedan en sesión antes de correr la action
+	// (ej: "handoff_reason" para handoff).
+	ActionParams map[string]string `json:"action_params,omitempty"`
+	// HTTP: configuración de la action "http" (endpoint externo, ver http_action.go)
+	HTTP *FlowHTTPRequest `json:"http,omitempty"`
+	// OnErrorNext: estado al que se pasa si la action falla (si no, se renderiza el estado igual)
+	OnErrorNext string `json:"on_error_next,omitempty"`
 
 	// Optional header media for interactive messages (e.g. image header)
 	HeaderMedia *FlowHeaderMedia `json:"header_media,omitempty"`
 
-	// List / Buttons UI
+	// List / Buttons / CTA URL UI
 	List    *FlowList    `json:"list,omitempty"`
 	Buttons *FlowButtons `json:"buttons,omitempty"`
+	CTA     *FlowCTA     `json:"cta,omitempty"`
 
 	// Transiciones
-	OnTextNext   string            `json:"on_text_next,omitempty"`
-	OnSelectNext map[string]string `json:"on_select_next,omitempty"` // row_id -> next_state
+	OnTextNext     string            `json:"on_text_next,omitempty"`
+	OnSelectNext   map[string]string `json:"on_select_next,omitempty"`   // row_id -> next_state
+	OnLocationNext string            `json:"on_location_next,omitempty"` // ubicación recibida (lat/lng/address en sesión)
+	OnMediaNext    string            `json:"on_media_next,omitempty"`    // imagen/documento/video recibido (queda en UserSession.PendingMedia)
+
+	// Sub-flow: solo para type "call" (no se renderiza, salta a Call.State)
+	Call *FlowCall `json:"call,omitempty"`
+
+	// Redirects: al entrar al estado, si una var cumple la condición se salta a otro (ver flow_includes.go)
+	Redirects []FlowRedirect `json:"redirects,omitempty"`
+
+	// SaveAs: guarda la respuesta del usuario a este estado (texto, o título de la opción elegida)
+	// en UserSession.Inputs y como var {{save_as}}. Lo usa save_lead para armar el lead.
+	SaveAs string `json:"save_as,omitempty"`
 }
 
 type FlowList struct {
@@ -212,6 +395,21 @@ type FlowButton struct {
 	Title string `json:"title"`
 }
 
+// FlowCTA describe un mensaje interactive "cta_url": un botón que abre una URL.
+// La URL admite {{vars}}; las que van en el query string se escapan (ej: ?poliza={{policy_number}}).
+type FlowCTA struct {
+	Header      string `json:"header"`
+	Footer      string `json:"footer"`
+	DisplayText string `json:"display_text"`
+	URL         string `json:"url"`
+}
+
+// FlowTemplate referencia un template de WhatsApp aprobado. Language vacío = locale del tenant.
+type FlowTemplate struct {
+	Name     string `json:"name"`
+	Language string `json:"language,omitempty"`
+}
+
 type FlowHeaderMedia struct {
 	Type string `json:"type"`           // "image" (extendible)
 	Path string `json:"path,omitempty"` // local: relative to configs/{tenant}/assets/
@@ -225,10 +423,29 @@ type FlowHeaderMedia struct {
 type UserSession struct {
 	State     string
 	UpdatedAt time.Time
+	// Versión del flow (FlowConfig.VersionKey) con la que viene conversando el usuario.
+	// Se mantiene hasta que vuelve al estado de entrada.
+	FlowVersion string
+	// Estados a los que vuelve cada sub-flow en curso ("$return"), el último es el más reciente.
+	CallStack []string
+	// Inicio de la conversación (primer mensaje de esta sesión).
+	StartedAt time.Time
+	// Respuestas capturadas con save_as (campo -> valor).
+	Inputs map[string]string
+	// Adjuntos recibidos que todavía no se asociaron a nada (ej: fotos de un siniestro, ver claims.go).
+	PendingMedia []MediaRef
+	// Número del negocio por el que conversa (para que un asesor responda por el mismo).
+	PhoneID string
+	// Mode: ModeBot o ModeHandoff (derivada a un asesor; HandoffAt = última actividad del asesor, ver handoff.go).
+	Mode      string
+	HandoffAt time.Time
 	// Agregamos un mapa de datos para guardar info del CRM, selecciones del usuario, etc.
 	Data map[string]string
 }
 
+// Máximo de adjuntos pendientes por sesión (se descartan los más viejos).
+const maxPendingMedia = 20
+
 type SessionStore struct {
 	mu   sync.RWMutex
 	data map[string]UserSession
@@ -245,23 +462,55 @@ func (s *SessionStore) Get(key string) (UserSession, bool) {
 	return v, ok
 }
 
+func (s *SessionStore) Delete(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.data, key)
+}
+
 func (s *SessionStore) Set(key string, sess UserSession) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	s.data[key] = sess
 }
 
+// CountByFlowVersion devuelve cuántas sesiones hay en cada versión de flow, por tenant.
+func (s *SessionStore) CountByFlowVersion() map[string]map[string]int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	out := make(map[string]map[string]int)
+	for key, sess := range s.data {
+		tenant, _, _ := strings.Cut(key, ":")
+		if out[tenant] == nil {
+			out[tenant] = make(map[string]int)
+		}
+		out[tenant][sess.FlowVersion]++
+	}
+	return out
+}
+
 // ---------------------
 // Config cache
 // ---------------------
 
+// Cuántas versiones viejas de un flow mantenemos en memoria para sesiones en curso.
+const maxFlowVersions = 10
+
 type ConfigCache struct {
 	mu    sync.RWMutex
-	cache map[string]FlowConfig
+	cache map[string]FlowConfig // versión vigente
+
+	// Versiones cargadas por tenant (VersionKey -> config), para sesiones pineadas.
+	versions     map[string]map[string]FlowConfig
+	versionOrder map[string][]string
 }
 
 func NewConfigCache() *ConfigCache {
-	return &ConfigCache{cache: make(map[string]FlowConfig)}
+	return &ConfigCache{
+		cache:        make(map[string]FlowConfig),
+		versions:     make(map[string]map[string]FlowConfig),
+		versionOrder: make(map[string][]string),
+	}
 }
 
 func (c *ConfigCache) Get(tenant string) (FlowConfig, bool) {
@@ -275,6 +524,49 @@ func (c *ConfigCache) Set(tenant string, cfg FlowConfig) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 	c.cache[tenant] = cfg
+
+	key := cfg.VersionKey()
+	if c.versions[tenant] == nil {
+		c.versions[tenant] = make(map[string]FlowConfig)
+	}
+	if _, ok := c.versions[tenant][key]; !ok {
+		c.versionOrder[tenant] = append(c.versionOrder[tenant], key)
+	}
+	c.versions[tenant][key] = cfg
+
+	// Descartamos las versiones más viejas (las sesiones pineadas ahí pasan a la vigente)
+	for len(c.versionOrder[tenant]) > maxFlowVersions {
+		oldest := c.versionOrder[tenant][0]
+		c.versionOrder[tenant] = c.versionOrder[tenant][1:]
+		delete(c.versions[tenant], oldest)
+	}
+}
+
+// GetVersion devuelve una versión puntual del flow si sigue en memoria.
+func (c *ConfigCache) GetVersion(tenant, versionKey string) (FlowConfig, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	cfg, ok := c.versions[tenant][versionKey]
+	return cfg, ok
+}
+
+type FlowVersions struct {
+	Current string   `json:"current"`
+	Loaded  []string `json:"loaded"` // de la más vieja a la más nueva
+}
+
+// Versions devuelve, por tenant, la versión vigente y las que siguen en memoria.
+func (c *ConfigCache) Versions() map[string]FlowVersions {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	out := make(map[string]FlowVersions, len(c.cache))
+	for tenant, cfg := range c.cache {
+		out[tenant] = FlowVersions{
+			Current: cfg.VersionKey(),
+			Loaded:  append([]string(nil), c.versionOrder[tenant]...),
+		}
+	}
+	return out
 }
 
 func loadFlowConfig(tenant string) (FlowConfig, error) {
@@ -290,9 +582,16 @@ func loadFlowConfig(tenant string) (FlowConfig, error) {
 	if len(cfg.States) == 0 {
 		return FlowConfig{}, fmt.Errorf("flow.json de %s no tiene states", tenant)
 	}
+	sources, included, err := expandIncludes(tenant, &cfg)
+	if err != nil {
+		return FlowConfig{}, fmt.Errorf("flow.json de %s: %w", tenant, err)
+	}
 	if err := validateFlowConfig(tenant, cfg); err != nil {
 		return FlowConfig{}, err
 	}
+	sum := sha256.Sum256(append(b, included...))
+	cfg.hash = hex.EncodeToString(sum[:])
+	cfg.sources = sources
 	return cfg, nil
 }
 
@@ -307,6 +606,36 @@ func validateFlowConfig(tenant string, cfg FlowConfig) error {
 
 	for stateName, st := range cfg.States {
 
+		// -------------------------
+		// transiciones: todo destino tiene que existir
+		// -------------------------
+		for _, target := range transitionTargets(st) {
+			if target == ReturnTarget {
+				continue
+			}
+			if _, ok := cfg.States[target]; !ok {
+				errs = append(errs, fmt.Sprintf("state=%s transiciona a un estado inexistente: %s", stateName, target))
+			}
+		}
+
+		for i, r := range st.Redirects {
+			if strings.TrimSpace(r.Var) == "" {
+				errs = append(errs, fmt.Sprintf("state=%s redirects[%d] sin var", stateName, i))
+			}
+		}
+		errs = append(errs, validateHTTPAction(stateName, st)...)
+		errs = append(errs, validateNotifyEmail(tenant, stateName, st)...)
+
+		// -------------------------
+		// call (sub-flow)
+		// -------------------------
+		if st.Type == "call" {
+			if st.Call == nil || strings.TrimSpace(st.Call.State) == "" {
+				errs = append(errs, fmt.Sprintf("state=%s es call pero no define call.state", stateName))
+			}
+			continue
+		}
+
 		// -------------------------
 		// header_media validation (interactive only)
 		// -------------------------
@@ -402,52 +731,98 @@ func validateFlowConfig(tenant string, cfg FlowConfig) error {
 			continue
 		}
 
-		// Para otros tipos ("text"), no validamos UI acá.
-	}
+		// -------------------------
+		// interactive_cta_url
+		// -------------------------
+		if st.Type == "interactive_cta_url" {
+			if st.CTA == nil {
+				errs = append(errs, fmt.Sprintf("state=%s es interactive_cta_url pero cta es nil", stateName))
+				continue
+			}
+			c := st.CTA
 
-	if len(errs) > 0 {
-		return fmt.Errorf("flow inválido tenant=%s:\n- %s", tenant, strings.Join(errs, "\n- "))
-	}
-	return nil
-}
+			if runeLen(c.Header) > 60 {
+				errs = append(errs, fmt.Sprintf("state=%s cta.header > 60 (%d): %q", stateName, runeLen(c.Header), c.Header))
+			}
+			if runeLen(c.Footer) > 60 {
+				errs = append(errs, fmt.Sprintf("state=%s cta.footer > 60 (%d): %q", stateName, runeLen(c.Footer), c.Footer))
+			}
+			if strings.TrimSpace(c.DisplayText) == "" {
+				errs = append(errs, fmt.Sprintf("state=%s cta.display_text vacío", stateName))
+			} else if runeLen(c.DisplayText) > 20 {
+				errs = append(errs, fmt.Sprintf("state=%s cta.display_text > 20 (%d): %q", stateName, runeLen(c.DisplayText), c.DisplayText))
+			}
 
-// ---------------------
-// Tenant resolver
-// ---------------------
+			rawURL := strings.TrimSpace(c.URL)
+			if rawURL == "" {
+				errs = append(errs, fmt.Sprintf("state=%s cta.url vacío", stateName))
+			} else if !strings.HasPrefix(rawURL, "{{") && !strings.HasPrefix(rawURL, "https://") && !strings.HasPrefix(rawURL, "http://") {
+				errs = append(errs, fmt.Sprintf("state=%s cta.url debe ser absoluta (http/https): %q", stateName, c.URL))
+			}
 
-type TenantResolver struct {
-	byPhoneNumberID map[string]string
-	defaultTenant   string
-}
+			continue
+		}
 
-func NewTenantResolver() *TenantResolver {
-	m := map[string]string{}
-	raw := os.Getenv("TENANT_BY_PHONE_NUMBER_ID")
-	if raw != "" {
-		for _, p := range strings.Split(raw, ",") {
-			p = strings.TrimSpace(p)
-			if p == "" {
-				continue
+		// -------------------------
+		// location_request
+		// -------------------------
+		if st.Type == "location_request" {
+			if strings.TrimSpace(st.Body) == "" {
+				errs = append(errs, fmt.Sprintf("state=%s es location_request pero body está vacío", stateName))
 			}
-			kv := strings.SplitN(p, ":", 2)
-			if len(kv) != 2 {
-				continue
+			if st.OnLocationNext == "" {
+				errs = append(errs, fmt.Sprintf("state=%s es location_request pero no tiene on_location_next", stateName))
 			}
-			m[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+			continue
 		}
+
+		// Para otros tipos ("text"), no validamos UI acá.
+	}
+
+	if cfg.RateLimit != nil && (cfg.RateLimit.MessagesPerSecond < 0 || cfg.RateLimit.Burst < 0) {
+		errs = append(errs, "rate_limit no puede tener valores negativos")
 	}
-	def := os.Getenv("DEFAULT_TENANT")
-	if def == "" {
-		def = "broker"
+	if cfg.ClaimStatusTemplate != nil && strings.TrimSpace(cfg.ClaimStatusTemplate.Name) == "" {
+		errs = append(errs, "claim_status_template.name vacío")
+	}
+	if cfg.HandoffTimeout != "" {
+		if d, err := time.ParseDuration(cfg.HandoffTimeout); err != nil || d <= 0 {
+			errs = append(errs, fmt.Sprintf("handoff_timeout inválido: %q (ej: \"2h\", \"30m\")", cfg.HandoffTimeout))
+		}
 	}
-	return &TenantResolver{byPhoneNumberID: m, defaultTenant: def}
-}
 
-func (r *TenantResolver) Resolve(phoneNumberID string) string {
-	if t, ok := r.byPhoneNumberID[phoneNumberID]; ok && t != "" {
-		return t
+	if _, ok := cfg.States[cfg.Entry()]; !ok {
+		if cfg.EntryState == "" {
+			errs = append(errs, "no existe el estado MENU: definí entry_state")
+		} else {
+			errs = append(errs, fmt.Sprintf("entry_state apunta a un estado inexistente: %s", cfg.EntryState))
+		}
+	}
+	for i, r := range cfg.EntryRoutes {
+		if !r.hasMatcher() {
+			errs = append(errs, fmt.Sprintf("entry_routes[%d] no tiene criterio (ref/keyword/ad_id/source_*)", i))
+		}
+		if _, ok := cfg.States[r.State]; !ok {
+			errs = append(errs, fmt.Sprintf("entry_routes[%d] apunta a un estado inexistente: %s", i, r.State))
+		}
+	}
+
+	for from, to := range cfg.StateMigrations {
+		if _, ok := cfg.States[to]; !ok {
+			errs = append(errs, fmt.Sprintf("state_migrations %s -> %s: el destino no existe", from, to))
+		}
+	}
+
+	if cfg.OnSendFailed != "" {
+		if _, ok := cfg.States[cfg.OnSendFailed]; !ok {
+			errs = append(errs, fmt.Sprintf("on_send_failed apunta a un estado inexistente: %s", cfg.OnSendFailed))
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("flow inválido tenant=%s:\n- %s", tenant, strings.Join(errs, "\n- "))
 	}
-	return r.defaultTenant
+	return nil
 }
 
 // ---------------------
@@ -484,15 +859,41 @@ type WhatsAppClient struct {
 	token      string
 	phoneID    string
 	apiBaseURL string
+	graphURL   string // https://graph.facebook.com/{version} (media)
 	forceTo    string
+	httpClient *http.Client
+	limiter    *RateLimiter
 }
 
-func NewWhatsAppClient(phoneNumberID string) (*WhatsAppClient, error) {
-	token := os.Getenv("WHATSAPP_TOKEN")
-	if token == "" {
-		return nil, errors.New("WHATSAPP_TOKEN no seteado")
+func NewWhatsAppClient(phoneNumberID, token, forceTo string) *WhatsAppClient {
+	return &WhatsAppClient{
+		token:      token,
+		phoneID:    phoneNumberID,
+		apiBaseURL: fmt.Sprintf("https://graph.facebook.com/%s/%s/messages", apiVersion, phoneNumberID),
+		graphURL:   fmt.Sprintf("https://graph.facebook.com/%s", apiVersion),
+		forceTo:    forceTo,
+		httpClient: newGraphHTTPClient(),
+		limiter:    NewRateLimiter(defaultMessagesPerSecond, defaultBurst),
 	}
+}
+
+// ---------------------
+// WhatsApp client registry (uno por phone_number_id)
+// ---------------------
+
+// WhatsAppClients mantiene un WhatsAppClient por número, con su propio token
+// (System User token de la WABA), pool de conexiones y rate limiter.
+type WhatsAppClients struct {
+	mu       sync.Mutex
+	clients  map[string]*WhatsAppClient
+	forceTo  string
+	resolver *TenantResolver
+
+	// rateLimit devuelve el rate_limit del flow vigente del tenant (lo setea NewApp).
+	rateLimit func(tenant string) (*RateLimitConfig, bool)
+}
 
+func NewWhatsAppClients(resolver *TenantResolver) *WhatsAppClients {
 	env := strings.TrimSpace(os.Getenv("APP_ENV"))
 	if env == "" {
 		env = "dev"
@@ -501,16 +902,74 @@ func NewWhatsAppClient(phoneNumberID string) (*WhatsAppClient, error) {
 	if env != "dev" {
 		force = ""
 	}
+	return &WhatsAppClients{
+		clients:  make(map[string]*WhatsAppClient),
+		forceTo:  force,
+		resolver: resolver,
+	}
+}
 
-	return &WhatsAppClient{
-		token:      token,
-		phoneID:    phoneNumberID,
-		apiBaseURL: fmt.Sprintf("https://graph.facebook.com/%s/%s/messages", apiVersion, phoneNumberID),
-		forceTo:    force,
-	}, nil
+// tokenForPhone: access_token del tenant (tenants.json), si no WHATSAPP_TOKEN_{phone_number_id},
+// y por último WHATSAPP_TOKEN.
+func (r *WhatsAppClients) tokenForPhone(phoneNumberID string) string {
+	if t := r.resolver.AccessToken(phoneNumberID); t != "" {
+		return t
+	}
+	if t := strings.TrimSpace(os.Getenv("WHATSAPP_TOKEN_" + phoneNumberID)); t != "" {
+		return t
+	}
+	return strings.TrimSpace(os.Getenv("WHATSAPP_TOKEN"))
+}
+
+// Get devuelve el cliente del número con el rate_limit del flow del tenant aplicado: así vale
+// para todo lo que sale por ese número (webhook, inbox, avisos de siniestros) desde el primer
+// envío, y toma los cambios del hot reload.
+func (r *WhatsAppClients) Get(phoneNumberID string) (*WhatsAppClient, error) {
+	c, err := r.get(phoneNumberID)
+	if err != nil {
+		return nil, err
+	}
+	if tenant := r.resolver.tenantFor(phoneNumberID); tenant != "" && r.rateLimit != nil {
+		if cfg, ok := r.rateLimit(tenant); ok {
+			c.limiter.Configure(cfg)
+		}
+	}
+	return c, nil
+}
+
+func (r *WhatsAppClients) get(phoneNumberID string) (*WhatsAppClient, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if c, ok := r.clients[phoneNumberID]; ok {
+		return c, nil
+	}
+	if strings.TrimSpace(phoneNumberID) == "" {
+		return nil, errors.New("phone_number_id vacío")
+	}
+	token := r.tokenForPhone(phoneNumberID)
+	if token == "" {
+		return nil, fmt.Errorf("no hay token para phone_number_id=%s (WHATSAPP_TOKEN_%s o WHATSAPP_TOKEN)", phoneNumberID, phoneNumberID)
+	}
+
+	c := NewWhatsAppClient(phoneNumberID, token, r.forceTo)
+	r.clients[phoneNumberID] = c
+	log.Printf("📱 WhatsApp client creado para phone_number_id=%s", phoneNumberID)
+	return c, nil
+}
+
+// RateLimiterStats devuelve el estado del limiter de cada número.
+func (r *WhatsAppClients) RateLimiterStats() map[string]RateLimiterStats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	out := make(map[string]RateLimiterStats, len(r.clients))
+	for id, c := range r.clients {
+		out[id] = c.limiter.Stats()
+	}
+	return out
 }
 
-func (c *WhatsAppClient) sendText(to string, body string) error {
+func (c *WhatsAppClient) sendText(to string, body string) (string, error) {
 	toOriginal := to
 	if c.forceTo != "" {
 		log.Printf("⚠️ WHATSAPP_FORCE_TO activo: to_original=%s to_forzado=%s", toOriginal, c.forceTo)
@@ -528,7 +987,33 @@ func (c *WhatsAppClient) sendText(to string, body string) error {
 	return c.post(payload)
 }
 
-func (c *WhatsAppClient) sendList(to string, headerText, headerImageURL, body, footer, buttonText string, sections []FlowSection) error {
+// sendMedia envía una imagen / documento / video / audio por link público.
+// caption no aplica a audio; filename solo a document.
+func (c *WhatsAppClient) sendMedia(to, mediaType, link, caption, filename string) (string, error) {
+	toOriginal := to
+	if c.forceTo != "" {
+		log.Printf("⚠️ WHATSAPP_FORCE_TO activo: to_original=%s to_forzado=%s", toOriginal, c.forceTo)
+		to = c.forceTo
+	}
+	to = normalizeRecipientForMeta(to)
+
+	media := map[string]any{"link": link}
+	if caption != "" && mediaType != "audio" {
+		media["caption"] = caption
+	}
+	if filename != "" && mediaType == "document" {
+		media["filename"] = filename
+	}
+	payload := map[string]any{
+		"messaging_product": "whatsapp",
+		"to":                to,
+		"type":              mediaType,
+		mediaType:           media,
+	}
+	return c.post(payload)
+}
+
+func (c *WhatsAppClient) sendList(to string, headerText, headerImageURL, body, footer, buttonText string, sections []FlowSection) (string, error) {
 	toOriginal := to
 	if c.forceTo != "" {
 		log.Printf("⚠️ WHATSAPP_FORCE_TO activo: to_original=%s to_forzado=%s", toOriginal, c.forceTo)
@@ -597,7 +1082,7 @@ func (c *WhatsAppClient) sendList(to string, headerText, headerImageURL, body, f
 	return c.post(payload)
 }
 
-func (c *WhatsAppClient) sendButtons(to string, headerText, headerImageURL, body, footer string, buttons []FlowButton) error {
+func (c *WhatsAppClient) sendButtons(to string, headerText, headerImageURL, body, footer string, buttons []FlowButton) (string, error) {
 	toOriginal := to
 	if c.forceTo != "" {
 		log.Printf("⚠️ WHATSAPP_FORCE_TO activo: to_original=%s to_forzado=%s", toOriginal, c.forceTo)
@@ -657,64 +1142,266 @@ func (c *WhatsAppClient) sendButtons(to string, headerText, headerImageURL, body
 	return c.post(payload)
 }
 
-func (c *WhatsAppClient) post(payload map[string]any) error {
-	b, _ := json.Marshal(payload)
-	req, err := http.NewRequest("POST", c.apiBaseURL, bytes.NewReader(b))
-	if err != nil {
-		return err
+func (c *WhatsAppClient) sendCTAURL(to string, headerText, headerImageURL, body, footer, displayText, ctaURL string) (string, error) {
+	toOriginal := to
+	if c.forceTo != "" {
+		log.Printf("⚠️ WHATSAPP_FORCE_TO activo: to_original=%s to_forzado=%s", toOriginal, c.forceTo)
+		to = c.forceTo
 	}
-	req.Header.Set("Authorization", "Bearer "+c.token)
-	req.Header.Set("Content-Type", "application/json")
 
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return err
-	}
-	defer resp.Body.Close()
-	body, _ := io.ReadAll(resp.Body)
+	to = normalizeRecipientForMeta(to)
 
-	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		return fmt.Errorf("respuesta no OK de Meta: %s - %s", resp.Status, string(body))
+	interactive := map[string]any{
+		"type": "cta_url",
+		"body": map[string]any{
+			"text": body,
+		},
+		"action": map[string]any{
+			"name": "cta_url",
+			"parameters": map[string]any{
+				"display_text": displayText,
+				"url":          ctaURL,
+			},
+		},
 	}
-	log.Printf("✅ Enviado OK: %s", string(body))
-	return nil
-}
-
-// ---------------------
-// Renderer
-// ---------------------
-
-type Renderer struct {
-	cache *ConfigCache
-}
 
-func NewRenderer(cache *ConfigCache) *Renderer {
-	return &Renderer{cache: cache}
-}
+	if strings.TrimSpace(headerImageURL) != "" {
+		interactive["header"] = map[string]any{
+			"type": "image",
+			"image": map[string]any{
+				"link": headerImageURL,
+			},
+		}
+	} else if strings.TrimSpace(headerText) != "" {
+		interactive["header"] = map[string]any{
+			"type": "text",
+			"text": headerText,
+		}
+	}
 
-func (r *Renderer) RenderAndSend(tenant string, stateName string, wa *WhatsAppClient, to string, vars map[string]string) error {
-	cfg, ok := r.cache.Get(tenant)
-	if !ok {
-		loaded, err := loadFlowConfig(tenant)
-		if err != nil {
-			return err
+	if strings.TrimSpace(footer) != "" {
+		interactive["footer"] = map[string]any{
+			"text": footer,
 		}
-		r.cache.Set(tenant, loaded)
-		cfg = loaded
 	}
 
-	st, ok := cfg.States[stateName]
-	if !ok {
-		return fmt.Errorf("estado no existe: %s", stateName)
+	payload := map[string]any{
+		"messaging_product": "whatsapp",
+		"to":                to,
+		"type":              "interactive",
+		"interactive":       interactive,
 	}
 
-	switch st.Type {
+	return c.post(payload)
+}
+
+func (c *WhatsAppClient) sendLocationRequest(to string, body string) (string, error) {
+	toOriginal := to
+	if c.forceTo != "" {
+		log.Printf("⚠️ WHATSAPP_FORCE_TO activo: to_original=%s to_forzado=%s", toOriginal, c.forceTo)
+		to = c.forceTo
+	}
+	to = normalizeRecipientForMeta(to)
+	payload := map[string]any{
+		"messaging_product": "whatsapp",
+		"recipient_type":    "individual",
+		"to":                to,
+		"type":              "interactive",
+		"interactive": map[string]any{
+			"type": "location_request_message",
+			"body": map[string]any{
+				"text": body,
+			},
+			"action": map[string]any{
+				"name": "send_location",
+			},
+		},
+	}
+	return c.post(payload)
+}
+
+// markAsRead marca el mensaje entrante como leído (doble tilde azul).
+// Con typing=true además muestra "escribiendo…" hasta que respondamos (o ~25s).
+func (c *WhatsAppClient) markAsRead(messageID string, typing bool) error {
+	payload := map[string]any{
+		"messaging_product": "whatsapp",
+		"status":            "read",
+		"message_id":        messageID,
+	}
+	if typing {
+		payload["typing_indicator"] = map[string]any{
+			"type": "text",
+		}
+	}
+	_, err := c.post(payload)
+	return err
+}
+
+// sendTemplate envía un template aprobado (para escribirle al usuario fuera de la ventana de 24h).
+// bodyParams completa las variables {{1}}, {{2}}... del cuerpo en orden.
+func (c *WhatsAppClient) sendTemplate(to, name, language string, bodyParams []string) (string, error) {
+	toOriginal := to
+	if c.forceTo != "" {
+		log.Printf("⚠️ WHATSAPP_FORCE_TO activo: to_original=%s to_forzado=%s", toOriginal, c.forceTo)
+		to = c.forceTo
+	}
+	to = normalizeRecipientForMeta(to)
+
+	template := map[string]any{
+		"name":     name,
+		"language": map[string]any{"code": language},
+	}
+	if len(bodyParams) > 0 {
+		params := make([]map[string]any, 0, len(bodyParams))
+		for _, p := range bodyParams {
+			params = append(params, map[string]any{"type": "text", "text": p})
+		}
+		template["components"] = []map[string]any{{"type": "body", "parameters": params}}
+	}
+	payload := map[string]any{
+		"messaging_product": "whatsapp",
+		"to":                to,
+		"type":              "template",
+		"template":          template,
+	}
+	return c.post(payload)
+}
+
+// downloadMedia baja un adjunto recibido: primero pide la URL temporal del media ID y
+// después el archivo (las dos llamadas van con el token del número).
+func (c *WhatsAppClient) downloadMedia(mediaID string) ([]byte, string, error) {
+	get := func(u string) ([]byte, string, error) {
+		req, err := http.NewRequest("GET", u, nil)
+		if err != nil {
+			return nil, "", err
+		}
+		req.Header.Set("Authorization", "Bearer "+c.token)
+		resp, err := c.httpClient.Do(req)
+		if err != nil {
+			return nil, "", err
+		}
+		defer resp.Body.Close()
+		// Uno de más para distinguir "justo el tope" de "truncado": un adjunto cortado se corrompe
+		body, err := io.ReadAll(io.LimitReader(resp.Body, maxMediaBytes+1))
+		if err != nil {
+			return nil, "", err
+		}
+		if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+			return nil, "", parseMetaError(resp.StatusCode, body)
+		}
+		if len(body) > maxMediaBytes {
+			return nil, "", fmt.Errorf("media %s supera %d bytes", mediaID, maxMediaBytes)
+		}
+		return body, resp.Header.Get("Content-Type"), nil
+	}
+
+	body, _, err := get(c.graphURL + "/" + url.PathEscape(mediaID))
+	if err != nil {
+		return nil, "", err
+	}
+	var info struct {
+		URL      string `json:"url"`
+		MimeType string `json:"mime_type"`
+	}
+	if err := json.Unmarshal(body, &info); err != nil || info.URL == "" {
+		return nil, "", fmt.Errorf("media %s: respuesta sin url", mediaID)
+	}
+	data, _, err := get(info.URL)
+	if err != nil {
+		return nil, "", err
+	}
+	return data, info.MimeType, nil
+}
+
+// Tope de descarga de adjuntos (Meta acepta hasta 100MB en documentos).
+const maxMediaBytes = 100 << 20
+
+// post envía el payload y devuelve el ID del mensaje (wamid) que asigna Meta,
+// para poder correlacionarlo después con los webhooks de statuses.
+// Reintenta con backoff los rate limits, 5xx y errores de red; el resto vuelve como *MetaAPIError.
+func (c *WhatsAppClient) post(payload map[string]any) (string, error) {
+	b, _ := json.Marshal(payload)
+
+	var lastErr error
+	for attempt := 0; attempt < graphMaxAttempts; attempt++ {
+		c.limiter.Wait()
+		msgID, retryAfter, err := c.postOnce(b)
+		if err == nil {
+			return msgID, nil
+		}
+		lastErr = err
+
+		var me *MetaAPIError
+		retryable := isRetryableNetErr(err) || (errors.As(err, &me) && me.Retryable())
+		if !retryable || attempt == graphMaxAttempts-1 {
+			break
+		}
+		delay, ok := backoffDelay(attempt, retryAfter)
+		if !ok {
+			log.Printf("⚠️ Meta pide esperar %ss (Retry-After): no se reintenta", retryAfter)
+			break
+		}
+		log.Printf("🔁 Reintentando envío a Meta (intento %d/%d) en %s: %v", attempt+2, graphMaxAttempts, delay.Round(time.Millisecond), err)
+		time.Sleep(delay)
+	}
+	return "", lastErr
+}
+
+func (c *WhatsAppClient) postOnce(payload []byte) (msgID string, retryAfter string, err error) {
+	req, err := http.NewRequest("POST", c.apiBaseURL, bytes.NewReader(payload))
+	if err != nil {
+		return "", "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return "", "", err
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return "", resp.Header.Get("Retry-After"), parseMetaError(resp.StatusCode, body)
+	}
+	log.Printf("✅ Enviado OK: %s", string(body))
+
+	var sent struct {
+		Messages []struct {
+			ID string `json:"id"`
+		} `json:"messages"`
+	}
+	if err := json.Unmarshal(body, &sent); err == nil && len(sent.Messages) > 0 {
+		return sent.Messages[0].ID, "", nil
+	}
+	return "", "", nil
+}
+
+// ---------------------
+// Renderer
+// ---------------------
+
+type Renderer struct{}
+
+func NewRenderer() *Renderer {
+	return &Renderer{}
+}
+
+// RenderAndSend renderiza el estado con la versión de flow de la sesión (cfg) y lo envía.
+func (r *Renderer) RenderAndSend(tenant string, cfg FlowConfig, stateName string, wa *WhatsAppClient, to string, vars map[string]string) (string, error) {
+	st, ok := cfg.States[stateName]
+	if !ok {
+		return "", fmt.Errorf("estado no existe: %s", stateName)
+	}
+
+	switch st.Type {
 	case "text":
 		return wa.sendText(to, renderVars(st.Body, vars))
 
 	case "interactive_list":
 		if st.List == nil {
-			return fmt.Errorf("estado %s es interactive_list pero list es nil", stateName)
+			return "", fmt.Errorf("estado %s es interactive_list pero list es nil", stateName)
 		}
 
 		// ✅ Un solo mensaje: el body del interactive es st.Body (no mandamos texto aparte)
@@ -730,17 +1417,9 @@ func (r *Renderer) RenderAndSend(tenant string, stateName string, wa *WhatsAppCl
 		button := renderVars(st.List.ButtonText, vars)
 
 		// Optional: header media (image) for interactive messages
-		headerImageURL := ""
-		if st.HeaderMedia != nil && strings.EqualFold(st.HeaderMedia.Type, "image") {
-			if strings.TrimSpace(st.HeaderMedia.URL) != "" {
-				headerImageURL = strings.TrimSpace(st.HeaderMedia.URL)
-			} else if strings.TrimSpace(st.HeaderMedia.Path) != "" {
-				u, err := buildPublicAssetURL(tenant, renderVars(st.HeaderMedia.Path, vars))
-				if err != nil {
-					return err
-				}
-				headerImageURL = u
-			}
+		headerImageURL, err := resolveHeaderImageURL(tenant, st.HeaderMedia, vars)
+		if err != nil {
+			return "", err
 		}
 
 		// Render vars en secciones/rows (por si lo necesitás)
@@ -764,7 +1443,7 @@ func (r *Renderer) RenderAndSend(tenant string, stateName string, wa *WhatsAppCl
 
 	case "interactive_buttons":
 		if st.Buttons == nil {
-			return fmt.Errorf("estado %s es interactive_buttons pero buttons es nil", stateName)
+			return "", fmt.Errorf("estado %s es interactive_buttons pero buttons es nil", stateName)
 		}
 
 		bodyText := strings.TrimSpace(st.Body)
@@ -777,17 +1456,9 @@ func (r *Renderer) RenderAndSend(tenant string, stateName string, wa *WhatsAppCl
 		footer := renderVars(st.Buttons.Footer, vars)
 
 		// Optional: header media (image) for interactive messages
-		headerImageURL := ""
-		if st.HeaderMedia != nil && strings.EqualFold(st.HeaderMedia.Type, "image") {
-			if strings.TrimSpace(st.HeaderMedia.URL) != "" {
-				headerImageURL = strings.TrimSpace(st.HeaderMedia.URL)
-			} else if strings.TrimSpace(st.HeaderMedia.Path) != "" {
-				u, err := buildPublicAssetURL(tenant, renderVars(st.HeaderMedia.Path, vars))
-				if err != nil {
-					return err
-				}
-				headerImageURL = u
-			}
+		headerImageURL, err := resolveHeaderImageURL(tenant, st.HeaderMedia, vars)
+		if err != nil {
+			return "", err
 		}
 
 		btns := make([]FlowButton, 0, len(st.Buttons.Buttons))
@@ -800,9 +1471,54 @@ func (r *Renderer) RenderAndSend(tenant string, stateName string, wa *WhatsAppCl
 
 		return wa.sendButtons(to, headerText, headerImageURL, bodyText, footer, btns)
 
+	case "interactive_cta_url":
+		if st.CTA == nil {
+			return "", fmt.Errorf("estado %s es interactive_cta_url pero cta es nil", stateName)
+		}
+
+		bodyText := strings.TrimSpace(st.Body)
+		if bodyText == "" {
+			bodyText = "Tocá el botón para continuar:"
+		}
+		bodyText = renderVars(bodyText, vars)
+
+		headerText := renderVars(st.CTA.Header, vars)
+		footer := renderVars(st.CTA.Footer, vars)
+		displayText := renderVars(st.CTA.DisplayText, vars)
+
+		ctaURL := strings.TrimSpace(renderURLVars(st.CTA.URL, vars))
+		if u, err := url.Parse(ctaURL); err != nil || u.Host == "" {
+			return "", fmt.Errorf("estado %s: cta.url inválida tras render: %q", stateName, ctaURL)
+		}
+
+		headerImageURL, err := resolveHeaderImageURL(tenant, st.HeaderMedia, vars)
+		if err != nil {
+			return "", err
+		}
+
+		return wa.sendCTAURL(to, headerText, headerImageURL, bodyText, footer, displayText, ctaURL)
+
+	case "location_request":
+		return wa.sendLocationRequest(to, renderVars(st.Body, vars))
+
 	default:
-		return fmt.Errorf("tipo de estado no soportado: %s", st.Type)
+		return "", fmt.Errorf("tipo de estado no soportado: %s", st.Type)
+	}
+}
+
+// resolveHeaderImageURL devuelve la URL pública del header image (url remota o asset local).
+// Devuelve "" si el estado no tiene header_media de tipo image.
+func resolveHeaderImageURL(tenant string, hm *FlowHeaderMedia, vars map[string]string) (string, error) {
+	if hm == nil || !strings.EqualFold(hm.Type, "image") {
+		return "", nil
+	}
+	if strings.TrimSpace(hm.URL) != "" {
+		return strings.TrimSpace(hm.URL), nil
+	}
+	if strings.TrimSpace(hm.Path) != "" {
+		return buildPublicAssetURL(tenant, renderVars(hm.Path, vars))
 	}
+	return "", nil
 }
 
 // ---------------------
@@ -810,11 +1526,23 @@ func (r *Renderer) RenderAndSend(tenant string, stateName string, wa *WhatsAppCl
 // ---------------------
 
 type App struct {
+	// Un mutex por sesión: si el usuario toca dos veces mientras corre una action,
+	// los mensajes se procesan en orden en lugar de pisarse la sesión.
+	locksMu      sync.Mutex
+	sessionLocks map[string]*sessionLock // solo las sesiones con alguien adentro o esperando
+
 	verifyToken string
+	adminToken  string
 	resolver    *TenantResolver
 	sessions    *SessionStore
 	cache       *ConfigCache
 	renderer    *Renderer
+	messages    *MessageLog
+	clients     *WhatsAppClients
+	leads       *LeadStore
+	transcripts *TranscriptStore
+	claims      *ClaimStore
+	events      *EventDispatcher
 }
 
 func NewApp() (*App, error) {
@@ -822,14 +1550,44 @@ func NewApp() (*App, error) {
 	if verify == "" {
 		verify = "brokerbot_verify"
 	}
+	resolver, err := NewTenantResolver()
+	if err != nil {
+		return nil, err
+	}
+	tenantRegistry = resolver
+
+	// Los stores se arman acá y no al inicializar el paquete: DATA_DIR puede venir del .env.
+	dir := dataDir()
+	leadStore = NewLeadStore(dir)
+	claimStore = NewClaimStore(dir)
+	eventDispatcher = NewEventDispatcher(dir)
+
 	cache := NewConfigCache()
-	return &App{
-		verifyToken: verify,
-		resolver:    NewTenantResolver(),
-		sessions:    NewSessionStore(),
-		cache:       cache,
-		renderer:    NewRenderer(cache),
-	}, nil
+	clients := NewWhatsAppClients(resolver)
+	mediaClients = clients
+	app := &App{
+		sessionLocks: map[string]*sessionLock{},
+		verifyToken:  verify,
+		adminToken:   strings.TrimSpace(os.Getenv("ADMIN_TOKEN")),
+		resolver:     resolver,
+		sessions:     NewSessionStore(),
+		cache:        cache,
+		renderer:     NewRenderer(),
+		messages:     NewMessageLog(dir),
+		clients:      clients,
+		leads:        leadStore,
+		transcripts:  NewTranscriptStore(dir),
+		claims:       claimStore,
+		events:       eventDispatcher,
+	}
+	clients.rateLimit = func(tenant string) (*RateLimitConfig, bool) {
+		cfg, err := app.currentFlow(tenant)
+		if err != nil {
+			return nil, false
+		}
+		return cfg.RateLimit, true
+	}
+	return app, nil
 }
 
 func (a *App) handleWebhook(w http.ResponseWriter, r *http.Request) {
@@ -851,7 +1609,7 @@ func (a *App) handleVerify(w http.ResponseWriter, r *http.Request) {
 	token := r.URL.Query().Get("hub.verify_token")
 	challenge := r.URL.Query().Get("hub.challenge")
 
-	if mode == "subscribe" && token == a.verifyToken {
+	if mode == "subscribe" && (token == a.verifyToken || a.resolver.MatchesVerifyToken(token)) {
 		w.WriteHeader(http.StatusOK)
 		_, _ = w.Write([]byte(challenge))
 		return
@@ -876,14 +1634,30 @@ func (a *App) handleMessage(w http.ResponseWriter, r *http.Request) {
 	for _, e := range payload.Entry {
 		for _, ch := range e.Changes {
 			phoneID := ch.Value.Metadata.PhoneNumberID
-			tenant := a.resolver.Resolve(phoneID)
+			// La firma va antes de resolver: un POST sin firmar con phone_number_id inventados
+			// no tiene que llegar a las alertas de números desconocidos.
+			if !a.resolver.VerifySignature(a.resolver.tenantFor(phoneID), rawBody, r.Header.Get("X-Hub-Signature-256")) {
+				log.Printf("🚫 Firma X-Hub-Signature-256 inválida para phone_number_id=%s: descartado", phoneID)
+				continue
+			}
+			tenant, ok := a.resolver.Resolve(phoneID)
+			if !ok {
+				continue
+			}
+			if !a.resolver.Enabled(tenant) {
+				log.Printf("⏸️ tenant=%s deshabilitado: descartando webhook de phone_number_id=%s", tenant, phoneID)
+				continue
+			}
+
+			for _, st := range ch.Value.Statuses {
+				a.handleStatus(st)
+			}
 
 			if len(ch.Value.Messages) == 0 {
 				continue
 			}
 
 			for _, msg := range ch.Value.Messages {
-				waID := msg.From
 				name := ""
 				if len(ch.Value.Contacts) > 0 {
 					name = strings.TrimSpace(ch.Value.Contacts[0].Profile.Name)
@@ -891,213 +1665,527 @@ func (a *App) handleMessage(w http.ResponseWriter, r *http.Request) {
 				if name == "" {
 					name = "ahí"
 				}
+				a.handleIncoming(tenant, phoneID, name, msg)
+			}
+		}
+	}
 
-				// Inicializamos vars con datos básicos
-				vars := map[string]string{
-					"name": name,
-				}
+	w.WriteHeader(http.StatusOK)
+}
 
-				sessKey := tenant + ":" + waID
-				sess, ok := a.sessions.Get(sessKey)
-				// Si no existe sesión o no tiene estado, inicializamos
-				if !ok || sess.State == "" {
-					sess = UserSession{
-						State:     "MENU",
-						UpdatedAt: time.Now(),
-						Data:      make(map[string]string), // Importante inicializar el mapa
-					}
-					a.sessions.Set(sessKey, sess)
-				}
+// handleIncoming procesa un mensaje entrante: transición, action y render del próximo estado.
+// Los mensajes de una misma sesión se procesan de a uno (ver lockSession).
+func (a *App) handleIncoming(tenant, phoneID, name string, msg IncomingMessage) {
+	waID := msg.From
+
+	// Inicializamos vars con datos básicos
+	vars := map[string]string{
+		"name": name,
+	}
+
+	sessKey := tenant + ":" + waID
+	defer a.lockSession(sessKey)()
+	sess, ok := a.sessions.Get(sessKey)
+	// Si no existe sesión o no tiene estado, inicializamos (el estado de entrada sale del flow)
+	isNew := !ok || sess.State == ""
+	if isNew {
+		sess = UserSession{
+			UpdatedAt: time.Now(),
+			StartedAt: time.Now(),
+			Data:      make(map[string]string), // Importante inicializar el mapa
+		}
+	}
+	if sess.Data == nil {
+		sess.Data = make(map[string]string)
+	}
+	// El nombre del perfil también queda en sesión (lo usan las actions, ej: save_lead)
+	if name != "" {
+		sess.Data["name"] = name
+	}
+	sess.PhoneID = phoneID
 
-				// Si la sesión ya traía datos (Data), los sumamos a vars para que estén disponibles
-				if sess.Data != nil {
-					for k, v := range sess.Data {
-						vars[k] = v
-					}
-				}
+	// Si la sesión ya traía datos (Data), los sumamos a vars para que estén disponibles
+	if sess.Data != nil {
+		for k, v := range sess.Data {
+			vars[k] = v
+		}
+	}
+	for k, v := range sess.Inputs {
+		vars[k] = v
+	}
+	// Horario de atención del tenant: is_open / next_open
+	for k, v := range businessHoursVars(tenant, time.Now()) {
+		vars[k] = v
+	}
 
-				log.Printf("🤖 tenant=%s wa_id=%s state=%s type=%s name=%s", tenant, waID, sess.State, msg.Type, name)
+	log.Printf("🤖 tenant=%s wa_id=%s state=%s type=%s name=%s", tenant, waID, sess.State, msg.Type, name)
+	a.transcripts.Append(tenant, waID, inboundTranscriptEntry(sess.State, msg))
 
-				waClient, err := NewWhatsAppClient(phoneID)
-				if err != nil {
-					log.Printf("ERROR WhatsApp client: %v", err)
-					continue
-				}
+	waClient, err := a.clients.Get(phoneID)
+	if err != nil {
+		log.Printf("ERROR WhatsApp client: %v", err)
+		return
+	}
 
-				// ---------------------------------------------------------
-				// NUEVO BLOQUE: CAPTURAR SELECCIÓN INTERACTIVA (SLOTS)
-				// ---------------------------------------------------------
-				// Si el mensaje es una respuesta a botón o lista, guardamos el ID
-				// en la sesión ANTES de calcular el próximo estado.
-				if msg.Type == "interactive" && msg.Interactive != nil {
-					selectedID := ""
-					if msg.Interactive.ListReply != nil {
-						selectedID = msg.Interactive.ListReply.ID
-					} else if msg.Interactive.ButtonReply != nil {
-						selectedID = msg.Interactive.ButtonReply.ID
-					}
+	// Flow con el que sigue esta sesión (versión pineada o la vigente)
+	cfg, err := a.flowForSession(tenant, &sess)
+	if err != nil {
+		log.Printf("ERROR cargando flow: %v", err)
+		a.sendTextLogged(waClient, tenant, waID, sess.State, "Perdón, hubo un error. Probá de nuevo.")
+		return
+	}
+	if isNew {
+		sess.State = cfg.Entry()
+	}
 
-					if selectedID != "" {
-						if sess.Data == nil {
-							sess.Data = make(map[string]string)
-						}
-						sess.Data["last_selected_id"] = selectedID
-						log.Printf("💾 Guardando selección del usuario: %s", selectedID)
-					}
-				}
-				// ---------------------------------------------------------
-
-				// 1. Determinamos el siguiente estado según el input del usuario
-				nextState, handled, err := a.processMessage(tenant, sess.State, msg)
-				if err != nil {
-					log.Printf("ERROR procesando msg: %v", err)
-					_ = waClient.sendText(waID, "Perdón, hubo un error. Probá de nuevo.")
-					continue
-				}
+	// Si el flow se recargó y el estado de la sesión ya no existe, la migramos
+	if next, migrated := migrateSessionState(cfg, sess.State); migrated {
+		log.Printf("🔀 Sesión %s: estado %s ya no existe en el flow, continúa en %s", sessKey, sess.State, next)
+		sess.State = next
+	}
 
-				if !handled {
-					nextState = "MENU"
-				}
+	// Conversación derivada a un asesor: el bot no responde, el mensaje queda en la cola
+	if sess.Mode == ModeHandoff {
+		if a.handleHandoffMessage(tenant, cfg, &sess, msg) {
+			sess.UpdatedAt = time.Now()
+			a.sessions.Set(sessKey, sess)
+			return
+		}
+		isNew = true
+	}
+
+	// ---------------------------------------------------------
+	// NUEVO BLOQUE: CAPTURAR SELECCIÓN INTERACTIVA (SLOTS)
+	// ---------------------------------------------------------
+	// Si el mensaje es una respuesta a botón o lista, guardamos el ID
+	// en la sesión ANTES de calcular el próximo estado.
+	if msg.Type == "interactive" && msg.Interactive != nil {
+		selectedID := ""
+		if msg.Interactive.ListReply != nil {
+			selectedID = msg.Interactive.ListReply.ID
+		} else if msg.Interactive.ButtonReply != nil {
+			selectedID = msg.Interactive.ButtonReply.ID
+		}
 
-				// ---------------------------------------------------------
-				// NUEVA LÓGICA: EJECUCIÓN DE ACCIONES (The Action Pattern)
-				// ---------------------------------------------------------
-
-				// Recuperamos la config para ver si el nextState tiene una Action asociada
-				cfg, ok := a.cache.Get(tenant)
-				if !ok {
-					// Si por alguna razón no está en caché (raro), intentamos recargar
-					loaded, errLoad := loadFlowConfig(tenant)
-					if errLoad == nil {
-						cfg = loaded
-						a.cache.Set(tenant, loaded)
-					}
-				}
+		if selectedID != "" {
+			if sess.Data == nil {
+				sess.Data = make(map[string]string)
+			}
+			sess.Data["last_selected_id"] = selectedID
+			log.Printf("💾 Guardando selección del usuario: %s", selectedID)
+		}
+	}
+	// Si el usuario compartió su ubicación, la dejamos en sesión (lat/lng/address)
+	if msg.Type == "location" && msg.Location != nil {
+		if sess.Data == nil {
+			sess.Data = make(map[string]string)
+		}
+		loc := map[string]string{
+			"lat":           strconv.FormatFloat(msg.Location.Latitude, 'f', 6, 64),
+			"lng":           strconv.FormatFloat(msg.Location.Longitude, 'f', 6, 64),
+			"address":       msg.Location.Address,
+			"location_name": msg.Location.Name,
+		}
+		for k, v := range loc {
+			sess.Data[k] = v
+			vars[k] = v
+		}
+		log.Printf("📍 Ubicación recibida: lat=%s lng=%s address=%q", loc["lat"], loc["lng"], loc["address"])
+	}
+	// Adjuntos: quedan pendientes en sesión hasta que una action los use (ej: create_claim)
+	if media, ok := msg.media(); ok {
+		media.ReceivedAt = time.Now()
+		sess.PendingMedia = append(sess.PendingMedia, media)
+		if len(sess.PendingMedia) > maxPendingMedia {
+			sess.PendingMedia = sess.PendingMedia[len(sess.PendingMedia)-maxPendingMedia:]
+		}
+		log.Printf("📎 Adjunto recibido: %s id=%s (%d pendientes)", media.Type, media.ID, len(sess.PendingMedia))
+	}
+	// ---------------------------------------------------------
 
-				// Buscamos si el próximo estado tiene una acción definida
-				targetSt, exists := cfg.States[nextState]
-
-				// Si el estado existe y tiene una Action definida...
-				if exists && targetSt.Action != "" {
-					log.Printf("⚡ Ejecutando acción: %s [Estado: %s]", targetSt.Action, nextState)
-
-					// Buscamos la función en el registro
-					if fn, found := actionRegistry[targetSt.Action]; found {
-						// Ejecutamos la acción pasándole el contexto
-						newVars, errAction := fn(tenant, waID, &sess)
-
-						if errAction != nil {
-							log.Printf("❌ Error ejecutando acción %s: %v", targetSt.Action, errAction)
-							// Opcional: Podrías forzar nextState = "ERROR_STATE" aquí si quisieras
-						} else {
-							// Merge de variables nuevas
-							if sess.Data == nil {
-								sess.Data = make(map[string]string)
-							}
-							for k, v := range newVars {
-								// 1. Disponibles para el render inmediato
-								vars[k] = v
-								// 2. Persistentes en la sesión del usuario
-								sess.Data[k] = v
-							}
-						}
-					} else {
-						log.Printf("⚠️ Acción definida en JSON pero no en código: %s", targetSt.Action)
-					}
+	// Atribución: anuncio click-to-WhatsApp o ref=... del link (quedan como vars ref_*)
+	entryCtx := newEntryContext(msg, isNew)
+	if attribution := attributionVars(msg, entryCtx); len(attribution) > 0 {
+		if sess.Data == nil {
+			sess.Data = make(map[string]string)
+		}
+		for k, v := range attribution {
+			sess.Data[k] = v
+			vars[k] = v
+		}
+		log.Printf("📣 Atribución: source_type=%s source_id=%s ref=%s", attribution["ref_source_type"], attribution["ref_source_id"], attribution["ref_code"])
+	}
+
+	// 1. Determinamos el siguiente estado: ruta de entrada (anuncio/ref/keyword) o input del usuario
+	var nextState string
+	if route, ok := matchEntryRoute(cfg, entryCtx); ok {
+		log.Printf("🧭 Ruta de entrada: %+v -> %s", route, route.State)
+		nextState = route.State
+	} else {
+		var handled bool
+		nextState, handled = a.processMessage(cfg, sess.State, msg)
+		if !handled {
+			nextState = cfg.Entry()
+		} else if st := cfg.States[sess.State]; st.SaveAs != "" && nextState != cfg.Entry() {
+			if value := inputValue(msg); value != "" {
+				if sess.Inputs == nil {
+					sess.Inputs = make(map[string]string)
 				}
+				sess.Inputs[st.SaveAs] = value
+				vars[st.SaveAs] = value
+				log.Printf("💾 Input %s guardado (estado %s)", st.SaveAs, sess.State)
+			}
+		}
+	}
 
-				// ---------------------------------------------------------
+	// Sub-flows: entrar a un "call" o volver con "$return"
+	nextState = resolveTransition(cfg, &sess, vars, nextState)
 
-				// Guardamos la sesión actualizada (Nuevo Estado + Nuevos Datos en Data)
-				sess.State = nextState
-				sess.UpdatedAt = time.Now()
-				a.sessions.Set(sessKey, sess)
+	// Al volver al estado de entrada, la sesión pasa a la versión vigente del flow
+	// (y se descartan los sub-flows que hubieran quedado abiertos)
+	if nextState == cfg.Entry() {
+		sess.CallStack = nil
+		if current, err := a.currentFlow(tenant); err == nil && current.VersionKey() != sess.FlowVersion {
+			log.Printf("📌 Sesión %s: flow %s -> %s", sessKey, sess.FlowVersion, current.VersionKey())
+			sess.FlowVersion = current.VersionKey()
+			cfg = current
+		}
+	}
 
-				// Renderizamos y enviamos el mensaje
-				if err := a.renderer.RenderAndSend(tenant, nextState, waClient, waID, vars); err != nil {
-					log.Printf("ERROR render %s: %v", nextState, err)
-					_ = waClient.sendText(waID, "Perdón, hubo un problema mostrando el menú.")
+	// ---------------------------------------------------------
+	// NUEVA LÓGICA: EJECUCIÓN DE ACCIONES (The Action Pattern)
+	// ---------------------------------------------------------
+
+	// Buscamos si el próximo estado tiene una acción definida
+	targetSt, exists := cfg.States[nextState]
+
+	// Si el estado existe y tiene una Action definida...
+	if exists && targetSt.Action != "" {
+		log.Printf("⚡ Ejecutando acción: %s [Estado: %s]", targetSt.Action, nextState)
+
+		// Feedback al usuario mientras corre la acción (puede tardar, ej: Google Calendar)
+		if (cfg.TypingIndicator || cfg.MarkAsRead) && msg.ID != "" {
+			if err := waClient.markAsRead(msg.ID, cfg.TypingIndicator); err != nil {
+				log.Printf("⚠️ No se pudo marcar como leído / typing: %v", err)
+			}
+		}
+
+		if errAction := runStateAction(tenant, waID, nextState, targetSt, &sess, vars); errAction != nil {
+			log.Printf("❌ Error ejecutando acción %s: %v", targetSt.Action, errAction)
+			// on_error_next: la conversación sigue por el estado de error (su action corre una sola vez,
+			// sin encadenar otro on_error_next)
+			if targetSt.OnErrorNext != "" {
+				nextState = targetSt.OnErrorNext
+				log.Printf("↪️ on_error_next -> %s", nextState)
+				if errSt := cfg.States[nextState]; errSt.Action != "" {
+					if err := runStateAction(tenant, waID, nextState, errSt, &sess, vars); err != nil {
+						log.Printf("❌ Error ejecutando acción %s: %v", errSt.Action, err)
+					}
 				}
 			}
 		}
 	}
 
-	w.WriteHeader(http.StatusOK)
+	// ---------------------------------------------------------
+
+	// Guardamos la sesión actualizada (Nuevo Estado + Nuevos Datos en Data)
+	sess.State = nextState
+	sess.UpdatedAt = time.Now()
+	a.sessions.Set(sessKey, sess)
+
+	// Renderizamos y enviamos el mensaje
+	msgID, err := a.renderer.RenderAndSend(tenant, cfg, nextState, waClient, waID, vars)
+	if err != nil {
+		log.Printf("ERROR render %s: %v", nextState, err)
+		if a.shouldSendFallback(tenant, waID, err) {
+			a.sendTextLogged(waClient, tenant, waID, nextState, "Perdón, hubo un problema mostrando el menú.")
+		}
+		return
+	}
+	a.messages.RecordOutbound(tenant, waID, nextState, msgID)
+	sentSt := cfg.States[nextState]
+	a.transcripts.Append(tenant, waID, TranscriptEntry{
+		Direction: "out",
+		State:     nextState,
+		Type:      sentSt.Type,
+		Text:      renderVars(sentSt.Body, vars),
+		MessageID: msgID,
+	})
+}
+
+// runStateAction corre la action del estado: renderiza action_params, ejecuta la función,
+// mergea las vars que devuelve (render inmediato + persistentes en sesión) y emite su evento
+// a los webhooks del tenant.
+func runStateAction(tenant, waID, stateName string, st FlowState, sess *UserSession, vars map[string]string) error {
+	if sess.Data == nil {
+		sess.Data = make(map[string]string)
+	}
+	for k, v := range st.ActionParams {
+		v = renderVars(v, vars)
+		sess.Data[k] = v
+		vars[k] = v
+	}
+
+	// Buscamos la función en el registro ("http" se arma con la config del estado)
+	fn, found := actionRegistry[st.Action]
+	if st.Action == httpActionName {
+		fn, found = httpAction(st.HTTP, vars), true
+	}
+	if !found {
+		log.Printf("⚠️ Acción definida en JSON pero no en código: %s", st.Action)
+		return nil
+	}
+
+	inputs := make(map[string]string, len(sess.Inputs))
+	for k, v := range sess.Inputs {
+		inputs[k] = v
+	}
+	newVars, err := fn(tenant, waID, sess)
+	if err != nil {
+		return err
+	}
+	for k, v := range newVars {
+		vars[k] = v
+		sess.Data[k] = v
+	}
+	emitActionEvent(tenant, waID, stateName, st.Action, sess, inputs, newVars)
+	return nil
+}
+
+// sendTextLogged envía un texto suelto (ej: fallback de error) y lo deja en el transcript.
+func (a *App) sendTextLogged(wa *WhatsAppClient, tenant, waID, state, text string) {
+	msgID, err := wa.sendText(waID, text)
+	if err != nil {
+		return
+	}
+	a.transcripts.Append(tenant, waID, TranscriptEntry{Direction: "out", State: state, Type: "text", Text: text, MessageID: msgID})
+}
+
+// inputValue devuelve la respuesta del usuario a guardar con save_as: el texto,
+// o el título de la opción elegida en botones/listas.
+func inputValue(msg IncomingMessage) string {
+	switch {
+	case msg.Type == "text" && msg.Text != nil:
+		return strings.TrimSpace(msg.Text.Body)
+	case msg.Type == "interactive" && msg.Interactive != nil && msg.Interactive.ListReply != nil:
+		return msg.Interactive.ListReply.Title
+	case msg.Type == "interactive" && msg.Interactive != nil && msg.Interactive.ButtonReply != nil:
+		return msg.Interactive.ButtonReply.Title
+	}
+	return ""
 }
 
-func (a *App) processMessage(tenant string, state string, msg IncomingMessage) (next string, handled bool, err error) {
-	cfg, ok := a.cache.Get(tenant)
+type sessionLock struct {
+	mu   sync.Mutex
+	refs int // cuántos lo tienen o lo esperan (protegido por App.locksMu)
+}
+
+// lockSession toma el mutex de la sesión y devuelve la función para liberarlo.
+// El último en soltarlo borra la entrada: el map no crece con cada usuario que escribió alguna vez.
+func (a *App) lockSession(sessKey string) func() {
+	a.locksMu.Lock()
+	l, ok := a.sessionLocks[sessKey]
 	if !ok {
-		loaded, err2 := loadFlowConfig(tenant)
-		if err2 != nil {
-			return "", false, err2
+		l = &sessionLock{}
+		a.sessionLocks[sessKey] = l
+	}
+	l.refs++
+	a.locksMu.Unlock()
+
+	l.mu.Lock()
+	return func() {
+		l.mu.Unlock()
+		a.locksMu.Lock()
+		if l.refs--; l.refs == 0 {
+			delete(a.sessionLocks, sessKey)
 		}
-		a.cache.Set(tenant, loaded)
-		cfg = loaded
+		a.locksMu.Unlock()
 	}
+}
 
+// currentFlow devuelve la versión vigente del flow del tenant (cargándola si hace falta).
+func (a *App) currentFlow(tenant string) (FlowConfig, error) {
+	if cfg, ok := a.cache.Get(tenant); ok {
+		return cfg, nil
+	}
+	loaded, err := loadFlowConfig(tenant)
+	if err != nil {
+		return FlowConfig{}, err
+	}
+	a.cache.Set(tenant, loaded)
+	return loaded, nil
+}
+
+// flowForSession devuelve el flow con el que tiene que seguir la sesión: la versión pineada
+// mientras la conversación está en curso, o la vigente si es nueva, está en el estado de
+// entrada o su versión ya no está en memoria.
+func (a *App) flowForSession(tenant string, sess *UserSession) (FlowConfig, error) {
+	current, err := a.currentFlow(tenant)
+	if err != nil {
+		return FlowConfig{}, err
+	}
+	key := current.VersionKey()
+
+	if sess.FlowVersion != "" && sess.FlowVersion != key && sess.State != current.Entry() {
+		if pinned, ok := a.cache.GetVersion(tenant, sess.FlowVersion); ok {
+			return pinned, nil
+		}
+		log.Printf("📌 Versión de flow %s ya no está en memoria: la sesión pasa a %s", sess.FlowVersion, key)
+	}
+	sess.FlowVersion = key
+	return current, nil
+}
+
+// migrateSessionState resuelve el estado de una sesión contra el flow vigente:
+// si el estado fue eliminado/renombrado usa state_migrations, y si no hay mapeo vuelve al de entrada.
+func migrateSessionState(cfg FlowConfig, state string) (string, bool) {
+	if _, ok := cfg.States[state]; ok {
+		return state, false
+	}
+	if to, ok := cfg.StateMigrations[state]; ok {
+		return to, true
+	}
+	return cfg.Entry(), true
+}
+
+// shouldSendFallback decide, según el tipo de error de Meta, si tiene sentido mandar
+// el texto de "hubo un error" o si el envío va a fallar igual (y a quién avisar).
+func (a *App) shouldSendFallback(tenant, waID string, err error) bool {
+	switch metaErrorKind(err) {
+	case MetaErrAuth:
+		alertOperator(tenant, fmt.Sprintf("token de WhatsApp inválido, vencido o sin permisos: %v", err))
+		return false
+	case MetaErrRecipientUnreachable:
+		log.Printf("🚫 wa_id=%s no recibe mensajes (bloqueo o número inválido)", waID)
+		return false
+	case MetaErrReEngagement:
+		log.Printf("⌛ wa_id=%s fuera de la ventana de 24h: solo templates", waID)
+		return false
+	case MetaErrRateLimited:
+		// Ya reintentamos con backoff; otro envío solo suma carga.
+		return false
+	default:
+		return true
+	}
+}
+
+// handleStatus procesa un status webhook (sent/delivered/read/failed) de un mensaje saliente.
+func (a *App) handleStatus(st MessageStatus) {
+	m, ok := a.messages.ApplyStatus(st)
+	if !ok {
+		log.Printf("📬 STATUS sin correlación: id=%s status=%s", st.ID, st.Status)
+		return
+	}
+	log.Printf("📬 STATUS tenant=%s wa_id=%s state=%s status=%s", m.Tenant, m.WaID, m.State, m.Status)
+
+	if st.Status != "failed" {
+		return
+	}
+
+	kind := (&MetaAPIError{Code: m.ErrorCode}).Kind()
+	log.Printf("❌ Mensaje no entregado: wa_id=%s state=%s code=%d kind=%s title=%q", m.WaID, m.State, m.ErrorCode, kind, m.ErrorTitle)
+
+	cfg, ok := a.cache.Get(m.Tenant)
+	if !ok {
+		return
+	}
+	if cfg.AlertOnSendFailure {
+		alertOperator(m.Tenant, fmt.Sprintf("no se pudo entregar el mensaje a %s (estado %s): %d %s", m.WaID, m.State, m.ErrorCode, m.ErrorTitle))
+	}
+	if cfg.OnSendFailed != "" {
+		sessKey := m.Tenant + ":" + m.WaID
+		// Mismo lock que handleIncoming: si no, un mensaje entrante en paralelo pisa (o pierde) el cambio.
+		defer a.lockSession(sessKey)()
+		if sess, ok := a.sessions.Get(sessKey); ok {
+			sess.State = cfg.OnSendFailed
+			sess.UpdatedAt = time.Now()
+			a.sessions.Set(sessKey, sess)
+			log.Printf("↩️ Sesión %s movida a %s por falla de envío", sessKey, cfg.OnSendFailed)
+		}
+	}
+}
+
+func (a *App) processMessage(cfg FlowConfig, state string, msg IncomingMessage) (next string, handled bool) {
 	st, ok := cfg.States[state]
 	if !ok {
-		return "MENU", false, nil
+		return cfg.Entry(), false
 	}
 
 	switch msg.Type {
 	case "text":
 		if msg.Text == nil {
-			return "MENU", false, nil
+			return cfg.Entry(), false
 		}
 		txt := strings.TrimSpace(msg.Text.Body)
 		log.Printf("📩 TEXT: %q", txt)
 
 		if strings.EqualFold(txt, "menu") {
-			return "MENU", true, nil
+			return cfg.Entry(), true
 		}
 
 		if st.OnTextNext != "" {
-			return st.OnTextNext, true, nil
+			return st.OnTextNext, true
 		}
-		return "MENU", false, nil
+		return cfg.Entry(), false
 
 	case "interactive":
 		if msg.Interactive == nil {
-			return "MENU", false, nil
+			return cfg.Entry(), false
 		}
 
 		switch msg.Interactive.Type {
 		case "list_reply":
 			if msg.Interactive.ListReply == nil {
-				return "MENU", false, nil
+				return cfg.Entry(), false
 			}
 			rowID := msg.Interactive.ListReply.ID
 			log.Printf("🧾 LIST_REPLY: id=%s title=%s", rowID, msg.Interactive.ListReply.Title)
 
 			if st.OnSelectNext != nil {
 				if ns, ok := st.OnSelectNext[rowID]; ok && ns != "" {
-					return ns, true, nil
+					return ns, true
 				}
 			}
-			return "MENU", false, nil
+			return cfg.Entry(), false
 
 		case "button_reply":
 			if msg.Interactive.ButtonReply == nil {
-				return "MENU", false, nil
+				return cfg.Entry(), false
 			}
 			btnID := msg.Interactive.ButtonReply.ID
 			log.Printf("🔘 BUTTON_REPLY: id=%s title=%s", btnID, msg.Interactive.ButtonReply.Title)
 
 			if st.OnSelectNext != nil {
 				if ns, ok := st.OnSelectNext[btnID]; ok && ns != "" {
-					return ns, true, nil
+					return ns, true
 				}
 			}
-			return "MENU", false, nil
+			return cfg.Entry(), false
 
 		default:
-			return "MENU", false, nil
+			return cfg.Entry(), false
+		}
+
+	case "location":
+		if msg.Location == nil {
+			return cfg.Entry(), false
+		}
+		if st.OnLocationNext != "" {
+			return st.OnLocationNext, true
+		}
+		return cfg.Entry(), false
+
+	case "image", "document", "video":
+		if _, ok := msg.media(); !ok {
+			return cfg.Entry(), false
 		}
+		if st.OnMediaNext != "" {
+			return st.OnMediaNext, true
+		}
+		return cfg.Entry(), false
 
 	default:
-		return "MENU", false, nil
+		return cfg.Entry(), false
 	}
 }
 
@@ -1196,40 +2284,19 @@ func (a *App) handleTenantAssets(w http.ResponseWriter, r *http.Request) {
 type ActionFunc func(tenant, userID string, session *UserSession) (map[string]string, error)
 
 var actionRegistry = map[string]ActionFunc{
-	"mock_crm_lookup":      actionMockCRMLookup,
 	"get_calendar_slots":   actionGetCalendarSlots,
 	"schedule_appointment": actionScheduleAppointment,
-}
-
-// --- Implementación Mock del CRM ---
-
-func actionMockCRMLookup(tenant, userID string, sess *UserSession) (map[string]string, error) {
-	// SIMULAMOS una llamada a base de datos
-	// En la vida real, acá harías: SELECT * FROM users WHERE phone = userID
-
-	log.Printf("🔍 Buscando usuario %s en CRM simulado...", userID)
-
-	// Simulamos que si el número termina en par, es cliente. Si es impar, es nuevo.
-	// (Un hack rápido para probar flujos distintos con distintos celulares)
-	esCliente := false
-	if len(userID) > 0 {
-		lastDigit := userID[len(userID)-1]
-		if int(lastDigit)%2 == 0 {
-			esCliente = true
-		}
-	}
-
-	vars := make(map[string]string)
-	if esCliente {
-		vars["is_client"] = "true"
-		vars["client_name"] = "Carlos (Cliente VIP)" // Dato traído del "CRM"
-		vars["last_visit"] = "15 de Febrero"
-	} else {
-		vars["is_client"] = "false"
-		vars["client_name"] = "Visitante"
-	}
-
-	return vars, nil
+	"nearest_branch":       actionNearestBranch,
+	"save_lead":            actionSaveLead,
+	"handoff":              actionHandoff,
+	"create_claim":         actionCreateClaim,
+	"attach_claim_media":   actionAttachClaimMedia,
+	"claim_status_lookup":  actionClaimStatusLookup,
+	"policy_lookup":        actionPolicyLookup,
+	"payment_lookup":       actionPaymentLookup,
+	"notify_email":         actionNotifyEmail,
+	"crm_lookup":           actionCRMLookup,
+	"crm_upsert":           actionCRMUpsert,
 }
 
 func actionGetCalendarSlots(tenant, userID string, sess *UserSession) (map[string]string, error) {
@@ -1270,6 +2337,73 @@ func actionGetCalendarSlots(tenant, userID string, sess *UserSession) (map[strin
 	return vars, nil
 }
 
+// ---------------------
+// Admin endpoints
+// ---------------------
+
+// requireAdmin valida el header "Authorization: Bearer {ADMIN_TOKEN}".
+// Sin ADMIN_TOKEN configurado los endpoints de admin quedan deshabilitados.
+func (a *App) requireAdmin(w http.ResponseWriter, r *http.Request) bool {
+	if a.adminToken == "" {
+		http.Error(w, "admin deshabilitado (ADMIN_TOKEN no seteado)", http.StatusForbidden)
+		return false
+	}
+	token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !hmac.Equal([]byte(token), []byte(a.adminToken)) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// GET /admin/messages                          -> contadores por tenant + fallas por conversación
+// GET /admin/messages?tenant=broker&wa_id=549… -> log de mensajes salientes de una conversación
+func (a *App) handleAdminMessages(w http.ResponseWriter, r *http.Request) {
+	if !a.requireAdmin(w, r) {
+		return
+	}
+	q := r.URL.Query()
+	if q.Get("tenant") != "" && q.Get("wa_id") != "" {
+		writeJSON(w, a.messages.Conversation(q.Get("tenant"), q.Get("wa_id")))
+		return
+	}
+	stats, failed := a.messages.Snapshot()
+	writeJSON(w, map[string]any{
+		"stats":                stats,
+		"failed_conversations": failed,
+	})
+}
+
+// GET /admin/flows -> por tenant: versión vigente, versiones en memoria y sesiones en cada una
+func (a *App) handleAdminFlows(w http.ResponseWriter, r *http.Request) {
+	if !a.requireAdmin(w, r) {
+		return
+	}
+	counts := a.sessions.CountByFlowVersion()
+	out := map[string]any{}
+	for tenant, v := range a.cache.Versions() {
+		out[tenant] = map[string]any{
+			"current":  v.Current,
+			"loaded":   v.Loaded,
+			"sessions": counts[tenant],
+		}
+	}
+	writeJSON(w, out)
+}
+
+// GET /admin/ratelimits -> estado del token bucket y cola de envíos por phone_number_id
+func (a *App) handleAdminRateLimits(w http.ResponseWriter, r *http.Request) {
+	if !a.requireAdmin(w, r) {
+		return
+	}
+	writeJSON(w, a.clients.RateLimiterStats())
+}
+
 // ---------------------
 // main
 // ---------------------
@@ -1282,8 +2416,24 @@ func main() {
 		log.Fatal(err)
 	}
 
+	NewConfigWatcher(app.cache, configReloadInterval()).Start()
+	app.events.Resume()
+	app.startHandoffSweeper()
+
 	http.HandleFunc("/webhook", app.handleWebhook)
 	http.HandleFunc("/tenants/", app.handleTenantAssets)
+	http.HandleFunc("/admin/messages", app.handleAdminMessages)
+	http.HandleFunc("/admin/ratelimits", app.handleAdminRateLimits)
+	http.HandleFunc("/admin/flows", app.handleAdminFlows)
+	http.HandleFunc("/admin/leads", app.handleAdminLeads)
+	http.HandleFunc("/admin/handoffs", app.handleAdminHandoffs)
+	http.HandleFunc("/admin/handoffs/release", app.handleAdminHandoffs)
+	http.HandleFunc("/api/inbox", app.handleInboxAPI)
+	http.HandleFunc("/api/inbox/", app.handleInboxAPI)
+	http.HandleFunc("/inbox", app.handleInboxPage)
+	http.HandleFunc("/api/transcripts", app.handleTranscripts)
+	http.HandleFunc("/api/claims", app.handleClaimsAPI)
+	http.HandleFunc("/api/claims/", app.handleClaimsAPI)
 
 	port := os.Getenv("PORT")
 	if port == "" {
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ---------------------
+// Message log (status webhooks: sent / delivered / read / failed)
+// ---------------------
+
+// Máximo de mensajes salientes que guardamos por conversación.
+const maxMessagesPerConversation = 100
+
+type MessageStatus struct {
+	ID          string `json:"id"`
+	Status      string `json:"status"` // sent | delivered | read | failed
+	Timestamp   string `json:"timestamp"`
+	RecipientID string `json:"recipient_id"`
+	Errors      []struct {
+		Code      int    `json:"code"`
+		Title     string `json:"title"`
+		Message   string `json:"message"`
+		ErrorData struct {
+			Details string `json:"details"`
+		} `json:"error_data"`
+	} `json:"errors,omitempty"`
+}
+
+type OutboundMessage struct {
+	ID         string    `json:"id"`
+	Tenant     string    `json:"tenant"`
+	WaID       string    `json:"wa_id"`
+	State      string    `json:"state"`
+	SentAt     time.Time `json:"sent_at"`
+	Status     string    `json:"status"`
+	StatusAt   time.Time `json:"status_at,omitempty"`
+	ErrorCode  int       `json:"error_code,omitempty"`
+	ErrorTitle string    `json:"error_title,omitempty"`
+}
+
+type MessageStats struct {
+	Sent      int `json:"sent"`
+	Delivered int `json:"delivered"`
+	Read      int `json:"read"`
+	Failed    int `json:"failed"`
+}
+
+// MessageLog correlaciona los statuses con los mensajes enviados. Se persiste en
+// {dataDir}/{tenant}/messages/{wa_id}.json (mensajes de la conversación) y
+// {dataDir}/{tenant}/message_stats.json (contadores y fallas), y se carga al arrancar.
+type MessageLog struct {
+	mu     sync.Mutex
+	dir    string
+	byConv map[string][]*OutboundMessage // tenant:wa_id -> mensajes
+	byID   map[string]*OutboundMessage   // wamid -> mensaje
+	stats  map[string]*MessageStats      // tenant -> contadores
+	failed map[string]int                // tenant:wa_id -> fallas
+}
+
+// messageStatsFile es el contenido de message_stats.json: fallas por wa_id.
+type messageStatsFile struct {
+	Stats  MessageStats   `json:"stats"`
+	Failed map[string]int `json:"failed"`
+}
+
+func NewMessageLog(dir string) *MessageLog {
+	l := &MessageLog{
+		dir:    dir,
+		byConv: make(map[string][]*OutboundMessage),
+		byID:   make(map[string]*OutboundMessage),
+		stats:  make(map[string]*MessageStats),
+		failed: make(map[string]int),
+	}
+	l.load()
+	return l
+}
+
+// load levanta lo persistido. Un archivo ilegible se loguea y se saltea.
+func (l *MessageLog) load() {
+	convs, _ := filepath.Glob(filepath.Join(l.dir, "*", "messages", "*.json"))
+	for _, p := range convs {
+		var msgs []*OutboundMessage
+		if err := readJSONFile(p, &msgs); err != nil {
+			log.Printf("⚠️ message log: %s inválido: %v", p, err)
+			continue
+		}
+		for _, m := range msgs {
+			l.byConv[m.Tenant+":"+m.WaID] = append(l.byConv[m.Tenant+":"+m.WaID], m)
+			l.byID[m.ID] = m
+		}
+	}
+
+	files, _ := filepath.Glob(filepath.Join(l.dir, "*", "message_stats.json"))
+	for _, p := range files {
+		tenant := filepath.Base(filepath.Dir(p))
+		var f messageStatsFile
+		if err := readJSONFile(p, &f); err != nil {
+			log.Printf("⚠️ message log: %s inválido: %v", p, err)
+			continue
+		}
+		st := f.Stats
+		l.stats[tenant] = &st
+		for waID, n := range f.Failed {
+			l.failed[tenant+":"+waID] = n
+		}
+	}
+	if len(l.byID) > 0 || len(l.stats) > 0 {
+		log.Printf("📨 message log: %d mensajes de %d tenants cargados", len(l.byID), len(l.stats))
+	}
+}
+
+func readJSONFile(path string, v any) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// writeJSONFile escribe v en path de forma atómica (tmp + rename).
+func writeJSONFile(path string, v any) error {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// persistConversation reescribe los mensajes de la conversación. Requiere l.mu.
+// Un error de disco se loguea: no corta el envío ni el webhook.
+func (l *MessageLog) persistConversation(tenant, waID string) {
+	if tenant == "" || strings.ContainsAny(tenant, `/\.`) || !waIDRe.MatchString(waID) {
+		return
+	}
+	p := filepath.Join(l.dir, tenant, "messages", waID+".json")
+	if err := writeJSONFile(p, l.byConv[tenant+":"+waID]); err != nil {
+		log.Printf("⚠️ message log: no se pudo guardar %s: %v", p, err)
+	}
+}
+
+// persistStats reescribe los contadores y fallas del tenant. Requiere l.mu.
+func (l *MessageLog) persistStats(tenant string) {
+	if tenant == "" || strings.ContainsAny(tenant, `/\.`) {
+		return
+	}
+	f := messageStatsFile{Failed: map[string]int{}}
+	if st, ok := l.stats[tenant]; ok {
+		f.Stats = *st
+	}
+	for k, n := range l.failed {
+		if waID, ok := strings.CutPrefix(k, tenant+":"); ok {
+			f.Failed[waID] = n
+		}
+	}
+	p := filepath.Join(l.dir, tenant, "message_stats.json")
+	if err := writeJSONFile(p, f); err != nil {
+		log.Printf("⚠️ message log: no se pudo guardar %s: %v", p, err)
+	}
+}
+
+func (l *MessageLog) tenantStats(tenant string) *MessageStats {
+	st, ok := l.stats[tenant]
+	if !ok {
+		st = &MessageStats{}
+		l.stats[tenant] = st
+	}
+	return st
+}
+
+// RecordOutbound registra un mensaje enviado (ID devuelto por Graph API) para correlacionar statuses.
+func (l *MessageLog) RecordOutbound(tenant, waID, state, msgID string) {
+	if msgID == "" {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	key := tenant + ":" + waID
+	m := &OutboundMessage{
+		ID:     msgID,
+		Tenant: tenant,
+		WaID:   waID,
+		State:  state,
+		SentAt: time.Now(),
+		Status: "accepted",
+	}
+	msgs := append(l.byConv[key], m)
+	if len(msgs) > maxMessagesPerConversation {
+		for _, old := range msgs[:len(msgs)-maxMessagesPerConversation] {
+			delete(l.byID, old.ID)
+		}
+		msgs = msgs[len(msgs)-maxMessagesPerConversation:]
+	}
+	l.byConv[key] = msgs
+	l.byID[msgID] = m
+	l.persistConversation(tenant, waID)
+}
+
+// ApplyStatus actualiza el mensaje correlacionado. Devuelve el mensaje (copia) y si lo encontró.
+func (l *MessageLog) ApplyStatus(s MessageStatus) (OutboundMessage, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	m, ok := l.byID[s.ID]
+	if !ok {
+		return OutboundMessage{}, false
+	}
+
+	// Meta puede mandar los statuses desordenados (read antes que delivered): no retrocedemos.
+	if statusRank(s.Status) <= statusRank(m.Status) {
+		return *m, true
+	}
+
+	prev := statusRank(m.Status)
+	m.Status = s.Status
+	m.StatusAt = time.Now()
+	if ts, err := parseUnixTimestamp(s.Timestamp); err == nil {
+		m.StatusAt = ts
+	}
+
+	// Si un status llega salteando otros (read sin delivered, o el delivered se perdió),
+	// contamos también los intermedios: un mensaje leído fue enviado y entregado.
+	st := l.tenantStats(m.Tenant)
+	switch s.Status {
+	case "sent", "delivered", "read":
+		for rank := prev + 1; rank <= statusRank(s.Status); rank++ {
+			switch rank {
+			case 1:
+				st.Sent++
+			case 2:
+				st.Delivered++
+			case 3:
+				st.Read++
+			}
+		}
+	case "failed":
+		st.Failed++
+		l.failed[m.Tenant+":"+m.WaID]++
+		if len(s.Errors) > 0 {
+			m.ErrorCode = s.Errors[0].Code
+			m.ErrorTitle = s.Errors[0].Title
+		}
+	}
+	l.persistConversation(m.Tenant, m.WaID)
+	l.persistStats(m.Tenant)
+	return *m, true
+}
+
+func statusRank(status string) int {
+	switch status {
+	case "sent":
+		return 1
+	case "delivered":
+		return 2
+	case "read":
+		return 3
+	case "failed":
+		return 4
+	default:
+		return 0
+	}
+}
+
+func (l *MessageLog) Conversation(tenant, waID string) []OutboundMessage {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	msgs := l.byConv[tenant+":"+waID]
+	out := make([]OutboundMessage, 0, len(msgs))
+	for _, m := range msgs {
+		out = append(out, *m)
+	}
+	return out
+}
+
+// Snapshot devuelve contadores por tenant y fallas por conversación (tenant:wa_id).
+func (l *MessageLog) Snapshot() (map[string]MessageStats, map[string]int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	stats := make(map[string]MessageStats, len(l.stats))
+	for t, s := range l.stats {
+		stats[t] = *s
+	}
+	failed := make(map[string]int, len(l.failed))
+	for k, v := range l.failed {
+		failed[k] = v
+	}
+	return stats, failed
+}
+
+func parseUnixTimestamp(s string) (time.Time, error) {
+	sec, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(sec, 0), nil
+}
+
+// ---------------------
+// Operator alerts
+// ---------------------
+
+// alertOperator deja el aviso en el log y, si OPERATOR_ALERT_URL está seteada,
+// lo postea como {"text": ...} (compatible con webhooks de Slack/Discord).
+func alertOperator(tenant, text string) {
+	log.Printf("🚨 ALERTA tenant=%s: %s", tenant, text)
+
+	alertURL := strings.TrimSpace(os.Getenv("OPERATOR_ALERT_URL"))
+	if alertURL == "" {
+		return
+	}
+	b, _ := json.Marshal(map[string]string{"text": "[" + tenant + "] " + text})
+	go func() {
+		client := &http.Client{Timeout: 10 * time.Second}
+		resp, err := client.Post(alertURL, "application/json", bytes.NewReader(b))
+		if err != nil {
+			log.Printf("ERROR enviando alerta: %v", err)
+			return
+		}
+		resp.Body.Close()
+	}()
+}
@@ -0,0 +1,55 @@
+package main
+
+import "testing"
+
+func TestMessageLogSurvivesRestart(t *testing.T) {
+	dir := t.TempDir()
+	l := NewMessageLog(dir)
+	l.RecordOutbound("broker", "5491100000000", "MENU", "wamid.1")
+	l.RecordOutbound("broker", "5491100000000", "MENU", "wamid.2")
+	l.ApplyStatus(MessageStatus{ID: "wamid.1", Status: "delivered", Timestamp: "1760000000"})
+	failed := MessageStatus{ID: "wamid.2", Status: "failed"}
+	l.ApplyStatus(failed)
+
+	l = NewMessageLog(dir)
+	if m, ok := l.ApplyStatus(MessageStatus{ID: "wamid.1", Status: "read"}); !ok || m.Status != "read" {
+		t.Fatalf("después de reiniciar el status no correlaciona: %+v (%v)", m, ok)
+	}
+	if msgs := l.Conversation("broker", "5491100000000"); len(msgs) != 2 || msgs[1].Status != "failed" {
+		t.Errorf("conversación = %+v", msgs)
+	}
+	stats, fails := l.Snapshot()
+	if got := stats["broker"]; got.Sent != 1 || got.Delivered != 1 || got.Read != 1 || got.Failed != 1 {
+		t.Errorf("stats = %+v", got)
+	}
+	if fails["broker:5491100000000"] != 1 {
+		t.Errorf("fallas = %v", fails)
+	}
+}
+
+func TestMessageLogCountsSkippedStatuses(t *testing.T) {
+	tests := []struct {
+		name     string
+		statuses []string
+		want     MessageStats
+	}{
+		{"en orden", []string{"sent", "delivered", "read"}, MessageStats{Sent: 1, Delivered: 1, Read: 1}},
+		{"read primero", []string{"read", "sent", "delivered"}, MessageStats{Sent: 1, Delivered: 1, Read: 1}},
+		{"delivered sin sent", []string{"delivered"}, MessageStats{Sent: 1, Delivered: 1}},
+		{"failed después de sent", []string{"sent", "failed"}, MessageStats{Sent: 1, Failed: 1}},
+		{"failed solo", []string{"failed", "delivered"}, MessageStats{Failed: 1}},
+		{"repetido", []string{"sent", "sent"}, MessageStats{Sent: 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := NewMessageLog(t.TempDir())
+			l.RecordOutbound("broker", "5491100000000", "MENU", "wamid.1")
+			for _, status := range tt.statuses {
+				l.ApplyStatus(MessageStatus{ID: "wamid.1", Status: status})
+			}
+			if stats, _ := l.Snapshot(); stats["broker"] != tt.want {
+				t.Errorf("stats = %+v, esperaba %+v", stats["broker"], tt.want)
+			}
+		})
+	}
+}
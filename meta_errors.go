@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// ---------------------
+// Graph API errors
+// ---------------------
+
+// MetaErrorKind agrupa los códigos de error de Meta según cómo tiene que reaccionar el engine.
+type MetaErrorKind string
+
+const (
+	MetaErrUnknown              MetaErrorKind = "unknown"
+	MetaErrAuth                 MetaErrorKind = "auth"                  // token vencido/revocado o sin permisos
+	MetaErrRateLimited          MetaErrorKind = "rate_limited"          // throughput del número / par de usuarios
+	MetaErrTransient            MetaErrorKind = "transient"             // caída temporal de Meta (reintentable)
+	MetaErrRecipientUnreachable MetaErrorKind = "recipient_unreachable" // número inválido, sin WhatsApp o nos bloqueó
+	MetaErrReEngagement         MetaErrorKind = "re_engagement"         // pasaron >24h: solo se puede mandar template
+	MetaErrInvalidRequest       MetaErrorKind = "invalid_request"       // payload/parámetros inválidos (bug nuestro o del flow)
+)
+
+// MetaAPIError es el error que devuelve Graph API: {"error": {"message", "type", "code", "error_subcode", "error_data", "fbtrace_id"}}
+type MetaAPIError struct {
+	HTTPStatus int
+	Code       int
+	Subcode    int
+	Type       string
+	Message    string
+	Details    string
+	FBTraceID  string
+}
+
+func (e *MetaAPIError) Error() string {
+	msg := fmt.Sprintf("meta api error: http=%d code=%d", e.HTTPStatus, e.Code)
+	if e.Subcode != 0 {
+		msg += fmt.Sprintf(" subcode=%d", e.Subcode)
+	}
+	msg += fmt.Sprintf(" kind=%s: %s", e.Kind(), e.Message)
+	if e.Details != "" {
+		msg += " (" + e.Details + ")"
+	}
+	if e.FBTraceID != "" {
+		msg += " fbtrace_id=" + e.FBTraceID
+	}
+	return msg
+}
+
+// Kind clasifica el error. Códigos: https://developers.facebook.com/docs/whatsapp/cloud-api/support/error-codes
+func (e *MetaAPIError) Kind() MetaErrorKind {
+	switch e.Code {
+	case 190, 102, 10, 200:
+		return MetaErrAuth
+	case 4, 80007, 130429, 131048, 131056:
+		return MetaErrRateLimited
+	case 1, 2, 131000, 131016, 133004:
+		return MetaErrTransient
+	case 131026, 131021, 131030, 131050:
+		return MetaErrRecipientUnreachable
+	case 131047:
+		return MetaErrReEngagement
+	case 100, 131008, 131009, 131051, 131052, 131053, 132000, 132001, 132005, 132007, 132012:
+		return MetaErrInvalidRequest
+	}
+
+	switch {
+	case e.HTTPStatus == http.StatusUnauthorized:
+		return MetaErrAuth
+	case e.HTTPStatus == http.StatusTooManyRequests:
+		return MetaErrRateLimited
+	case e.HTTPStatus >= 500:
+		return MetaErrTransient
+	}
+	return MetaErrUnknown
+}
+
+// Retryable indica si tiene sentido reintentar el mismo envío.
+func (e *MetaAPIError) Retryable() bool {
+	k := e.Kind()
+	return k == MetaErrRateLimited || k == MetaErrTransient
+}
+
+// parseMetaError arma un MetaAPIError a partir de la respuesta no-2xx de Graph API.
+func parseMetaError(status int, body []byte) *MetaAPIError {
+	var envelope struct {
+		Error struct {
+			Message      string `json:"message"`
+			Type         string `json:"type"`
+			Code         int    `json:"code"`
+			ErrorSubcode int    `json:"error_subcode"`
+			FBTraceID    string `json:"fbtrace_id"`
+			ErrorData    struct {
+				Details string `json:"details"`
+			} `json:"error_data"`
+		} `json:"error"`
+	}
+	e := &MetaAPIError{HTTPStatus: status}
+	if err := json.Unmarshal(body, &envelope); err != nil || envelope.Error.Message == "" {
+		e.Message = string(body)
+		return e
+	}
+	e.Code = envelope.Error.Code
+	e.Subcode = envelope.Error.ErrorSubcode
+	e.Type = envelope.Error.Type
+	e.Message = envelope.Error.Message
+	e.Details = envelope.Error.ErrorData.Details
+	e.FBTraceID = envelope.Error.FBTraceID
+	return e
+}
+
+// metaErrorKind devuelve la clasificación de err si es (o envuelve) un MetaAPIError.
+func metaErrorKind(err error) MetaErrorKind {
+	var me *MetaAPIError
+	if errors.As(err, &me) {
+		return me.Kind()
+	}
+	return MetaErrUnknown
+}
+
+// ---------------------
+// Retry / backoff
+// ---------------------
+
+const (
+	graphMaxAttempts = 4
+	graphBackoffBase = 500 * time.Millisecond
+	graphBackoffMax  = 8 * time.Second
+)
+
+// newGraphHTTPClient arma el cliente HTTP para Graph API con timeouts (nunca http.DefaultClient).
+func newGraphHTTPClient() *http.Client {
+	return &http.Client{
+		Timeout: 15 * time.Second,
+		Transport: &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+			DialContext: (&net.Dialer{
+				Timeout:   5 * time.Second,
+				KeepAlive: 30 * time.Second,
+			}).DialContext,
+			TLSHandshakeTimeout:   5 * time.Second,
+			ResponseHeaderTimeout: 10 * time.Second,
+			MaxIdleConns:          100,
+			MaxIdleConnsPerHost:   20,
+			IdleConnTimeout:       90 * time.Second,
+		},
+	}
+}
+
+// backoffDelay: exponencial con "full jitter" (rand entre 0 y base*2^attempt, con tope).
+// Si Meta manda Retry-After lo respetamos, pero el envío corre dentro del webhook con el lock de
+// la sesión tomado: si pide esperar más que graphBackoffMax devuelve ok=false y no se reintenta
+// (el error sigue por on_send_failed).
+func backoffDelay(attempt int, retryAfter string) (d time.Duration, ok bool) {
+	if secs, err := strconv.Atoi(retryAfter); err == nil && secs > 0 {
+		d = time.Duration(secs) * time.Second
+		return d, d <= graphBackoffMax
+	}
+	d = graphBackoffBase << attempt
+	if d > graphBackoffMax || d <= 0 {
+		d = graphBackoffMax
+	}
+	return time.Duration(rand.Int63n(int64(d)) + 1), true
+}
+
+// isRetryableNetErr: solo errores en los que el request seguro no salió (no se pudo conectar:
+// DNS, connection refused, timeout de conexión). Un timeout esperando la respuesta no se
+// reintenta: Graph pudo haber recibido el POST y el usuario recibiría el mensaje duplicado.
+func isRetryableNetErr(err error) bool {
+	var oe *net.OpError
+	return errors.As(err, &oe) && oe.Op == "dial"
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestMetaAPIErrorKind(t *testing.T) {
+	tests := []struct {
+		status, code int
+		want         MetaErrorKind
+		retryable    bool
+	}{
+		{http.StatusUnauthorized, 190, MetaErrAuth, false},
+		{http.StatusBadRequest, 131056, MetaErrRateLimited, true},
+		{http.StatusBadRequest, 130429, MetaErrRateLimited, true},
+		{http.StatusInternalServerError, 131000, MetaErrTransient, true},
+		{http.StatusBadRequest, 131026, MetaErrRecipientUnreachable, false},
+		{http.StatusBadRequest, 131047, MetaErrReEngagement, false},
+		{http.StatusBadRequest, 100, MetaErrInvalidRequest, false},
+		// código desconocido: decide el HTTP status
+		{http.StatusUnauthorized, 0, MetaErrAuth, false},
+		{http.StatusTooManyRequests, 0, MetaErrRateLimited, true},
+		{http.StatusBadGateway, 999999, MetaErrTransient, true},
+		{http.StatusBadRequest, 999999, MetaErrUnknown, false},
+	}
+	for _, tt := range tests {
+		e := &MetaAPIError{HTTPStatus: tt.status, Code: tt.code}
+		if got := e.Kind(); got != tt.want || e.Retryable() != tt.retryable {
+			t.Errorf("http=%d code=%d: kind=%s retryable=%v, esperaba %s/%v", tt.status, tt.code, got, e.Retryable(), tt.want, tt.retryable)
+		}
+	}
+}
+
+func TestParseMetaError(t *testing.T) {
+	body := []byte(`{"error":{"message":"Re-engagement message","type":"OAuthException","code":131047,"error_subcode":2494010,"error_data":{"details":"más de 24 horas"},"fbtrace_id":"Abc"}}`)
+	e := parseMetaError(http.StatusBadRequest, body)
+	if e.Code != 131047 || e.Subcode != 2494010 || e.Details != "más de 24 horas" || e.FBTraceID != "Abc" || e.Kind() != MetaErrReEngagement {
+		t.Errorf("error = %+v", e)
+	}
+
+	e = parseMetaError(http.StatusBadGateway, []byte("<html>bad gateway</html>"))
+	if e.Code != 0 || e.Message != "<html>bad gateway</html>" || e.Kind() != MetaErrTransient {
+		t.Errorf("body no JSON = %+v", e)
+	}
+
+	wrapped := fmt.Errorf("enviando template: %w", &MetaAPIError{HTTPStatus: http.StatusBadRequest, Code: 131026})
+	if k := metaErrorKind(wrapped); k != MetaErrRecipientUnreachable {
+		t.Errorf("metaErrorKind(envuelto) = %s", k)
+	}
+	if k := metaErrorKind(errors.New("otra cosa")); k != MetaErrUnknown {
+		t.Errorf("metaErrorKind(otro) = %s", k)
+	}
+}
+
+func TestBackoffDelay(t *testing.T) {
+	tests := []struct {
+		name       string
+		attempt    int
+		retryAfter string
+		max        time.Duration // el jitter va de 1ns a max
+		exact      bool
+		ok         bool
+	}{
+		{"primer intento", 0, "", graphBackoffBase, false, true},
+		{"tercer intento", 2, "", graphBackoffBase << 2, false, true},
+		{"tope", 10, "", graphBackoffMax, false, true},
+		{"sin overflow", 70, "", graphBackoffMax, false, true},
+		{"Retry-After dentro del tope", 0, "3", 3 * time.Second, true, true},
+		{"Retry-After igual al tope", 0, "8", graphBackoffMax, true, true},
+		{"Retry-After mayor al tope", 0, "60", time.Minute, true, false},
+		{"Retry-After inválido", 1, "mañana", graphBackoffBase << 1, false, true},
+		{"Retry-After cero", 1, "0", graphBackoffBase << 1, false, true},
+	}
+	for _, tt := range tests {
+		for i := 0; i < 50; i++ {
+			d, ok := backoffDelay(tt.attempt, tt.retryAfter)
+			if ok != tt.ok || d <= 0 || d > tt.max || (tt.exact && d != tt.max) {
+				t.Fatalf("%s: backoffDelay = %v, %v; esperaba <= %v (exacto %v), ok=%v", tt.name, d, ok, tt.max, tt.exact, tt.ok)
+			}
+		}
+	}
+}
+
+func TestIsRetryableNetErr(t *testing.T) {
+	dial := &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+	read := &net.OpError{Op: "read", Net: "tcp", Err: errors.New("connection reset by peer")}
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"dial", dial, true},
+		{"dial dentro de url.Error", &url.Error{Op: "Post", URL: "https://graph.facebook.com", Err: dial}, true},
+		{"DNS", &net.OpError{Op: "dial", Net: "tcp", Err: &net.DNSError{Err: "no such host", Name: "graph.facebook.com"}}, true},
+		{"read: el POST pudo haber llegado", &url.Error{Op: "Post", URL: "https://graph.facebook.com", Err: read}, false},
+		{"timeout esperando la respuesta", &url.Error{Op: "Post", URL: "https://graph.facebook.com", Err: context.DeadlineExceeded}, false},
+		{"error de Meta", &MetaAPIError{HTTPStatus: http.StatusInternalServerError}, false},
+		{"nil", nil, false},
+	}
+	for _, tt := range tests {
+		if got := isRetryableNetErr(tt.err); got != tt.want {
+			t.Errorf("%s: %v, esperaba %v", tt.name, got, tt.want)
+		}
+	}
+}
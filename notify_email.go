@@ -0,0 +1,452 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ---------------------
+// Notificaciones por email al equipo del tenant
+// ---------------------
+
+// SMTPConfig: servidor de salida del tenant (tenants.json -> smtp).
+type SMTPConfig struct {
+	Host     string `json:"host"`
+	Port     int    `json:"port"`
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"` // secret ref: "env:VAR" / "file:/path"
+	From     string `json:"from"`               // ej: "Coberser Bot <bot@coberser.com.ar>"
+	// Security: "starttls" (default, puerto 587), "tls" (465) o "none" (solo para un SMTP local de prueba)
+	Security string `json:"security,omitempty"`
+
+	password string
+}
+
+// EmailNotification: destinatarios y template de un evento (tenants.json -> email_notifications).
+// La clave es un evento de webhook (lead.created, claim.created, ...) o el email_event de una
+// action notify_email. Subject y body se renderizan con las vars de la conversación; sin body
+// se listan todas.
+type EmailNotification struct {
+	To          []string `json:"to"`
+	Subject     string   `json:"subject,omitempty"`
+	Body        string   `json:"body,omitempty"`
+	AttachMedia bool     `json:"attach_media,omitempty"` // adjunta imágenes/documentos que mandó el usuario
+}
+
+const (
+	smtpTimeout        = 15 * time.Second
+	maxEmailAttachment = 20 << 20 // total por email
+)
+
+// Espera antes de cada reintento de envío.
+var emailRetryDelays = []time.Duration{10 * time.Second, time.Minute}
+
+// mediaClients lo setea NewApp: hace falta para bajar de Meta los adjuntos a reenviar.
+var mediaClients *WhatsAppClients
+
+// actionNotifyEmail manda el email del evento indicado en action_params.email_event
+// (ej: "case_review") con lo capturado en la conversación. El envío sigue en background.
+// Vars: email_event
+func actionNotifyEmail(tenant, userID string, session *UserSession) (map[string]string, error) {
+	event := strings.TrimSpace(session.Data["email_event"])
+	if event == "" {
+		return nil, fmt.Errorf("notify_email sin action_params.email_event")
+	}
+	vars := emailVars(tenant, userID, event, session.Data, session.Inputs)
+
+	attached, err := notifyEmail(tenant, event, vars, session.PhoneID, session.PendingMedia)
+	if err != nil {
+		return nil, err
+	}
+	if attached {
+		session.PendingMedia = nil
+	}
+	return map[string]string{"email_event": event}, nil
+}
+
+// notifyEventEmail manda el email de un evento de webhook, si el tenant lo configuró.
+// En los siniestros se adjuntan los archivos del caso.
+func notifyEventEmail(ev TenantEvent, phoneID string) {
+	t, ok := tenantConfig(ev.Tenant)
+	if !ok {
+		return
+	}
+	if _, ok := t.EmailNotifications[ev.Event]; !ok {
+		return
+	}
+	vars := emailVars(ev.Tenant, ev.WaID, ev.Event, ev.Attribution, ev.Inputs)
+	vars["name"] = ev.Name
+	for k, v := range ev.Data {
+		vars[k] = v
+	}
+	var media []MediaRef
+	if claimStore != nil { // nil sin NewApp (tests)
+		if c, ok := claimStore.Get(ev.Tenant, ev.Data["claim_number"]); ok {
+			media = c.Media
+		}
+	}
+	if _, err := notifyEmail(ev.Tenant, ev.Event, vars, phoneID, media); err != nil {
+		log.Printf("❌ email %s tenant=%s: %v", ev.Event, ev.Tenant, err)
+	}
+}
+
+func tenantConfig(tenant string) (*TenantConfig, bool) {
+	if tenantRegistry == nil {
+		return nil, false
+	}
+	return tenantRegistry.Config(tenant)
+}
+
+// emailVars junta lo de la conversación para el template (los inputs pisan a data).
+func emailVars(tenant, waID, event string, data, inputs map[string]string) map[string]string {
+	vars := map[string]string{}
+	for k, v := range data {
+		vars[k] = v
+	}
+	for k, v := range inputs {
+		vars[k] = v
+	}
+	vars["tenant"] = tenant
+	vars["wa_id"] = waID
+	vars["email_event"] = event
+	return vars
+}
+
+// notifyEmail arma el email del evento y lo envía en background (con reintentos).
+// Devuelve error solo si el tenant no tiene configurado el evento o el SMTP;
+// attached indica si se van a reenviar los adjuntos.
+func notifyEmail(tenant, event string, vars map[string]string, phoneID string, media []MediaRef) (attached bool, err error) {
+	t, ok := tenantConfig(tenant)
+	if !ok {
+		return false, fmt.Errorf("tenant %s sin config en %s", tenant, tenantsFile)
+	}
+	n, ok := t.EmailNotifications[event]
+	if !ok {
+		return false, fmt.Errorf("tenant %s no tiene email_notifications.%s", tenant, event)
+	}
+	if t.SMTP == nil {
+		return false, fmt.Errorf("tenant %s sin smtp configurado", tenant)
+	}
+	smtpCfg := *t.SMTP
+
+	subject := n.Subject
+	if subject == "" {
+		subject = "[{{tenant}}] {{email_event}}: {{name}} ({{wa_id}})"
+	}
+	// Los valores los escribe el usuario: nada de saltos de línea en el header
+	subject = strings.Join(strings.Fields(renderVars(subject, vars)), " ")
+	body := renderVars(n.Body, vars)
+	if n.Body == "" {
+		body = defaultEmailBody(vars)
+	}
+	if !n.AttachMedia {
+		media = nil
+	}
+	media = append([]MediaRef(nil), media...)
+
+	go func() {
+		files := fetchEmailAttachments(phoneID, media)
+		if len(files) < len(media) {
+			body += fmt.Sprintf("\n\n(%d adjunto(s) no se pudieron descargar de WhatsApp)", len(media)-len(files))
+		}
+		raw, err := buildEmail(smtpCfg.From, n.To, subject, body, files)
+		if err != nil {
+			log.Printf("❌ email %s tenant=%s: %v", event, tenant, err)
+			return
+		}
+
+		for attempt := 0; ; attempt++ {
+			err = sendSMTP(smtpCfg, n.To, raw)
+			if err == nil {
+				log.Printf("📧 Email %s tenant=%s enviado a %s (%d adjuntos)", event, tenant, strings.Join(n.To, ", "), len(files))
+				return
+			}
+			if attempt >= len(emailRetryDelays) {
+				break
+			}
+			log.Printf("⚠️ email %s tenant=%s intento %d: %v", event, tenant, attempt+1, err)
+			time.Sleep(emailRetryDelays[attempt])
+		}
+		alertOperator(tenant, fmt.Sprintf("no se pudo enviar el email %s a %s: %v", event, strings.Join(n.To, ", "), err))
+	}()
+	return len(media) > 0, nil
+}
+
+func defaultEmailBody(vars map[string]string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Evento %s de %s (%s)\n\n", vars["email_event"], vars["name"], vars["wa_id"])
+	keys := make([]string, 0, len(vars))
+	for k := range vars {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if k == "email_event" || k == "tenant" || vars[k] == "" {
+			continue
+		}
+		fmt.Fprintf(&b, "%s: %s\n", k, vars[k])
+	}
+	return b.String()
+}
+
+type emailAttachment struct {
+	Filename string
+	MimeType string
+	Data     []byte
+}
+
+// fetchEmailAttachments baja los adjuntos de Meta (los que fallan o exceden el tope se omiten).
+func fetchEmailAttachments(phoneID string, media []MediaRef) []emailAttachment {
+	if len(media) == 0 || mediaClients == nil {
+		return nil
+	}
+	wa, err := mediaClients.Get(phoneID)
+	if err != nil {
+		log.Printf("⚠️ adjuntos email: %v", err)
+		return nil
+	}
+	var files []emailAttachment
+	total := 0
+	for i, m := range media {
+		data, mimeType, err := wa.downloadMedia(m.ID)
+		if err != nil {
+			log.Printf("⚠️ adjunto %s no disponible: %v", m.ID, err)
+			continue
+		}
+		if total+len(data) > maxEmailAttachment {
+			log.Printf("⚠️ adjunto %s omitido: el email supera %d bytes", m.ID, maxEmailAttachment)
+			continue
+		}
+		total += len(data)
+		if mimeType == "" {
+			mimeType = m.MimeType
+		}
+		name := m.Filename
+		if name == "" {
+			name = fmt.Sprintf("%s-%d%s", m.Type, i+1, extensionFor(mimeType))
+		}
+		files = append(files, emailAttachment{Filename: name, MimeType: mimeType, Data: data})
+	}
+	return files
+}
+
+// Extensiones de lo que suele llegar por WhatsApp (mime.ExtensionsByType devuelve ".jfif" para jpeg).
+var mediaExtensions = map[string]string{
+	"image/jpeg":      ".jpg",
+	"image/png":       ".png",
+	"image/webp":      ".webp",
+	"video/mp4":       ".mp4",
+	"application/pdf": ".pdf",
+}
+
+func extensionFor(mimeType string) string {
+	if ext, ok := mediaExtensions[mimeType]; ok {
+		return ext
+	}
+	if exts, _ := mime.ExtensionsByType(mimeType); len(exts) > 0 {
+		return exts[0]
+	}
+	return ""
+}
+
+// buildEmail arma el mensaje MIME (texto UTF-8 + adjuntos).
+func buildEmail(from string, to []string, subject, body string, files []emailAttachment) ([]byte, error) {
+	var buf bytes.Buffer
+	header := func(k, v string) { fmt.Fprintf(&buf, "%s: %s\r\n", k, v) }
+
+	header("From", from)
+	header("To", strings.Join(to, ", "))
+	header("Subject", mime.QEncoding.Encode("utf-8", subject))
+	header("Date", time.Now().Format(time.RFC1123Z))
+	header("Message-ID", "<"+randomToken()+"@flowly>")
+	header("MIME-Version", "1.0")
+
+	writeText := func() error {
+		fmt.Fprintf(&buf, "Content-Type: text/plain; charset=utf-8\r\nContent-Transfer-Encoding: quoted-printable\r\n\r\n")
+		qp := quotedprintable.NewWriter(&buf)
+		// El body puede venir con \r\n (texto pegado del usuario): normalizamos antes de pasar a CRLF
+		text := strings.NewReplacer("\r\n", "\n", "\r", "\n").Replace(body)
+		if _, err := qp.Write([]byte(strings.ReplaceAll(text, "\n", "\r\n"))); err != nil {
+			return err
+		}
+		if err := qp.Close(); err != nil {
+			return err
+		}
+		buf.WriteString("\r\n")
+		return nil
+	}
+
+	if len(files) == 0 {
+		if err := writeText(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+
+	boundary := "flowly-" + randomToken()
+	header("Content-Type", `multipart/mixed; boundary="`+boundary+`"`)
+	buf.WriteString("\r\n--" + boundary + "\r\n")
+	if err := writeText(); err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		buf.WriteString("--" + boundary + "\r\n")
+		header("Content-Type", f.MimeType)
+		header("Content-Transfer-Encoding", "base64")
+		header("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": f.Filename}))
+		buf.WriteString("\r\n")
+		enc := base64.StdEncoding.EncodeToString(f.Data)
+		for len(enc) > 76 {
+			buf.WriteString(enc[:76] + "\r\n")
+			enc = enc[76:]
+		}
+		buf.WriteString(enc + "\r\n")
+	}
+	buf.WriteString("--" + boundary + "--\r\n")
+	return buf.Bytes(), nil
+}
+
+func randomToken() string {
+	b := make([]byte, 12)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// sendSMTP entrega el mensaje con el SMTP del tenant (con timeout, STARTTLS obligatorio salvo security "tls"/"none").
+func sendSMTP(cfg SMTPConfig, to []string, raw []byte) error {
+	from, err := mail.ParseAddress(cfg.From)
+	if err != nil {
+		return fmt.Errorf("smtp.from inválido: %w", err)
+	}
+	addr := net.JoinHostPort(cfg.Host, strconv.Itoa(cfg.Port))
+	dialer := &net.Dialer{Timeout: smtpTimeout}
+
+	var conn net.Conn
+	if cfg.Security == "tls" {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, &tls.Config{ServerName: cfg.Host})
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return fmt.Errorf("smtp %s: %w", addr, err)
+	}
+	_ = conn.SetDeadline(time.Now().Add(2 * smtpTimeout))
+
+	c, err := smtp.NewClient(conn, cfg.Host)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("smtp %s: %w", addr, err)
+	}
+	defer c.Close()
+
+	if cfg.Security == "" || cfg.Security == "starttls" {
+		if err := c.StartTLS(&tls.Config{ServerName: cfg.Host}); err != nil {
+			return fmt.Errorf("smtp %s: STARTTLS: %w", addr, err)
+		}
+	}
+	if cfg.Username != "" {
+		if err := c.Auth(smtp.PlainAuth("", cfg.Username, cfg.password, cfg.Host)); err != nil {
+			return fmt.Errorf("smtp %s: auth: %w", addr, err)
+		}
+	}
+	if err := c.Mail(from.Address); err != nil {
+		return err
+	}
+	for _, rcpt := range to {
+		a, err := mail.ParseAddress(rcpt)
+		if err != nil {
+			return err
+		}
+		if err := c.Rcpt(a.Address); err != nil {
+			return fmt.Errorf("smtp rcpt %s: %w", a.Address, err)
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(raw); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	// El server ya aceptó el DATA: un error en QUIT no es motivo para reintentar (duplicaría el email)
+	if err := c.Quit(); err != nil {
+		log.Printf("⚠️ smtp %s: QUIT: %v (el mensaje ya fue aceptado)", addr, err)
+	}
+	return nil
+}
+
+// validateNotifyEmail: un estado con action notify_email tiene que apuntar a un email_event que
+// el tenant tenga en email_notifications (si no, cada vez que se pasa por ahí falla y nadie se entera).
+func validateNotifyEmail(tenant, stateName string, st FlowState) []string {
+	if st.Action != "notify_email" {
+		return nil
+	}
+	event := strings.TrimSpace(st.ActionParams["email_event"])
+	if event == "" {
+		return []string{fmt.Sprintf("state=%s notify_email sin action_params.email_event", stateName)}
+	}
+	if strings.Contains(event, "{{") {
+		return nil
+	}
+	t, ok := tenantConfig(tenant)
+	if !ok || t.SMTP == nil {
+		return []string{fmt.Sprintf("state=%s notify_email: el tenant %s no tiene smtp en %s", stateName, tenant, tenantsFile)}
+	}
+	if _, ok := t.EmailNotifications[event]; !ok {
+		return []string{fmt.Sprintf("state=%s notify_email: el tenant %s no tiene email_notifications.%s", stateName, tenant, event)}
+	}
+	return nil
+}
+
+// validateEmailConfig valida smtp + email_notifications del tenant y resuelve la contraseña.
+func validateEmailConfig(t *TenantConfig) []string {
+	var errs []string
+	if s := t.SMTP; s != nil {
+		if strings.TrimSpace(s.Host) == "" || s.Port <= 0 {
+			errs = append(errs, fmt.Sprintf("tenant=%s smtp requiere host y port", t.ID))
+		}
+		if _, err := mail.ParseAddress(s.From); err != nil {
+			errs = append(errs, fmt.Sprintf("tenant=%s smtp.from inválido %q", t.ID, s.From))
+		}
+		switch s.Security {
+		case "", "starttls", "tls", "none":
+		default:
+			errs = append(errs, fmt.Sprintf("tenant=%s smtp.security inválido %q (starttls|tls|none)", t.ID, s.Security))
+		}
+		var err error
+		if s.password, err = resolveSecret(s.Password); err != nil {
+			log.Printf("⚠️ tenant=%s smtp.password no resuelto (%v): los emails van a fallar", t.ID, err)
+		}
+	} else if len(t.EmailNotifications) > 0 {
+		errs = append(errs, fmt.Sprintf("tenant=%s tiene email_notifications pero no smtp", t.ID))
+	}
+
+	for event, n := range t.EmailNotifications {
+		if len(n.To) == 0 {
+			errs = append(errs, fmt.Sprintf("tenant=%s email_notifications.%s sin destinatarios", t.ID, event))
+		}
+		for _, to := range n.To {
+			if _, err := mail.ParseAddress(to); err != nil {
+				errs = append(errs, fmt.Sprintf("tenant=%s email_notifications.%s destinatario inválido %q", t.ID, event, to))
+			}
+		}
+	}
+	return errs
+}
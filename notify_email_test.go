@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeSMTP es un SMTP local mínimo (sin TLS ni auth) que guarda los mensajes que acepta.
+// Con dropQuit corta la conexión al recibir QUIT, como un server que se cae después del DATA.
+type fakeSMTP struct {
+	ln       net.Listener
+	dropQuit bool
+
+	mu       sync.Mutex
+	messages []smtpMessage
+}
+
+type smtpMessage struct {
+	From string
+	To   []string
+	Data []byte
+}
+
+func newFakeSMTP(t *testing.T, dropQuit bool) *fakeSMTP {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeSMTP{ln: ln, dropQuit: dropQuit}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *fakeSMTP) config() SMTPConfig {
+	addr := s.ln.Addr().(*net.TCPAddr)
+	return SMTPConfig{Host: "127.0.0.1", Port: addr.Port, From: "Bot <bot@example.com>", Security: "none"}
+}
+
+func (s *fakeSMTP) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	reply := func(line string) { _, _ = io.WriteString(conn, line+"\r\n") }
+
+	var msg smtpMessage
+	reply("220 fake ESMTP")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		cmd := strings.TrimSpace(line)
+		switch upper := strings.ToUpper(cmd); {
+		case strings.HasPrefix(upper, "EHLO"), strings.HasPrefix(upper, "HELO"):
+			reply("250 fake")
+		case strings.HasPrefix(upper, "MAIL FROM:"):
+			msg.From = strings.Trim(cmd[len("MAIL FROM:"):], "<> ")
+			reply("250 ok")
+		case strings.HasPrefix(upper, "RCPT TO:"):
+			msg.To = append(msg.To, strings.Trim(cmd[len("RCPT TO:"):], "<> "))
+			reply("250 ok")
+		case upper == "DATA":
+			reply("354 go ahead")
+			var data bytes.Buffer
+			for {
+				l, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if l == ".\r\n" {
+					break
+				}
+				data.WriteString(strings.TrimPrefix(l, "."))
+			}
+			msg.Data = data.Bytes()
+			s.mu.Lock()
+			s.messages = append(s.messages, msg)
+			s.mu.Unlock()
+			msg = smtpMessage{}
+			reply("250 queued")
+		case upper == "QUIT":
+			if s.dropQuit {
+				return
+			}
+			reply("221 bye")
+			return
+		default:
+			reply("250 ok")
+		}
+	}
+}
+
+func (s *fakeSMTP) received() []smtpMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]smtpMessage(nil), s.messages...)
+}
+
+func TestBuildEmailPlainText(t *testing.T) {
+	raw, err := buildEmail("Bot <bot@example.com>", []string{"staff@example.com"}, "Nuevo caso ñandú", "Hola\nDNI: 12345678", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	subject, _ := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject"))
+	if subject != "Nuevo caso ñandú" || msg.Header.Get("To") != "staff@example.com" {
+		t.Errorf("headers = %v (subject %q)", msg.Header, subject)
+	}
+	body, _ := io.ReadAll(quotedprintable.NewReader(msg.Body))
+	if strings.TrimRight(string(body), "\r\n") != "Hola\r\nDNI: 12345678" {
+		t.Errorf("body = %q", body)
+	}
+}
+
+func TestBuildEmailNormalizesLineEndings(t *testing.T) {
+	raw, err := buildEmail("bot@example.com", []string{"staff@example.com"}, "Caso", "Hola\r\nDNI: 1\rPatente: AB123CD\n", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(raw, []byte("\r\r")) {
+		t.Errorf("quedó un \\r duplicado: %q", raw)
+	}
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(quotedprintable.NewReader(msg.Body))
+	if strings.TrimRight(string(body), "\r\n") != "Hola\r\nDNI: 1\r\nPatente: AB123CD" {
+		t.Errorf("body = %q", body)
+	}
+}
+
+func TestBuildEmailWithAttachments(t *testing.T) {
+	photo := bytes.Repeat([]byte{0xff, 0xd8, 0x00, 0x42}, 100)
+	raw, err := buildEmail("bot@example.com", []string{"a@example.com", "b@example.com"}, "Siniestro", "Ver adjuntos", []emailAttachment{
+		{Filename: "foto 1.jpg", MimeType: "image/jpeg", Data: photo},
+		{Filename: "denuncia.pdf", MimeType: "application/pdf", Data: []byte("%PDF-1.4")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/mixed" {
+		t.Fatalf("Content-Type = %q (%v)", msg.Header.Get("Content-Type"), err)
+	}
+
+	mr := multipart.NewReader(msg.Body, params["boundary"])
+	var parts []*multipart.Part
+	var contents [][]byte
+	for {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		// multipart.Reader decodifica quoted-printable solo; base64 no
+		b, _ := io.ReadAll(p)
+		parts = append(parts, p)
+		contents = append(contents, b)
+	}
+	if len(parts) != 3 {
+		t.Fatalf("partes = %d, esperaba texto + 2 adjuntos", len(parts))
+	}
+	if string(contents[0]) != "Ver adjuntos" {
+		t.Errorf("texto = %q", contents[0])
+	}
+	if parts[1].FileName() != "foto 1.jpg" || parts[1].Header.Get("Content-Type") != "image/jpeg" {
+		t.Errorf("adjunto = %v", parts[1].Header)
+	}
+	decoded, err := io.ReadAll(base64.NewDecoder(base64.StdEncoding, bytes.NewReader(contents[1])))
+	if err != nil || !bytes.Equal(decoded, photo) {
+		t.Errorf("el adjunto no coincide (%v)", err)
+	}
+	for _, line := range strings.Split(string(contents[1]), "\r\n") {
+		if len(line) > 76 {
+			t.Fatalf("línea base64 de %d caracteres (máx 76)", len(line))
+		}
+	}
+	if parts[2].FileName() != "denuncia.pdf" {
+		t.Errorf("adjunto = %v", parts[2].Header)
+	}
+}
+
+func TestSendSMTP(t *testing.T) {
+	srv := newFakeSMTP(t, false)
+	raw, _ := buildEmail("bot@example.com", []string{"staff@example.com"}, "Hola", "Cuerpo", nil)
+	if err := sendSMTP(srv.config(), []string{"Staff <staff@example.com>"}, raw); err != nil {
+		t.Fatal(err)
+	}
+
+	got := srv.received()
+	if len(got) != 1 || got[0].From != "bot@example.com" || len(got[0].To) != 1 || got[0].To[0] != "staff@example.com" {
+		t.Fatalf("recibidos = %+v", got)
+	}
+	if !bytes.Contains(got[0].Data, []byte("Subject: Hola")) {
+		t.Errorf("DATA = %s", got[0].Data)
+	}
+}
+
+func TestSendSMTPIgnoresQuitErrorAfterData(t *testing.T) {
+	srv := newFakeSMTP(t, true)
+	raw, _ := buildEmail("bot@example.com", []string{"staff@example.com"}, "Hola", "Cuerpo", nil)
+	if err := sendSMTP(srv.config(), []string{"staff@example.com"}, raw); err != nil {
+		t.Fatalf("con el DATA aceptado no debería fallar (se reenviaría duplicado): %v", err)
+	}
+	if n := len(srv.received()); n != 1 {
+		t.Errorf("mensajes recibidos = %d", n)
+	}
+}
+
+func TestNotifyEventEmailSendsConfiguredEvent(t *testing.T) {
+	srv := newFakeSMTP(t, false)
+	cfg := srv.config()
+	withTenants(t, &TenantConfig{
+		ID:   "broker",
+		SMTP: &cfg,
+		EmailNotifications: map[string]EmailNotification{
+			EventLeadCreated: {To: []string{"ventas@example.com"}, Subject: "Lead de {{name}}", Body: "Tel: {{wa_id}}\nEmail: {{email}}"},
+		},
+	})
+
+	notifyEventEmail(TenantEvent{Event: EventLeadCreated, Tenant: "broker", WaID: "5491100000000", Name: "Ana", Inputs: map[string]string{"email": "ana@example.com"}}, "")
+	notifyEventEmail(TenantEvent{Event: EventHandoffRequested, Tenant: "broker", WaID: "5491100000000"}, "")
+	waitFor(t, "el email", func() bool { return len(srv.received()) == 1 })
+
+	msg, err := mail.ReadMessage(bytes.NewReader(srv.received()[0].Data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(quotedprintable.NewReader(msg.Body))
+	if msg.Header.Get("Subject") != "Lead de Ana" || !strings.Contains(string(body), "Email: ana@example.com") {
+		t.Errorf("email = %v / %q", msg.Header, body)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if n := len(srv.received()); n != 1 {
+		t.Errorf("handoff.requested no está configurado y llegaron %d emails", n)
+	}
+}
+
+func TestValidateNotifyEmail(t *testing.T) {
+	st := FlowState{Action: "notify_email", ActionParams: map[string]string{"email_event": "case_review"}}
+	withTenants(t, &TenantConfig{ID: "broker"})
+	if errs := validateNotifyEmail("broker", "CASE_REVIEW_TEXT", st); len(errs) != 1 {
+		t.Errorf("tenant sin smtp: %v", errs)
+	}
+
+	withTenants(t, &TenantConfig{ID: "broker", SMTP: &SMTPConfig{Host: "localhost", Port: 25}, EmailNotifications: map[string]EmailNotification{"case_review": {To: []string{"a@example.com"}}}})
+	if errs := validateNotifyEmail("broker", "CASE_REVIEW_TEXT", st); len(errs) != 0 {
+		t.Errorf("evento configurado: %v", errs)
+	}
+	st.ActionParams["email_event"] = "otro"
+	if errs := validateNotifyEmail("broker", "CASE_REVIEW_TEXT", st); len(errs) != 1 {
+		t.Errorf("evento no configurado: %v", errs)
+	}
+}
@@ -0,0 +1,378 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ---------------------
+// Pólizas y pagos (padrón exportado por el sistema de gestión del broker)
+// ---------------------
+
+// El padrón es un CSV en configs/{tenant}/data/policies.csv (export nocturno; no se versiona,
+// policies.example.csv muestra el formato con datos ficticios). Columnas reconocidas
+// (encabezado obligatorio, orden libre, las demás se ignoran):
+//
+//	policy_number,dni,holder,plate,email,phone,company,line,coverage,start_date,expiry_date,
+//	status,next_due_date,next_due_amount,payment_status
+//
+// Las fechas pueden venir como YYYY-MM-DD o DD/MM/YYYY.
+const (
+	policiesFile = "policies.csv"
+
+	maxPoliciesInLookup = 3
+
+	// Un registro coincide solo si el mensaje trae al menos dos de sus identificadores
+	// (DNI, patente, Nº de póliza, email); el teléfono del registro igual al wa_id cuenta como uno.
+	minPolicyMatches = 2
+
+	policyLookupNoMatch     = "No encontré pólizas con esos datos 🤔\nRevisá que estén el *DNI* y la *patente* o el *Nº de póliza* del titular."
+	policyLookupUnavailable = "En este momento no puedo consultar las pólizas 🙏\nUn asesor te va a responder con la información."
+)
+
+type Policy struct {
+	Number        string `json:"policy_number"`
+	DNI           string `json:"dni"`
+	Holder        string `json:"holder"`
+	Plate         string `json:"plate"`
+	Email         string `json:"email"`
+	Phone         string `json:"phone"`
+	Company       string `json:"company"`
+	Line          string `json:"line"`
+	Coverage      string `json:"coverage"`
+	StartDate     string `json:"start_date"`
+	ExpiryDate    string `json:"expiry_date"`
+	Status        string `json:"status"`
+	NextDueDate   string `json:"next_due_date"`
+	NextDueAmount string `json:"next_due_amount"`
+	PaymentStatus string `json:"payment_status"`
+}
+
+// policyDataset es el padrón cargado de un tenant; se relee cuando cambia el archivo (mtime/tamaño).
+type policyDataset struct {
+	modTime  time.Time
+	size     int64
+	policies []Policy
+}
+
+type PolicyStore struct {
+	mu      sync.Mutex
+	root    string
+	data    map[string]*policyDataset
+	alerted map[string]bool // tenant -> ya se avisó al operador que falta el padrón
+}
+
+func NewPolicyStore(root string) *PolicyStore {
+	return &PolicyStore{root: root, data: make(map[string]*policyDataset), alerted: make(map[string]bool)}
+}
+
+var policyStore = NewPolicyStore(configRoot)
+
+// Policies devuelve el padrón del tenant. Si el export nocturno reemplazó el archivo, se recarga.
+func (s *PolicyStore) Policies(tenant string) ([]Policy, error) {
+	if strings.ContainsAny(tenant, `/\.`) {
+		return nil, fmt.Errorf("tenant inválido %q", tenant)
+	}
+	path := filepath.Join(s.root, tenant, "data", policiesFile)
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		s.mu.Lock()
+		alert := !s.alerted[tenant]
+		s.alerted[tenant] = true
+		s.mu.Unlock()
+		if alert {
+			alertOperator(tenant, fmt.Sprintf("falta el padrón de pólizas %s: las consultas de pólizas y pagos no funcionan hasta subir el export", path))
+		}
+		return nil, fmt.Errorf("falta el padrón de pólizas %s (formato en policies.example.csv)", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("no hay padrón de pólizas para %s: %w", tenant, err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.alerted, tenant)
+	if ds, ok := s.data[tenant]; ok && ds.modTime.Equal(info.ModTime()) && ds.size == info.Size() {
+		return ds.policies, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	policies, err := readPoliciesCSV(f)
+	if err != nil {
+		return nil, fmt.Errorf("csv de pólizas inválido en %s: %w", path, err)
+	}
+	s.data[tenant] = &policyDataset{modTime: info.ModTime(), size: info.Size(), policies: policies}
+	log.Printf("📑 Padrón de pólizas cargado tenant=%s (%d pólizas)", tenant, len(policies))
+	return policies, nil
+}
+
+func readPoliciesCSV(r io.Reader) ([]Policy, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	cr.TrimLeadingSpace = true
+
+	header, err := cr.Read()
+	if err != nil {
+		return nil, fmt.Errorf("falta el encabezado: %w", err)
+	}
+	cols := map[string]int{}
+	for i, h := range header {
+		cols[strings.ToLower(strings.TrimSpace(strings.TrimPrefix(h, "\ufeff")))] = i
+	}
+	if _, ok := cols["policy_number"]; !ok {
+		return nil, fmt.Errorf("falta la columna policy_number")
+	}
+
+	policies := []Policy{}
+	for {
+		rec, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		get := func(col string) string {
+			if i, ok := cols[col]; ok && i < len(rec) {
+				return strings.TrimSpace(rec[i])
+			}
+			return ""
+		}
+		p := Policy{
+			Number:        get("policy_number"),
+			DNI:           normalizeIdentifier(get("dni")),
+			Holder:        get("holder"),
+			Plate:         strings.ToUpper(get("plate")),
+			Email:         strings.ToLower(get("email")),
+			Phone:         get("phone"),
+			Company:       get("company"),
+			Line:          get("line"),
+			Coverage:      get("coverage"),
+			StartDate:     get("start_date"),
+			ExpiryDate:    get("expiry_date"),
+			Status:        get("status"),
+			NextDueDate:   get("next_due_date"),
+			NextDueAmount: get("next_due_amount"),
+			PaymentStatus: get("payment_status"),
+		}
+		if p.Number == "" {
+			continue
+		}
+		policies = append(policies, p)
+	}
+	return policies, nil
+}
+
+// normalizeIdentifier deja solo letras y números en mayúscula ("AB 123 CD" -> "AB123CD", "00-123456" -> "00123456").
+func normalizeIdentifier(s string) string {
+	var b strings.Builder
+	for _, r := range strings.ToUpper(s) {
+		if (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// queryIdentifiers arma los candidatos del mensaje: cada palabra normalizada, las combinaciones de
+// 2 y 3 palabras seguidas (patentes escritas con espacios) y los emails en minúscula.
+func queryIdentifiers(query string) map[string]bool {
+	ids := map[string]bool{}
+	var words []string
+	for _, f := range strings.FieldsFunc(query, func(r rune) bool {
+		return r == ' ' || r == '\n' || r == '\t' || r == ',' || r == ';' || r == ':'
+	}) {
+		if strings.Contains(f, "@") {
+			ids[strings.ToLower(strings.Trim(f, ".()<>"))] = true
+			continue
+		}
+		if w := normalizeIdentifier(f); w != "" {
+			words = append(words, w)
+		}
+	}
+	for i := range words {
+		joined := ""
+		for j := i; j < len(words) && j < i+3; j++ {
+			joined += words[j]
+			ids[joined] = true
+		}
+	}
+	if dni := findDNI(query); dni != "" {
+		ids[dni] = true
+	}
+	return ids
+}
+
+// matchPolicies devuelve las pólizas con al menos minPolicyMatches identificadores presentes en el mensaje.
+func matchPolicies(policies []Policy, query, waID string) []Policy {
+	ids := queryIdentifiers(query)
+	var out []Policy
+	for _, p := range policies {
+		n := 0
+		for _, v := range []string{p.DNI, normalizeIdentifier(p.Plate), normalizeIdentifier(p.Number)} {
+			if v != "" && ids[v] {
+				n++
+			}
+		}
+		if p.Email != "" && ids[p.Email] {
+			n++
+		}
+		if phone := normalizeIdentifier(p.Phone); len(phone) >= 8 && strings.HasSuffix(waID, phone) {
+			n++
+		}
+		if n >= minPolicyMatches {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+// formatPolicyDate muestra la fecha como DD/MM/YYYY (acepta YYYY-MM-DD o ya formateada).
+func formatPolicyDate(s string) string {
+	if t, err := time.Parse("2006-01-02", s); err == nil {
+		return t.Format("02/01/2006")
+	}
+	return s
+}
+
+func parsePolicyDate(s string, loc *time.Location) (time.Time, bool) {
+	for _, layout := range []string{"2006-01-02", "02/01/2006"} {
+		if t, err := time.ParseInLocation(layout, s, loc); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// paymentStatus usa payment_status del padrón; si no viene, lo deduce del próximo vencimiento.
+func paymentStatus(p Policy, now time.Time) string {
+	if p.PaymentStatus != "" {
+		return p.PaymentStatus
+	}
+	due, ok := parsePolicyDate(p.NextDueDate, now.Location())
+	if !ok {
+		return ""
+	}
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	if due.Before(today) {
+		return "vencida"
+	}
+	return "al día"
+}
+
+// policyVars expone la primera póliza encontrada para los templates del flow.
+func policyVars(p Policy, count int, now time.Time) map[string]string {
+	return map[string]string{
+		"policy_found":          "true",
+		"policy_count":          fmt.Sprint(count),
+		"policy_number":         p.Number,
+		"policy_holder":         p.Holder,
+		"policy_plate":          p.Plate,
+		"policy_company":        p.Company,
+		"policy_line":           p.Line,
+		"policy_coverage":       p.Coverage,
+		"policy_start":          formatPolicyDate(p.StartDate),
+		"policy_expiry":         formatPolicyDate(p.ExpiryDate),
+		"policy_status":         p.Status,
+		"policy_next_due_date":  formatPolicyDate(p.NextDueDate),
+		"policy_amount":         p.NextDueAmount,
+		"policy_payment_status": paymentStatus(p, now),
+	}
+}
+
+// lookupPolicies busca en el padrón con lo que mandó el usuario (save_as: policy_query).
+// Si el padrón no está disponible devuelve ok=false: la conversación sigue con un texto de disculpa.
+func lookupPolicies(tenant, userID string, session *UserSession) (matches []Policy, ok bool) {
+	policies, err := policyStore.Policies(tenant)
+	if err != nil {
+		log.Printf("❌ Consulta de pólizas tenant=%s: %v", tenant, err)
+		return nil, false
+	}
+	matches = matchPolicies(policies, session.Inputs["policy_query"], userID)
+	log.Printf("📑 Consulta de pólizas tenant=%s wa_id=%s: %d coincidencias", tenant, userID, len(matches))
+	return matches, true
+}
+
+// actionPolicyLookup busca las pólizas del usuario por DNI + patente / Nº de póliza / email.
+// Vars: policy_found, policy_count, policy_number, policy_holder, policy_plate, policy_company,
+// policy_line, policy_coverage, policy_start, policy_expiry, policy_status, policy_next_due_date,
+// policy_amount, policy_payment_status, policy_text (resumen de hasta maxPoliciesInLookup pólizas)
+func actionPolicyLookup(tenant, userID string, session *UserSession) (map[string]string, error) {
+	matches, ok := lookupPolicies(tenant, userID, session)
+	if !ok {
+		return map[string]string{"policy_found": "false", "policy_text": policyLookupUnavailable}, nil
+	}
+	if len(matches) == 0 {
+		return map[string]string{"policy_found": "false", "policy_text": policyLookupNoMatch}, nil
+	}
+
+	now := time.Now().In(tenantLocation(tenant))
+	vars := policyVars(matches[0], len(matches), now)
+	if len(matches) > maxPoliciesInLookup {
+		matches = matches[:maxPoliciesInLookup]
+	}
+	var parts []string
+	for _, p := range matches {
+		part := fmt.Sprintf("📄 Póliza *%s*", p.Number)
+		if p.Line != "" {
+			part += " (" + p.Line + ")"
+		}
+		if p.Plate != "" {
+			part += "\nPatente: " + p.Plate
+		}
+		part += fmt.Sprintf("\nCompañía: %s\nCobertura: %s\nVigencia hasta: %s", p.Company, p.Coverage, formatPolicyDate(p.ExpiryDate))
+		if p.Status != "" {
+			part += "\nEstado: *" + p.Status + "*"
+		}
+		parts = append(parts, part)
+	}
+	vars["policy_text"] = strings.Join(parts, "\n\n")
+	return vars, nil
+}
+
+// actionPaymentLookup usa la misma búsqueda que actionPolicyLookup y resume cuotas/vencimientos.
+// Vars: las de actionPolicyLookup + payment_text
+func actionPaymentLookup(tenant, userID string, session *UserSession) (map[string]string, error) {
+	matches, ok := lookupPolicies(tenant, userID, session)
+	if !ok {
+		return map[string]string{"policy_found": "false", "payment_text": policyLookupUnavailable}, nil
+	}
+	if len(matches) == 0 {
+		return map[string]string{"policy_found": "false", "payment_text": policyLookupNoMatch}, nil
+	}
+
+	now := time.Now().In(tenantLocation(tenant))
+	vars := policyVars(matches[0], len(matches), now)
+	if len(matches) > maxPoliciesInLookup {
+		matches = matches[:maxPoliciesInLookup]
+	}
+	var parts []string
+	for _, p := range matches {
+		part := fmt.Sprintf("💳 Póliza *%s*", p.Number)
+		if p.Plate != "" {
+			part += " (" + p.Plate + ")"
+		}
+		if p.NextDueDate == "" {
+			part += "\nNo tiene cuotas pendientes."
+		} else {
+			part += fmt.Sprintf("\nPróximo vencimiento: %s\nImporte: %s", formatPolicyDate(p.NextDueDate), p.NextDueAmount)
+		}
+		if st := paymentStatus(p, now); st != "" {
+			part += "\nEstado: *" + st + "*"
+		}
+		parts = append(parts, part)
+	}
+	vars["payment_text"] = strings.Join(parts, "\n\n")
+	return vars, nil
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPolicyStoreMissingFile(t *testing.T) {
+	s := NewPolicyStore(t.TempDir())
+	if _, err := s.Policies("broker"); err == nil || !strings.Contains(err.Error(), "falta el padrón") {
+		t.Errorf("err = %v", err)
+	}
+}
+
+func TestPolicyStoreLoadsExampleFormat(t *testing.T) {
+	b, err := os.ReadFile(filepath.Join(configRoot, "broker", "data", "policies.example.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "broker", "data"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "broker", "data", policiesFile), b, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	policies, err := NewPolicyStore(root).Policies("broker")
+	if err != nil || len(policies) == 0 {
+		t.Fatalf("pólizas = %d (%v)", len(policies), err)
+	}
+	if got := matchPolicies(policies, "DNI 12345678 patente AB 123 CD", ""); len(got) != 1 || got[0].Number != "00-123456" {
+		t.Errorf("coincidencias = %+v", got)
+	}
+}
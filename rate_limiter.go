@@ -0,0 +1,116 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ---------------------
+// Outbound rate limiting (token bucket por phone_number_id)
+// ---------------------
+
+// Meta permite ~80 msg/s por número en Cloud API; dejamos margen por defecto.
+const (
+	defaultMessagesPerSecond = 50
+	defaultBurst             = 50
+)
+
+// RateLimitConfig va en flow.json del tenant: "rate_limit": {"messages_per_second": 20, "burst": 10}
+type RateLimitConfig struct {
+	MessagesPerSecond float64 `json:"messages_per_second"`
+	Burst             int     `json:"burst"`
+}
+
+// RateLimiter es un token bucket: los envíos que exceden el ritmo quedan esperando (encolados)
+// en lugar de fallar con 130429.
+type RateLimiter struct {
+	mu     sync.Mutex
+	rate   float64 // tokens por segundo
+	burst  float64
+	tokens float64
+	last   time.Time
+
+	queued atomic.Int64
+}
+
+func NewRateLimiter(rate float64, burst int) *RateLimiter {
+	l := &RateLimiter{last: time.Now()}
+	l.configure(rate, burst)
+	l.tokens = l.burst
+	return l
+}
+
+func (l *RateLimiter) configure(rate float64, burst int) {
+	if rate <= 0 {
+		rate = defaultMessagesPerSecond
+	}
+	if burst <= 0 {
+		burst = defaultBurst
+	}
+	l.rate = rate
+	l.burst = float64(burst)
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+}
+
+// Configure aplica la config del tenant (nil = valores por defecto).
+func (l *RateLimiter) Configure(cfg *RateLimitConfig) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if cfg == nil {
+		l.configure(0, 0)
+		return
+	}
+	l.configure(cfg.MessagesPerSecond, cfg.Burst)
+}
+
+// refill asume l.mu tomado.
+func (l *RateLimiter) refill(now time.Time) {
+	elapsed := now.Sub(l.last).Seconds()
+	l.last = now
+	l.tokens += elapsed * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+}
+
+// Wait bloquea hasta que haya un token disponible.
+func (l *RateLimiter) Wait() {
+	l.queued.Add(1)
+	defer l.queued.Add(-1)
+
+	for {
+		l.mu.Lock()
+		l.refill(time.Now())
+		if l.tokens >= 1 {
+			l.tokens--
+			l.mu.Unlock()
+			return
+		}
+		wait := time.Duration((1 - l.tokens) / l.rate * float64(time.Second))
+		l.mu.Unlock()
+		time.Sleep(wait)
+	}
+}
+
+type RateLimiterStats struct {
+	MessagesPerSecond float64 `json:"messages_per_second"`
+	Burst             int     `json:"burst"`
+	Available         float64 `json:"available_tokens"`
+	Queued            int64   `json:"queued"`
+}
+
+func (l *RateLimiter) Stats() RateLimiterStats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.refill(time.Now())
+	return RateLimiterStats{
+		MessagesPerSecond: l.rate,
+		Burst:             int(l.burst),
+		Available:         l.tokens,
+		// Wait() cuenta también al que está tomando el token; lo que importa es el orden de magnitud.
+		Queued: l.queued.Load(),
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiterRefill(t *testing.T) {
+	tests := []struct {
+		name    string
+		rate    float64
+		burst   int
+		tokens  float64
+		elapsed time.Duration
+		want    float64
+	}{
+		{"medio segundo a 10/s", 10, 20, 0, 500 * time.Millisecond, 5},
+		{"no pasa el burst", 10, 5, 0, 10 * time.Second, 5},
+		{"suma a lo que había", 2, 10, 3, time.Second, 5},
+		{"sin tiempo transcurrido", 50, 50, 1.5, 0, 1.5},
+	}
+	for _, tt := range tests {
+		l := NewRateLimiter(tt.rate, tt.burst)
+		now := time.Now()
+		l.tokens, l.last = tt.tokens, now.Add(-tt.elapsed)
+		l.refill(now)
+		if diff := l.tokens - tt.want; diff > 1e-9 || diff < -1e-9 {
+			t.Errorf("%s: tokens = %v, esperaba %v", tt.name, l.tokens, tt.want)
+		}
+	}
+}
+
+func TestRateLimiterBurstThenThrottle(t *testing.T) {
+	l := NewRateLimiter(20, 3) // un token cada 50ms
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		l.Wait()
+	}
+	if d := time.Since(start); d > 40*time.Millisecond {
+		t.Fatalf("el burst no debería esperar: %v", d)
+	}
+	l.Wait()
+	l.Wait()
+	if d := time.Since(start); d < 90*time.Millisecond {
+		t.Errorf("pasado el burst hay que esperar ~50ms por envío: %v", d)
+	}
+}
+
+func TestRateLimiterConfigure(t *testing.T) {
+	l := NewRateLimiter(10, 10)
+	l.Configure(&RateLimitConfig{MessagesPerSecond: 5, Burst: 2})
+	if st := l.Stats(); st.MessagesPerSecond != 5 || st.Burst != 2 || st.Available > 2 {
+		t.Errorf("achicar el burst recorta los tokens: %+v", st)
+	}
+	l.Configure(nil)
+	if st := l.Stats(); st.MessagesPerSecond != defaultMessagesPerSecond || st.Burst != defaultBurst {
+		t.Errorf("sin config van los valores por defecto: %+v", st)
+	}
+	l.Configure(&RateLimitConfig{MessagesPerSecond: -1})
+	if st := l.Stats(); st.MessagesPerSecond != defaultMessagesPerSecond || st.Burst != defaultBurst {
+		t.Errorf("valores inválidos van por defecto: %+v", st)
+	}
+}
@@ -0,0 +1,517 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ---------------------
+// Tenant registry (configs/tenants.json)
+// ---------------------
+
+const tenantsFile = "tenants.json"
+
+// Zona horaria por defecto si el tenant no define una.
+const defaultTimezone = "America/Argentina/Buenos_Aires"
+
+type TenantsFile struct {
+	// Strict: los phone_number_id desconocidos se descartan siempre (ignora cualquier catch-all).
+	Strict bool `json:"strict"`
+	// CatchAllTenant: tenant que atiende números desconocidos. Hay que declararlo explícitamente.
+	CatchAllTenant string         `json:"catch_all_tenant"`
+	Tenants        []TenantConfig `json:"tenants"`
+}
+
+// TenantConfig es la config "de plataforma" de un tenant (números, credenciales, horarios).
+// Los secretos se referencian, no se escriben: "env:NOMBRE_VAR" o "file:/run/secrets/x".
+type TenantConfig struct {
+	ID             string         `json:"id"`
+	Enabled        bool           `json:"enabled"`
+	PhoneNumberIDs []string       `json:"phone_number_ids"`
+	AccessToken    string         `json:"access_token"`
+	VerifyToken    string         `json:"verify_token"`
+	AppSecret      string         `json:"app_secret"`
+	Timezone       string         `json:"timezone"`
+	Locale         string         `json:"locale"`
+	BusinessHours  *BusinessHours `json:"business_hours,omitempty"`
+	// Asesores con acceso al inbox del tenant (ver inbox.go)
+	Agents []AgentConfig `json:"agents,omitempty"`
+	// Secrets: credenciales de integraciones (ej: API key del CRM), nombre -> secret ref.
+	// Las actions http los usan como {{secret:nombre}} (ver http_action.go).
+	Secrets map[string]string `json:"secrets,omitempty"`
+	// Webhooks: sistemas del tenant a los que se avisan eventos (ver event_webhooks.go)
+	Webhooks []WebhookConfig `json:"webhooks,omitempty"`
+	// SMTP + destinatarios por evento de las notificaciones por email (ver notify_email.go)
+	SMTP               *SMTPConfig                  `json:"smtp,omitempty"`
+	EmailNotifications map[string]EmailNotification `json:"email_notifications,omitempty"`
+	// CRM: provider de contactos del tenant (ver crm.go)
+	CRM *CRMConfig `json:"crm,omitempty"`
+
+	// Resueltos al cargar
+	accessToken string
+	verifyToken string
+	appSecret   string
+	location    *time.Location
+	secrets     map[string]string
+	crm         CRMProvider
+}
+
+// AgentConfig es un asesor del tenant: se autentica en el inbox con su token (secret ref).
+type AgentConfig struct {
+	Name  string `json:"name"`
+	Token string `json:"token"`
+
+	token string
+}
+
+// BusinessHours: horario de atención humana del tenant ("HH:MM", días 0=Domingo, 1=Lunes...).
+// Holidays: fechas sin atención (YYYY-MM-DD). Exceptions: horario especial de una fecha (ver business_hours.go).
+type BusinessHours struct {
+	WorkDays   []int                    `json:"work_days"`
+	Start      string                   `json:"start"`
+	End        string                   `json:"end"`
+	Holidays   []string                 `json:"holidays,omitempty"`
+	Exceptions []BusinessHoursException `json:"exceptions,omitempty"`
+}
+
+var hhmmRe = regexp.MustCompile(`^([01]\d|2[0-3]):[0-5]\d$|^24:00$`)
+
+// resolveSecret resuelve una referencia de secreto: "env:VAR", "file:/path" o el valor literal.
+func resolveSecret(ref string) (string, error) {
+	ref = strings.TrimSpace(ref)
+	switch {
+	case ref == "":
+		return "", nil
+	case strings.HasPrefix(ref, "env:"):
+		name := strings.TrimPrefix(ref, "env:")
+		v := strings.TrimSpace(os.Getenv(name))
+		if v == "" {
+			return "", fmt.Errorf("variable de entorno %s vacía", name)
+		}
+		return v, nil
+	case strings.HasPrefix(ref, "file:"):
+		b, err := os.ReadFile(strings.TrimPrefix(ref, "file:"))
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(b)), nil
+	default:
+		return ref, nil
+	}
+}
+
+// secretErr describe por qué un secret configurado quedó vacío.
+func secretErr(err error) error {
+	if err == nil {
+		return fmt.Errorf("valor vacío")
+	}
+	return err
+}
+
+func loadTenantsFile(path string) (TenantsFile, error) {
+	var f TenantsFile
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return f, err
+	}
+	if err := json.Unmarshal(b, &f); err != nil {
+		return f, fmt.Errorf("json inválido en %s: %w", path, err)
+	}
+	if err := validateTenants(f.Tenants); err != nil {
+		return f, err
+	}
+
+	f.CatchAllTenant = strings.TrimSpace(f.CatchAllTenant)
+	if f.CatchAllTenant != "" {
+		if f.Strict {
+			return f, fmt.Errorf("%s: strict y catch_all_tenant son excluyentes", tenantsFile)
+		}
+		found := false
+		for _, t := range f.Tenants {
+			if t.ID == f.CatchAllTenant && t.Enabled {
+				found = true
+			}
+		}
+		if !found {
+			return f, fmt.Errorf("%s: catch_all_tenant=%s no existe o está deshabilitado", tenantsFile, f.CatchAllTenant)
+		}
+	}
+	return f, nil
+}
+
+// validateTenants valida la estructura y resuelve secretos/zonas horarias.
+// Un secreto faltante no es fatal (se loguea): el tenant queda sin poder enviar o sin verificar firma.
+func validateTenants(tenants []TenantConfig) error {
+	var errs []string
+	seenTenant := map[string]bool{}
+	seenPhone := map[string]string{}
+
+	for i := range tenants {
+		t := &tenants[i]
+		t.ID = strings.TrimSpace(t.ID)
+		if t.ID == "" {
+			errs = append(errs, fmt.Sprintf("tenant #%d sin id", i))
+			continue
+		}
+		if seenTenant[t.ID] {
+			errs = append(errs, fmt.Sprintf("tenant=%s duplicado", t.ID))
+		}
+		seenTenant[t.ID] = true
+
+		if _, err := os.Stat(filepath.Join(configRoot, t.ID, "flow.json")); err != nil {
+			errs = append(errs, fmt.Sprintf("tenant=%s no tiene %s", t.ID, filepath.Join(configRoot, t.ID, "flow.json")))
+		}
+
+		for _, pid := range t.PhoneNumberIDs {
+			pid = strings.TrimSpace(pid)
+			if pid == "" {
+				errs = append(errs, fmt.Sprintf("tenant=%s tiene un phone_number_id vacío", t.ID))
+				continue
+			}
+			if other, ok := seenPhone[pid]; ok {
+				errs = append(errs, fmt.Sprintf("phone_number_id=%s asignado a %s y %s", pid, other, t.ID))
+			}
+			seenPhone[pid] = t.ID
+		}
+
+		tz := t.Timezone
+		if tz == "" {
+			tz = defaultTimezone
+		}
+		loc, err := time.LoadLocation(tz)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("tenant=%s timezone inválida %q: %v", t.ID, t.Timezone, err))
+		}
+		t.location = loc
+
+		if t.BusinessHours != nil {
+			errs = append(errs, validateBusinessHours(t.ID, t.BusinessHours)...)
+		}
+		errs = append(errs, validateWebhooks(t)...)
+		errs = append(errs, validateEmailConfig(t)...)
+		if t.CRM != nil {
+			if t.crm, err = newCRMProvider(t.ID, *t.CRM); err != nil {
+				errs = append(errs, fmt.Sprintf("tenant=%s %v", t.ID, err))
+			}
+		}
+
+		if !t.Enabled {
+			continue
+		}
+		// Sin access_token/app_secret se usan WHATSAPP_TOKEN/WHATSAPP_APP_SECRET; pero si están
+		// configurados y no se resuelven (typo en el env) es un error: caer al global o dejar de
+		// verificar la firma sería fallar abierto.
+		if t.accessToken, err = resolveSecret(t.AccessToken); t.AccessToken != "" && (err != nil || t.accessToken == "") {
+			errs = append(errs, fmt.Sprintf("tenant=%s access_token no resuelto: %v", t.ID, secretErr(err)))
+		}
+		if t.verifyToken, err = resolveSecret(t.VerifyToken); err != nil {
+			log.Printf("⚠️ tenant=%s verify_token no resuelto: %v", t.ID, err)
+		}
+		if t.appSecret, err = resolveSecret(t.AppSecret); t.AppSecret != "" && (err != nil || t.appSecret == "") {
+			errs = append(errs, fmt.Sprintf("tenant=%s app_secret no resuelto: %v", t.ID, secretErr(err)))
+		}
+		seenAgent := map[string]bool{}
+		for j := range t.Agents {
+			ag := &t.Agents[j]
+			ag.Name = strings.TrimSpace(ag.Name)
+			if ag.Name == "" || seenAgent[ag.Name] {
+				errs = append(errs, fmt.Sprintf("tenant=%s agents[%d] sin nombre o duplicado", t.ID, j))
+				continue
+			}
+			seenAgent[ag.Name] = true
+			if ag.token, err = resolveSecret(ag.Token); err != nil || ag.token == "" {
+				log.Printf("⚠️ tenant=%s agente %s sin token utilizable (%v): no podrá entrar al inbox", t.ID, ag.Name, err)
+			}
+		}
+		t.secrets = make(map[string]string, len(t.Secrets))
+		for name, ref := range t.Secrets {
+			v, err := resolveSecret(ref)
+			if err != nil || v == "" {
+				log.Printf("⚠️ tenant=%s secret %s no resuelto (%v): las actions que lo usen van a fallar", t.ID, name, err)
+				continue
+			}
+			t.secrets[name] = v
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("%s inválido:\n- %s", tenantsFile, strings.Join(errs, "\n- "))
+	}
+	return nil
+}
+
+// ---------------------
+// Tenant resolver
+// ---------------------
+
+type TenantResolver struct {
+	byPhoneNumberID map[string]string
+	tenants         map[string]*TenantConfig
+
+	// catchAllTenant atiende los phone_number_id desconocidos; vacío = se descartan.
+	catchAllTenant string
+	strict         bool
+
+	alertMu        sync.Mutex
+	alertedUnknown map[string]bool // phone_number_id -> ya alertado (una vez por número, hasta maxAlertedUnknown)
+}
+
+// NewTenantResolver carga configs/tenants.json. Si no existe, cae al mapeo por env
+// TENANT_BY_PHONE_NUMBER_ID=id:tenant,id2:tenant2 (retrocompatibilidad).
+//
+// Números desconocidos: se descartan, salvo que haya un catch-all explícito
+// (catch_all_tenant en tenants.json o DEFAULT_TENANT). TENANT_STRICT=true o
+// "strict": true fuerzan el descarte aunque haya catch-all.
+func NewTenantResolver() (*TenantResolver, error) {
+	r := &TenantResolver{
+		byPhoneNumberID: map[string]string{},
+		tenants:         map[string]*TenantConfig{},
+		alertedUnknown:  map[string]bool{},
+	}
+
+	path := filepath.Join(configRoot, tenantsFile)
+	f, err := loadTenantsFile(path)
+	switch {
+	case err == nil:
+		r.strict = f.Strict
+		r.catchAllTenant = f.CatchAllTenant
+		r.register(f.Tenants)
+		log.Printf("🏢 %d tenants cargados desde %s", len(f.Tenants), path)
+	case errors.Is(err, os.ErrNotExist):
+		r.loadFromEnv()
+		log.Printf("🏢 %s no existe: usando TENANT_BY_PHONE_NUMBER_ID", path)
+	default:
+		return nil, err
+	}
+
+	if r.catchAllTenant == "" {
+		r.catchAllTenant = strings.TrimSpace(os.Getenv("DEFAULT_TENANT"))
+	}
+	if strings.EqualFold(strings.TrimSpace(os.Getenv("TENANT_STRICT")), "true") {
+		r.strict = true
+	}
+	if r.strict {
+		r.catchAllTenant = ""
+	}
+	if r.catchAllTenant != "" {
+		if t, ok := r.tenants[r.catchAllTenant]; len(r.tenants) > 0 && (!ok || !t.Enabled) {
+			return nil, fmt.Errorf("catch-all tenant %q no existe o está deshabilitado en %s", r.catchAllTenant, tenantsFile)
+		}
+		log.Printf("🏢 catch-all tenant=%s para phone_number_id desconocidos", r.catchAllTenant)
+	} else {
+		log.Printf("🏢 phone_number_id desconocidos se descartan (sin catch-all)")
+	}
+	return r, nil
+}
+
+// register mapea los números de todos los tenants, también los deshabilitados: un número de
+// un tenant pausado tiene dueño (handleMessage lo descarta), no es "desconocido" ni va al catch-all.
+func (r *TenantResolver) register(tenants []TenantConfig) {
+	for i := range tenants {
+		t := &tenants[i]
+		r.tenants[t.ID] = t
+		for _, pid := range t.PhoneNumberIDs {
+			r.byPhoneNumberID[strings.TrimSpace(pid)] = t.ID
+		}
+	}
+}
+
+func (r *TenantResolver) loadFromEnv() {
+	raw := os.Getenv("TENANT_BY_PHONE_NUMBER_ID")
+	if raw == "" {
+		return
+	}
+	for _, p := range strings.Split(raw, ",") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		kv := strings.SplitN(p, ":", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		r.byPhoneNumberID[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+	}
+}
+
+// Tope de números desconocidos que se alertan (y se recuerdan): con la firma verificada
+// no debería haber más que unos pocos, pero no dejamos que el map crezca sin límite.
+const maxAlertedUnknown = 50
+
+// tenantFor devuelve el tenant que atendería el número (el dueño o el catch-all), sin
+// alertar ni loguear. "" si es desconocido: su firma se verifica con WHATSAPP_APP_SECRET.
+func (r *TenantResolver) tenantFor(phoneNumberID string) string {
+	if t, ok := r.byPhoneNumberID[phoneNumberID]; ok && t != "" {
+		return t
+	}
+	return r.catchAllTenant
+}
+
+// Resolve devuelve el tenant del número. ok=false si es desconocido y no hay catch-all:
+// el webhook se descarta (no queremos responder con el flow/branding de otra empresa).
+// Se llama con la firma del webhook ya verificada (ver handleWebhook).
+func (r *TenantResolver) Resolve(phoneNumberID string) (string, bool) {
+	if t, ok := r.byPhoneNumberID[phoneNumberID]; ok && t != "" {
+		return t, true
+	}
+	if r.catchAllTenant != "" {
+		log.Printf("🏢 phone_number_id=%s desconocido: atendido por catch-all tenant=%s", phoneNumberID, r.catchAllTenant)
+		return r.catchAllTenant, true
+	}
+
+	r.alertMu.Lock()
+	alert := !r.alertedUnknown[phoneNumberID] && len(r.alertedUnknown) < maxAlertedUnknown
+	if alert {
+		r.alertedUnknown[phoneNumberID] = true
+	}
+	r.alertMu.Unlock()
+
+	if alert {
+		alertOperator("-", fmt.Sprintf("webhook de phone_number_id desconocido %q descartado (revisar tenants.json)", phoneNumberID))
+	} else {
+		log.Printf("🚫 phone_number_id=%s desconocido: descartado", phoneNumberID)
+	}
+	return "", false
+}
+
+// Config devuelve la config del tenant si está en tenants.json.
+func (r *TenantResolver) Config(tenant string) (*TenantConfig, bool) {
+	t, ok := r.tenants[tenant]
+	return t, ok
+}
+
+// Secret devuelve un secreto de integración del tenant (tenants.json -> secrets).
+func (r *TenantResolver) Secret(tenant, name string) (string, error) {
+	t, ok := r.tenants[tenant]
+	if !ok {
+		return "", fmt.Errorf("tenant %s sin config en %s", tenant, tenantsFile)
+	}
+	v, ok := t.secrets[name]
+	if !ok {
+		return "", fmt.Errorf("tenant %s no tiene el secret %q", tenant, name)
+	}
+	return v, nil
+}
+
+// Enabled: un tenant sin entrada en tenants.json (modo env) se considera habilitado.
+func (r *TenantResolver) Enabled(tenant string) bool {
+	t, ok := r.tenants[tenant]
+	return !ok || t.Enabled
+}
+
+// AccessToken del número: el del tenant dueño del phone_number_id, si lo tiene.
+func (r *TenantResolver) AccessToken(phoneNumberID string) string {
+	if tenant, ok := r.byPhoneNumberID[phoneNumberID]; ok {
+		if t, ok := r.tenants[tenant]; ok {
+			return t.accessToken
+		}
+	}
+	return ""
+}
+
+// MatchesVerifyToken: el GET de verificación no trae phone_number_id, así que vale
+// el VERIFY_TOKEN global o el de cualquier tenant habilitado.
+func (r *TenantResolver) MatchesVerifyToken(token string) bool {
+	if token == "" {
+		return false
+	}
+	for _, t := range r.tenants {
+		if t.Enabled && t.verifyToken != "" && hmac.Equal([]byte(t.verifyToken), []byte(token)) {
+			return true
+		}
+	}
+	return false
+}
+
+// VerifySignature valida X-Hub-Signature-256 con el app_secret del tenant
+// (o WHATSAPP_APP_SECRET). Sin secreto configurado no se verifica.
+func (r *TenantResolver) VerifySignature(tenant string, body []byte, header string) bool {
+	secret := strings.TrimSpace(os.Getenv("WHATSAPP_APP_SECRET"))
+	if t, ok := r.tenants[tenant]; ok && t.appSecret != "" {
+		secret = t.appSecret
+	}
+	if secret == "" {
+		return true
+	}
+	sig, ok := strings.CutPrefix(header, "sha256=")
+	if !ok {
+		return false
+	}
+	got, err := hex.DecodeString(sig)
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hmac.Equal(got, mac.Sum(nil))
+}
+
+// AuthenticateAgent busca el asesor dueño del token. Devuelve su tenant y nombre.
+func (r *TenantResolver) AuthenticateAgent(token string) (tenant, agent string, ok bool) {
+	if token == "" {
+		return "", "", false
+	}
+	for _, t := range r.tenants {
+		if !t.Enabled {
+			continue
+		}
+		for _, ag := range t.Agents {
+			if ag.token != "" && hmac.Equal([]byte(ag.token), []byte(token)) {
+				return t.ID, ag.Name, true
+			}
+		}
+	}
+	return "", "", false
+}
+
+// HasAgent: el asesor figura en tenants.json -> agents del tenant.
+func (r *TenantResolver) HasAgent(tenant, name string) bool {
+	t, ok := r.tenants[tenant]
+	if !ok {
+		return false
+	}
+	for _, ag := range t.Agents {
+		if ag.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Location: zona horaria del tenant (por defecto Buenos Aires).
+func (r *TenantResolver) Location(tenant string) *time.Location {
+	if t, ok := r.tenants[tenant]; ok && t.location != nil {
+		return t.location
+	}
+	loc, err := time.LoadLocation(defaultTimezone)
+	if err != nil {
+		return time.Local
+	}
+	return loc
+}
+
+// tenantRegistry queda accesible para las actions (que solo reciben el nombre del tenant).
+var tenantRegistry *TenantResolver
+
+// tenantLocation devuelve la zona horaria del tenant aunque el registry no esté cargado.
+func tenantLocation(tenant string) *time.Location {
+	if tenantRegistry != nil {
+		return tenantRegistry.Location(tenant)
+	}
+	loc, err := time.LoadLocation(defaultTimezone)
+	if err != nil {
+		return time.Local
+	}
+	return loc
+}
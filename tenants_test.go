@@ -0,0 +1,92 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestResolverKeepsDisabledTenantNumbers(t *testing.T) {
+	r := &TenantResolver{byPhoneNumberID: map[string]string{}, tenants: map[string]*TenantConfig{}, alertedUnknown: map[string]bool{}, catchAllTenant: "broker"}
+	r.register([]TenantConfig{
+		{ID: "broker", Enabled: true, PhoneNumberIDs: []string{"111"}},
+		{ID: "demo_medical", Enabled: false, PhoneNumberIDs: []string{" 222 "}},
+	})
+
+	tests := []struct {
+		phoneID string
+		tenant  string
+		enabled bool
+	}{
+		{"111", "broker", true},
+		{"222", "demo_medical", false},
+		{"333", "broker", true}, // desconocido: catch-all
+	}
+	for _, tt := range tests {
+		tenant, ok := r.Resolve(tt.phoneID)
+		if !ok || tenant != tt.tenant || r.Enabled(tenant) != tt.enabled {
+			t.Errorf("Resolve(%s) = %q, %v (enabled %v), esperaba %q (enabled %v)", tt.phoneID, tenant, ok, r.Enabled(tenant), tt.tenant, tt.enabled)
+		}
+	}
+}
+
+func TestResolveSecret(t *testing.T) {
+	t.Setenv("FLOWLY_TEST_SECRET", " s3cr3t ")
+	file := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(file, []byte("tok-de-archivo\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		ref     string
+		want    string
+		wantErr bool
+	}{
+		{"", "", false},
+		{"literal", "literal", false},
+		{"env:FLOWLY_TEST_SECRET", "s3cr3t", false},
+		{"env:FLOWLY_TEST_INEXISTENTE", "", true},
+		{"file:" + file, "tok-de-archivo", false},
+		{"file:" + file + ".no", "", true},
+	}
+	for _, tt := range tests {
+		got, err := resolveSecret(tt.ref)
+		if got != tt.want || (err != nil) != tt.wantErr {
+			t.Errorf("resolveSecret(%q) = %q, %v", tt.ref, got, err)
+		}
+	}
+}
+
+func TestValidateTenantsSecretRefs(t *testing.T) {
+	t.Setenv("FLOWLY_TEST_TOKEN", "EAAtoken")
+	file := filepath.Join(t.TempDir(), "app_secret")
+	if err := os.WriteFile(file, []byte("secreto\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name          string
+		tenant        TenantConfig
+		wantErr       string
+		token, secret string
+	}{
+		{"env y file resueltos", TenantConfig{ID: "broker", Enabled: true, AccessToken: "env:FLOWLY_TEST_TOKEN", AppSecret: "file:" + file}, "", "EAAtoken", "secreto"},
+		{"sin secretos usa los globales", TenantConfig{ID: "broker", Enabled: true}, "", "", ""},
+		{"access_token con env vacía", TenantConfig{ID: "broker", Enabled: true, AccessToken: "env:FLOWLY_TEST_INEXISTENTE"}, "access_token no resuelto", "", ""},
+		{"app_secret con archivo inexistente", TenantConfig{ID: "broker", Enabled: true, AppSecret: "file:" + file + ".no"}, "app_secret no resuelto", "", ""},
+		{"deshabilitado no resuelve", TenantConfig{ID: "broker", AccessToken: "env:FLOWLY_TEST_INEXISTENTE"}, "", "", ""},
+	}
+	for _, tt := range tests {
+		tenants := []TenantConfig{tt.tenant}
+		err := validateTenants(tenants)
+		switch {
+		case tt.wantErr == "" && err != nil:
+			t.Errorf("%s: %v", tt.name, err)
+		case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+			t.Errorf("%s: err = %v, esperaba %q", tt.name, err, tt.wantErr)
+		case tt.wantErr == "" && (tenants[0].accessToken != tt.token || tenants[0].appSecret != tt.secret):
+			t.Errorf("%s: access_token=%q app_secret=%q", tt.name, tenants[0].accessToken, tenants[0].appSecret)
+		}
+	}
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ---------------------
+// Transcripts (historial de cada conversación)
+// ---------------------
+
+// TranscriptEntry es un mensaje de la conversación: del usuario ("in"), del bot o de un asesor ("out").
+type TranscriptEntry struct {
+	At            time.Time `json:"at"`
+	Direction     string    `json:"direction"`
+	State         string    `json:"state"`
+	Type          string    `json:"type"`
+	Text          string    `json:"text,omitempty"`
+	SelectedID    string    `json:"selected_id,omitempty"`
+	SelectedTitle string    `json:"selected_title,omitempty"`
+	MessageID     string    `json:"message_id,omitempty"`
+	Agent         string    `json:"agent,omitempty"`
+}
+
+// TranscriptStore persiste cada conversación en {dataDir}/{tenant}/transcripts/{wa_id}.jsonl.
+type TranscriptStore struct {
+	mu  sync.Mutex
+	dir string
+}
+
+func NewTranscriptStore(dir string) *TranscriptStore {
+	return &TranscriptStore{dir: dir}
+}
+
+var waIDRe = regexp.MustCompile(`^[0-9]+$`)
+
+func (s *TranscriptStore) path(tenant, waID string) (string, error) {
+	if !waIDRe.MatchString(waID) || strings.ContainsAny(tenant, `/\.`) {
+		return "", fmt.Errorf("conversación inválida %s:%s", tenant, waID)
+	}
+	return filepath.Join(s.dir, tenant, "transcripts", waID+".jsonl"), nil
+}
+
+// Append suma un mensaje al transcript. Un error de disco se loguea: no corta la conversación.
+func (s *TranscriptStore) Append(tenant, waID string, e TranscriptEntry) {
+	if e.At.IsZero() {
+		e.At = time.Now()
+	}
+	p, err := s.path(tenant, waID)
+	if err != nil {
+		log.Printf("⚠️ transcript: %v", err)
+		return
+	}
+	b, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		log.Printf("⚠️ transcript: no se pudo crear %s: %v", filepath.Dir(p), err)
+		return
+	}
+	f, err := os.OpenFile(p, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		log.Printf("⚠️ transcript: no se pudo abrir %s: %v", p, err)
+		return
+	}
+	defer f.Close()
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		log.Printf("⚠️ transcript: no se pudo escribir %s: %v", p, err)
+	}
+}
+
+// Get devuelve el transcript de una conversación (más viejo primero).
+func (s *TranscriptStore) Get(tenant, waID string) ([]TranscriptEntry, error) {
+	p, err := s.path(tenant, waID)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, err := os.Open(p)
+	if os.IsNotExist(err) {
+		return []TranscriptEntry{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	entries := []TranscriptEntry{}
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for sc.Scan() {
+		var e TranscriptEntry
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+			continue
+		}
+		entries = append(entries, e)
+	}
+	return entries, sc.Err()
+}
+
+// Conversations devuelve los wa_id con transcript del tenant.
+func (s *TranscriptStore) Conversations(tenant string) ([]string, error) {
+	if tenant == "" || strings.ContainsAny(tenant, `/\.`) {
+		return nil, fmt.Errorf("tenant inválido: %q", tenant)
+	}
+	files, err := os.ReadDir(filepath.Join(s.dir, tenant, "transcripts"))
+	if os.IsNotExist(err) {
+		return []string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	ids := []string{}
+	for _, f := range files {
+		if id, ok := strings.CutSuffix(f.Name(), ".jsonl"); ok {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+// inboundTranscriptEntry arma la entrada de un mensaje del usuario (state = donde estaba parado).
+func inboundTranscriptEntry(state string, msg IncomingMessage) TranscriptEntry {
+	e := TranscriptEntry{Direction: "in", State: state, Type: msg.Type, MessageID: msg.ID}
+	switch {
+	case msg.Type == "text" && msg.Text != nil:
+		e.Text = msg.Text.Body
+	case msg.Type == "interactive" && msg.Interactive != nil && msg.Interactive.ListReply != nil:
+		e.SelectedID, e.SelectedTitle = msg.Interactive.ListReply.ID, msg.Interactive.ListReply.Title
+	case msg.Type == "interactive" && msg.Interactive != nil && msg.Interactive.ButtonReply != nil:
+		e.SelectedID, e.SelectedTitle = msg.Interactive.ButtonReply.ID, msg.Interactive.ButtonReply.Title
+	case msg.Type == "location" && msg.Location != nil:
+		e.Text = fmt.Sprintf("%f,%f %s", msg.Location.Latitude, msg.Location.Longitude, msg.Location.Address)
+	default:
+		if media, ok := msg.media(); ok {
+			e.Text = strings.TrimSpace(fmt.Sprintf("[%s %s] %s", media.Type, media.ID, media.Caption))
+		}
+	}
+	return e
+}
+
+// writeTranscriptText exporta el transcript legible (horario del tenant).
+func writeTranscriptText(w *bufio.Writer, tenant, waID string, entries []TranscriptEntry) {
+	loc := tenantLocation(tenant)
+	fmt.Fprintf(w, "Conversación %s · %s\n\n", tenant, waID)
+	for _, e := range entries {
+		who := "Usuario"
+		if e.Direction == "out" {
+			who = "Bot"
+			if e.Agent != "" {
+				who = "Asesor " + e.Agent
+			}
+		}
+		text := e.Text
+		if e.SelectedID != "" {
+			text = fmt.Sprintf("[%s] %s", e.SelectedID, e.SelectedTitle)
+		}
+		fmt.Fprintf(w, "%s  %-6s %s (%s/%s):\n%s\n\n", e.At.In(loc).Format("2006-01-02 15:04:05"), e.Direction, who, e.State, e.Type, text)
+	}
+}
+
+// GET /api/transcripts?tenant=broker                          -> wa_id con historial
+// GET /api/transcripts?tenant=broker&wa_id=549…[&format=text] -> historial de la conversación (json|text)
+func (a *App) handleTranscripts(w http.ResponseWriter, r *http.Request) {
+	agent, ok := a.authenticateAgent(w, r)
+	if !ok {
+		return
+	}
+	q := r.URL.Query()
+	tenant := q.Get("tenant")
+	if tenant == "" {
+		tenant = agent.Tenant
+	}
+	if tenant == "" {
+		http.Error(w, "falta tenant", http.StatusBadRequest)
+		return
+	}
+	if !agent.canAccess(tenant) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	waID := q.Get("wa_id")
+	if waID == "" {
+		ids, err := a.transcripts.Conversations(tenant)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, ids)
+		return
+	}
+
+	entries, err := a.transcripts.Get(tenant, waID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	switch q.Get("format") {
+	case "", "json":
+		writeJSON(w, entries)
+	case "text":
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		bw := bufio.NewWriter(w)
+		writeTranscriptText(bw, tenant, waID, entries)
+		_ = bw.Flush()
+	default:
+		http.Error(w, "format inválido (json|text)", http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestTranscriptConversationsRejectsTraversal(t *testing.T) {
+	dir := t.TempDir()
+	s := NewTranscriptStore(dir)
+	s.Append("broker", "5491100000000", TranscriptEntry{Direction: "in", Type: "text", Text: "hola"})
+	if err := os.MkdirAll(filepath.Join(dir, "transcripts"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	if ids, err := s.Conversations("broker"); err != nil || len(ids) != 1 || ids[0] != "5491100000000" {
+		t.Errorf("conversaciones = %v (%v)", ids, err)
+	}
+	for _, tenant := range []string{"", ".", "..", "../broker", `broker\x`} {
+		if _, err := s.Conversations(tenant); err == nil {
+			t.Errorf("tenant %q debería ser inválido", tenant)
+		}
+	}
+}